@@ -1,20 +1,47 @@
 package config
 
 import (
+	"log"
 	"os"
+	"time"
+
+	"evoting-app/internal/tokens"
 )
 
 type Config struct {
-	DatabaseURL   string
-	Port          string
-	SessionSecret string
+	DatabaseURL       string
+	Port              string
+	SessionSecret     string
+	SchedulerInterval time.Duration
+	TokenFormat       string // how new voting tokens look; see tokens.Formats
+
+	// Token delivery by email is off unless SMTPHost is set
+	SMTPHost         string
+	SMTPPort         string
+	SMTPUsername     string
+	SMTPPassword     string
+	MailFrom         string
+	MailInterval     time.Duration
+	MailBounceSecret string // bearer token for the bounce webhook, which is off without it
+	BaseURL          string // where voters reach the application, for links in emails and on token slips
 }
 
 func Load() *Config {
+	port := getEnv("PORT", "8080")
 	return &Config{
-		DatabaseURL:   getEnv("DATABASE_URL", "evoting.db"),
-		Port:          getEnv("PORT", "8080"),
-		SessionSecret: getEnv("SESSION_SECRET", "your-secret-key-change-this-in-production"),
+		DatabaseURL:       getEnv("DATABASE_URL", "evoting.db"),
+		Port:              port,
+		SessionSecret:     getEnv("SESSION_SECRET", "your-secret-key-change-this-in-production"),
+		SchedulerInterval: getDurationEnv("SCHEDULER_INTERVAL", time.Minute),
+		TokenFormat:       getTokenFormatEnv("TOKEN_FORMAT", tokens.Base32),
+		SMTPHost:          os.Getenv("SMTP_HOST"),
+		SMTPPort:          getEnv("SMTP_PORT", "587"),
+		SMTPUsername:      os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:      os.Getenv("SMTP_PASSWORD"),
+		MailFrom:          getEnv("MAIL_FROM", "E-Voting <evoting@localhost>"),
+		MailInterval:      getDurationEnv("MAIL_INTERVAL", 30*time.Second),
+		MailBounceSecret:  os.Getenv("MAIL_BOUNCE_SECRET"),
+		BaseURL:           getEnv("BASE_URL", "http://localhost:"+port),
 	}
 }
 
@@ -24,3 +51,28 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func getTokenFormatEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if _, ok := tokens.Formats[value]; !ok {
+		log.Printf("Ignoring invalid %s %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return value
+}
@@ -1,13 +1,26 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+
+	"evoting-app/internal/ledger"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func Initialize(databaseURL string) (*sql.DB, error) {
+	// Transactions take the write lock when they begin, and concurrent
+	// writers wait for it instead of failing with "database is locked", e.g.
+	// when voters submit at the same moment.
+	databaseURL = withParam(databaseURL, "_busy_timeout", "5000")
+	databaseURL = withParam(databaseURL, "_txlock", "immediate")
+	// SQLite only enforces the schema's foreign keys when asked to, on every
+	// connection.
+	databaseURL = withParam(databaseURL, "_foreign_keys", "on")
+
 	db, err := sql.Open("sqlite3", databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -17,17 +30,54 @@ func Initialize(databaseURL string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
+	var foreignKeys bool
+	if err := db.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys); err != nil {
+		return nil, fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	if !foreignKeys {
+		return nil, fmt.Errorf("failed to enable foreign keys")
+	}
+
 	return db, nil
 }
 
+// withParam adds a connection parameter to the database URL unless it is
+// already set there.
+func withParam(databaseURL, name, value string) string {
+	if strings.Contains(databaseURL, name+"=") {
+		return databaseURL
+	}
+	separator := "?"
+	if strings.Contains(databaseURL, "?") {
+		separator = "&"
+	}
+	return databaseURL + separator + name + "=" + value
+}
+
 func Migrate(db *sql.DB) error {
 	migrations := []string{
 		createUsersTable,
 		createElectionsTable,
+		createContestsTable,
 		createCandidatesTable,
 		createVotingTokensTable,
 		createVotesTable,
 		createElectionAdminsTable,
+		createVoteSelectionsTable,
+		createBallotsTable,
+		createBallotLedgerTable,
+		preventLedgerUpdates,
+		preventLedgerDeletes,
+		createAuditLogTable,
+		createElectionKeysTable,
+		createTrusteesTable,
+		createDealtSharesTable,
+		createSealedBallotsTable,
+		createDecryptionSharesTable,
+		createTieDrawsTable,
+		createVotersTable,
+		createEmailOutboxTable,
+		backfillVoteSelections,
 		insertDefaultSuperAdmin,
 	}
 
@@ -37,9 +87,349 @@ func Migrate(db *sql.DB) error {
 		}
 	}
 
+	for _, column := range columnMigrations {
+		if err := addColumnIfMissing(db, column); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", column.table, column.name, err)
+		}
+	}
+
+	for _, upgrade := range dataMigrations {
+		if err := upgrade(db); err != nil {
+			return fmt.Errorf("failed to migrate data: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// columnMigration describes a column added to a table after its initial
+// CREATE TABLE statement, so that existing databases pick it up as well.
+type columnMigration struct {
+	table      string
+	name       string
+	definition string
+}
+
+var columnMigrations = []columnMigration{
+	{"elections", "voting_method", "TEXT NOT NULL DEFAULT 'plurality'"},
+	// seats and max_selections moved to contests; on elections they only
+	// seed the contest created for elections that predate contests.
+	{"elections", "seats", "INTEGER NOT NULL DEFAULT 1"},
+	{"elections", "max_selections", "INTEGER NOT NULL DEFAULT 1"},
+	{"candidates", "contest_id", "INTEGER REFERENCES contests(id) ON DELETE CASCADE"},
+	{"contests", "kind", "TEXT NOT NULL DEFAULT 'candidates'"},
+	{"contests", "pass_threshold", "TEXT NOT NULL DEFAULT 'majority'"},
+	{"candidates", "stance", "TEXT NOT NULL DEFAULT ''"},
+	// start_date and end_date are stored in UTC; timezone is the IANA zone
+	// the window was entered and is shown in.
+	{"elections", "timezone", "TEXT NOT NULL DEFAULT 'UTC'"},
+	// auto_status lets the scheduler move the election between statuses as
+	// its voting window opens and closes; a manual status change clears it.
+	// Elections from before the scheduler keep being managed by hand; new
+	// ones are created with it set.
+	{"elections", "auto_status", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	// encrypted elections seal their ballots until trustees decrypt them.
+	{"elections", "encrypted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	// results_embargo hides tallies and votes until the election has ended.
+	{"elections", "results_embargo", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	// results_published_at is when an admin published the results of a
+	// completed election on its public results page; NULL while unpublished.
+	{"elections", "results_published_at", "DATETIME"},
+	// tie_break is how a tie for a winning place is settled: "unresolved",
+	// "runoff" or "lot".
+	{"elections", "tie_break", "TEXT NOT NULL DEFAULT 'unresolved'"},
+	// parent_election_id links a runoff to the election it was created from.
+	{"elections", "parent_election_id", "INTEGER REFERENCES elections(id) ON DELETE SET NULL"},
+	// The quorum rule: the turnout, in percent of issued tokens or of the
+	// registered voters, and the share of the counted ballots a winner needs
+	// for the result to be valid. 0 means no requirement.
+	{"elections", "quorum_percent", "INTEGER NOT NULL DEFAULT 0"},
+	{"elections", "quorum_basis", "TEXT NOT NULL DEFAULT 'tokens'"},
+	{"elections", "registered_voters", "INTEGER NOT NULL DEFAULT 0"},
+	{"elections", "min_winning_share", "INTEGER NOT NULL DEFAULT 0"},
+	// weight is how many votes a token casts, such as a member's shares. A
+	// ballot carries its token's weight, since nothing else on it leads back
+	// to the token; ballots without a ballots row weigh 1.
+	{"voting_tokens", "weight", "INTEGER NOT NULL DEFAULT 1"},
+	{"ballots", "weight", "INTEGER NOT NULL DEFAULT 1"},
+	// Tokens printed as slips for a polling venue: the print run, numbered
+	// within the election, and the slip's number within it.
+	{"voting_tokens", "print_batch", "INTEGER"},
+	{"voting_tokens", "print_serial", "INTEGER"},
+	{"voting_tokens", "printed_at", "DATETIME"},
+	// A token stops working when it expires, or when an admin revokes it,
+	// such as after it leaked. A lost token is revoked and replaced_by
+	// names the token reissued to the voter in its place.
+	{"voting_tokens", "expires_at", "DATETIME"},
+	{"voting_tokens", "revoked_at", "DATETIME"},
+	{"voting_tokens", "revoked_reason", "TEXT NOT NULL DEFAULT ''"},
+	{"voting_tokens", "replaced_by", "INTEGER REFERENCES voting_tokens(id) ON DELETE SET NULL"},
+}
+
+// dataMigrations run once the schema is in place and bring rows written by
+// earlier versions up to date. Each must be safe to run repeatedly.
+var dataMigrations = []func(*sql.DB) error{
+	migrateToContests,
+	allowBlankVotes,
+	separateBallotsFromTokens,
+	chainExistingBallots,
+	coarsenTokenUseTimes,
+}
+
+func addColumnIfMissing(db *sql.DB, column columnMigration) error {
+	exists, err := hasColumn(db, column.table, column.name)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition))
+	return err
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	exists, _, err := columnInfo(db, table, column)
+	return exists, err
+}
+
+// columnInfo reports whether table has the column and whether it is
+// declared NOT NULL.
+func columnInfo(db *sql.DB, table, column string) (exists, notNull bool, err error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, false, err
+		}
+		if name == column {
+			return true, notNull, nil
+		}
+	}
+
+	return false, false, rows.Err()
+}
+
+// migrateToContests gives every election that still has candidates outside
+// a contest a single contest holding them, and rebuilds the votes table so
+// that a token casts one vote per contest instead of one per election.
+func migrateToContests(db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO contests (election_id, title, seats, max_selections)
+		SELECT e.id, e.title, e.seats, e.max_selections FROM elections e
+		WHERE NOT EXISTS (SELECT 1 FROM contests c WHERE c.election_id = e.id)
+		  AND EXISTS (SELECT 1 FROM candidates ca WHERE ca.election_id = e.id AND ca.contest_id IS NULL)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE candidates
+		SET contest_id = (SELECT MIN(c.id) FROM contests c WHERE c.election_id = candidates.election_id)
+		WHERE contest_id IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	perContest, err := hasColumn(db, "votes", "contest_id")
+	if err != nil || perContest {
+		return err
+	}
+
+	return rebuildTable(db, []string{
+		strings.Replace(createLinkedVotesTable, "votes (", "votes_per_contest (", 1),
+		`INSERT INTO votes_per_contest (id, election_id, contest_id, candidate_id, token_id, voted_at)
+		 SELECT v.id, v.election_id, c.contest_id, v.candidate_id, v.token_id, v.voted_at
+		 FROM votes v JOIN candidates c ON v.candidate_id = c.id`,
+		`DROP TABLE votes`,
+		`ALTER TABLE votes_per_contest RENAME TO votes`,
+	})
+}
+
+// allowBlankVotes rebuilds a votes table whose candidate_id is still NOT
+// NULL, so that blank ballots can be stored as votes without a candidate.
+func allowBlankVotes(db *sql.DB) error {
+	_, notNull, err := columnInfo(db, "votes", "candidate_id")
+	if err != nil || !notNull {
+		return err
+	}
+
+	return rebuildTable(db, []string{
+		strings.Replace(createLinkedVotesTable, "votes (", "votes_nullable (", 1),
+		`INSERT INTO votes_nullable (id, election_id, contest_id, candidate_id, token_id, voted_at)
+		 SELECT id, election_id, contest_id, candidate_id, token_id, voted_at FROM votes`,
+		`DROP TABLE votes`,
+		`ALTER TABLE votes_nullable RENAME TO votes`,
+	})
+}
+
+// separateBallotsFromTokens moves votes recorded with their token_id and
+// voted_at into the ballot box: each token's votes become one ballot with a
+// random ballot_id, and every vote gets a random row ID that its selections
+// follow. The tokens themselves stay marked as used.
+//
+// The old rows are overwritten as they are deleted and the file is vacuumed
+// afterwards, since rows left behind in free pages would still link each
+// selection to the token and time it was cast with.
+func separateBallotsFromTokens(db *sql.DB) error {
+	linked, err := hasColumn(db, "votes", "token_id")
+	if err != nil || !linked {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA secure_delete = ON`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA secure_delete = OFF`)
+
+	err = rebuildTableOn(ctx, conn, []string{
+		`CREATE TEMP TABLE ballot_ids AS
+		 SELECT token_id, lower(hex(randomblob(16))) AS ballot_id FROM votes GROUP BY token_id`,
+		`CREATE TEMP TABLE vote_ids AS
+		 SELECT id AS old_id, random() & 9223372036854775807 AS new_id FROM votes`,
+		strings.Replace(createVotesTable, "votes (", "ballot_box (", 1),
+		`INSERT INTO ballot_box (id, ballot_id, election_id, contest_id, candidate_id)
+		 SELECT vi.new_id, b.ballot_id, v.election_id, v.contest_id, v.candidate_id
+		 FROM votes v
+		 JOIN vote_ids vi ON vi.old_id = v.id
+		 JOIN ballot_ids b ON b.token_id = v.token_id
+		 ORDER BY vi.new_id`,
+		strings.Replace(createVoteSelectionsTable, "vote_selections (", "ballot_selections (", 1),
+		`INSERT INTO ballot_selections (vote_id, candidate_id, preference)
+		 SELECT vi.new_id, vs.candidate_id, vs.preference
+		 FROM vote_selections vs JOIN vote_ids vi ON vi.old_id = vs.vote_id`,
+		`DROP TABLE vote_selections`,
+		`DROP TABLE votes`,
+		`ALTER TABLE ballot_box RENAME TO votes`,
+		`ALTER TABLE ballot_selections RENAME TO vote_selections`,
+		`DROP TABLE ballot_ids`,
+		`DROP TABLE vote_ids`,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+// chainExistingBallots starts the ledger of a database that has ballots but
+// no ledger yet, chaining each election's ballots in ballot ID order since
+// the order they were cast in is not known. It does nothing once the ledger
+// has entries: ballots missing from it then are exactly what verification
+// must report, not something to add.
+func chainExistingBallots(db *sql.DB) error {
+	var entries int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ballot_ledger`).Scan(&entries); err != nil || entries > 0 {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT election_id, ballot_id FROM votes ORDER BY election_id, ballot_id`)
+	if err != nil {
+		return err
+	}
+	type ballot struct {
+		electionID int
+		id         string
+	}
+	var ballots []ballot
+	for rows.Next() {
+		var b ballot
+		if err := rows.Scan(&b.electionID, &b.id); err != nil {
+			rows.Close()
+			return err
+		}
+		ballots = append(ballots, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ballots) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, b := range ballots {
+		contents, err := ledger.ReadBallot(tx, b.id)
+		if err == ledger.ErrInconsistent {
+			// Left out, so that verification reports it.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := ledger.Append(tx, b.electionID, b.id, ledger.Digest(b.electionID, b.id, 1, contents)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// coarsenTokenUseTimes keeps only the day of the times tokens were used,
+// which is all that is recorded now.
+func coarsenTokenUseTimes(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE voting_tokens SET used_at = DATE(used_at) WHERE used_at IS NOT NULL AND used_at != DATE(used_at)`)
+	return err
+}
+
+// rebuildTable runs the statements that replace a table in one transaction,
+// on a connection with foreign keys switched off as SQLite requires for
+// schema changes: with them on, dropping the old table would cascade into
+// every table that references it.
+func rebuildTable(db *sql.DB, statements []string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return rebuildTableOn(ctx, conn, statements)
+}
+
+// rebuildTableOn is rebuildTable on a connection the caller has set up.
+func rebuildTableOn(ctx context.Context, conn *sql.Conn, statements []string) error {
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 const createUsersTable = `
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -64,6 +454,22 @@ CREATE TABLE IF NOT EXISTS elections (
     FOREIGN KEY (created_by) REFERENCES users(id)
 );`
 
+// A contest is one position (or question) on an election's ballot. A single
+// voting token casts one vote in every contest of its election.
+const createContestsTable = `
+CREATE TABLE IF NOT EXISTS contests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    election_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT,
+    seats INTEGER NOT NULL DEFAULT 1,
+    max_selections INTEGER NOT NULL DEFAULT 1,
+    order_num INTEGER DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+);`
+
 const createCandidatesTable = `
 CREATE TABLE IF NOT EXISTS candidates (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -88,17 +494,81 @@ CREATE TABLE IF NOT EXISTS voting_tokens (
     FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
 );`
 
+// The ballot box. A ballot is stored as one votes row per contest, grouped
+// by a random ballot_id; nothing on it refers back to the token that cast it
+// or records when it was cast. Row IDs are random too, so the order of the
+// rows does not give the order of the ballots away. voting_tokens.is_used is
+// the ledger of spent tokens, written in the same transaction.
 const createVotesTable = `
+CREATE TABLE IF NOT EXISTS votes (
+    id INTEGER PRIMARY KEY,
+    ballot_id TEXT NOT NULL,
+    election_id INTEGER NOT NULL,
+    contest_id INTEGER NOT NULL,
+    candidate_id INTEGER, -- NULL for a blank vote
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE,
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    FOREIGN KEY (candidate_id) REFERENCES candidates(id) ON DELETE CASCADE,
+    UNIQUE(ballot_id, contest_id)
+);`
+
+// Every ballot cast since receipts were introduced has a row here holding
+// the receipt code given to the voter, a digest of the ballot's contents.
+const createBallotsTable = `
+CREATE TABLE IF NOT EXISTS ballots (
+    id TEXT PRIMARY KEY, -- the ballot_id its votes rows share
+    election_id INTEGER NOT NULL,
+    receipt TEXT UNIQUE NOT NULL,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+) WITHOUT ROWID;`
+
+// The ballot ledger is a hash chain over each election's ballots, in the
+// order they were cast. Every entry commits to the entry before it and to a
+// digest of its ballot; see the ledger package.
+const createBallotLedgerTable = `
+CREATE TABLE IF NOT EXISTS ballot_ledger (
+    election_id INTEGER NOT NULL,
+    position INTEGER NOT NULL, -- 1 for the election's first ballot
+    ballot_id TEXT UNIQUE NOT NULL,
+    ballot_hash TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    PRIMARY KEY (election_id, position),
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+) WITHOUT ROWID;`
+
+// The ledger is append-only. Entries only go when their election is deleted.
+const preventLedgerUpdates = `
+CREATE TRIGGER IF NOT EXISTS ballot_ledger_no_update
+BEFORE UPDATE ON ballot_ledger
+BEGIN
+    SELECT RAISE(ABORT, 'ballot_ledger is append-only');
+END;`
+
+const preventLedgerDeletes = `
+CREATE TRIGGER IF NOT EXISTS ballot_ledger_no_delete
+BEFORE DELETE ON ballot_ledger
+WHEN EXISTS (SELECT 1 FROM elections WHERE id = OLD.election_id)
+BEGIN
+    SELECT RAISE(ABORT, 'ballot_ledger is append-only');
+END;`
+
+// createLinkedVotesTable is the votes table as it was before ballots were
+// separated from tokens. The migrations that bring older databases up to
+// that layout still build it.
+const createLinkedVotesTable = `
 CREATE TABLE IF NOT EXISTS votes (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     election_id INTEGER NOT NULL,
-    candidate_id INTEGER NOT NULL,
+    contest_id INTEGER NOT NULL,
+    candidate_id INTEGER, -- NULL for a blank vote
     token_id INTEGER NOT NULL,
     voted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE,
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
     FOREIGN KEY (candidate_id) REFERENCES candidates(id) ON DELETE CASCADE,
     FOREIGN KEY (token_id) REFERENCES voting_tokens(id) ON DELETE CASCADE,
-    UNIQUE(token_id)
+    UNIQUE(token_id, contest_id)
 );`
 
 const createElectionAdminsTable = `
@@ -112,6 +582,165 @@ CREATE TABLE IF NOT EXISTS election_admins (
     UNIQUE(election_id, user_id)
 );`
 
+// Every ballot keeps one votes row per contest (holding the first
+// preference) plus one row here for every candidate the voter chose in that
+// contest, in preference order. The table has no row ID of its own, which
+// would number the selections in the order they were cast.
+const createVoteSelectionsTable = `
+CREATE TABLE IF NOT EXISTS vote_selections (
+    vote_id INTEGER NOT NULL,
+    candidate_id INTEGER NOT NULL,
+    preference INTEGER NOT NULL,
+    PRIMARY KEY (vote_id, preference),
+    FOREIGN KEY (vote_id) REFERENCES votes(id) ON DELETE CASCADE,
+    FOREIGN KEY (candidate_id) REFERENCES candidates(id) ON DELETE CASCADE,
+    UNIQUE(vote_id, candidate_id)
+) WITHOUT ROWID;`
+
+// The audit log keeps a record of events worth reviewing later, such as
+// rejected ballots. Entries outlive the election and user they mention.
+const createAuditLogTable = `
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    election_id INTEGER,
+    user_id INTEGER,
+    action TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE SET NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);`
+
+// An encrypted election has one key, which its trustees make between them.
+// Only the public half is stored, once every trustee has dealt; the secret
+// exists nowhere, not even as shares, which only the trustees can work out.
+// decrypted_at is set once enough trustees have decrypted the ballots.
+const createElectionKeysTable = `
+CREATE TABLE IF NOT EXISTS election_keys (
+    election_id INTEGER PRIMARY KEY,
+    public_key TEXT,
+    threshold INTEGER NOT NULL, -- trustees needed to decrypt
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    decrypted_at DATETIME,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+);`
+
+// A trustee takes part in making an election key and holds one share of
+// it. personal_key is the trustee's own public key, that the others seal
+// the shares they deal to them to, and commitments their dealing's
+// commitments, comma separated. verification_key, g raised to the
+// trustee's share, is worked out from every dealing's commitments and
+// checks what the trustee computes with their share.
+const createTrusteesTable = `
+CREATE TABLE IF NOT EXISTS trustees (
+    election_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    share_index INTEGER NOT NULL,
+    personal_key TEXT,
+    commitments TEXT,
+    verification_key TEXT,
+    confirmed_at DATETIME, -- when the trustee proved they hold their share
+    decrypted_at DATETIME,
+    PRIMARY KEY (election_id, user_id),
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    UNIQUE(election_id, share_index)
+);`
+
+// The shares each trustee deals to the others, sealed to the recipient's
+// personal key so that only they can read them.
+const createDealtSharesTable = `
+CREATE TABLE IF NOT EXISTS dealt_shares (
+    election_id INTEGER NOT NULL,
+    dealer_index INTEGER NOT NULL,
+    recipient_index INTEGER NOT NULL,
+    ephemeral_key TEXT NOT NULL,
+    ciphertext TEXT NOT NULL,
+    PRIMARY KEY (election_id, dealer_index, recipient_index),
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+) WITHOUT ROWID;`
+
+// Ballots of an encrypted election, sealed to its key. They are decrypted
+// into the ballot box under the same ballot ID once enough trustees have
+// submitted their partial decryptions.
+const createSealedBallotsTable = `
+CREATE TABLE IF NOT EXISTS sealed_ballots (
+    id TEXT PRIMARY KEY,
+    election_id INTEGER NOT NULL,
+    ephemeral_key TEXT NOT NULL,
+    ciphertext TEXT NOT NULL,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE
+) WITHOUT ROWID;`
+
+const createDecryptionSharesTable = `
+CREATE TABLE IF NOT EXISTS decryption_shares (
+    ballot_id TEXT NOT NULL,
+    share_index INTEGER NOT NULL,
+    partial TEXT NOT NULL,
+    proof TEXT NOT NULL, -- that the partial was made with the trustee's share
+    PRIMARY KEY (ballot_id, share_index),
+    FOREIGN KEY (ballot_id) REFERENCES sealed_ballots(id) ON DELETE CASCADE
+) WITHOUT ROWID;`
+
+// A lot drawn to break a tie in a contest. The draw is fully determined by
+// the seed and the tied candidates, so anyone can repeat it.
+const createTieDrawsTable = `
+CREATE TABLE IF NOT EXISTS tie_draws (
+    contest_id INTEGER PRIMARY KEY,
+    candidates TEXT NOT NULL, -- tied candidate IDs, comma separated, ascending
+    seed TEXT NOT NULL,
+    drawn_by INTEGER,
+    drawn_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (contest_id) REFERENCES contests(id) ON DELETE CASCADE,
+    FOREIGN KEY (drawn_by) REFERENCES users(id) ON DELETE SET NULL
+);`
+
+// The voter roll of an election. Each voter is issued one token, and
+// whether they have voted is read from it; nothing leads from a voter to
+// their ballot.
+const createVotersTable = `
+CREATE TABLE IF NOT EXISTS voters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    election_id INTEGER NOT NULL,
+    member_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    group_name TEXT NOT NULL DEFAULT '',
+    token_id INTEGER UNIQUE,
+    delivered_at DATETIME, -- when the voter was given their token
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE,
+    FOREIGN KEY (token_id) REFERENCES voting_tokens(id) ON DELETE SET NULL,
+    UNIQUE(election_id, member_id)
+);`
+
+// The email outbox holds the messages sent to voters, each waiting in the queue
+// until it is sent, given up on or cancelled. The body is rendered when the
+// message is sent, so tokens are not copied into the outbox.
+const createEmailOutboxTable = `
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    election_id INTEGER NOT NULL,
+    voter_id INTEGER NOT NULL,
+    kind TEXT NOT NULL, -- invitation or reminder
+    recipient TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued', -- queued, sent, failed, bounced or cancelled
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME,
+    last_error TEXT NOT NULL DEFAULT '',
+    message_id TEXT,
+    sent_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (election_id) REFERENCES elections(id) ON DELETE CASCADE,
+    FOREIGN KEY (voter_id) REFERENCES voters(id) ON DELETE CASCADE
+);`
+
+const backfillVoteSelections = `
+INSERT INTO vote_selections (vote_id, candidate_id, preference)
+SELECT v.id, v.candidate_id, 1 FROM votes v
+WHERE v.candidate_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM vote_selections vs WHERE vs.vote_id = v.id);`
+
 const insertDefaultSuperAdmin = `
 INSERT OR IGNORE INTO users (username, password, role) 
 VALUES ('superadmin', '$2a$10$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi', 'superadmin');`
@@ -0,0 +1,420 @@
+// Package elgamal seals ballots to an election key whose private half is
+// split among trustees. A ballot is encrypted with AES-GCM under a key
+// agreed with ElGamal; opening it needs the ElGamal secret, which the
+// trustees create between them without it ever existing in one place: each
+// deals Shamir shares of a secret of their own, and holds the sum of the
+// shares dealt to them. Each trustee contributes a partial decryption per
+// ballot, computed from their share on their own machine and proved
+// correct, and any threshold of those combine into the secret the ballot
+// was sealed with.
+package elgamal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// The group is the 2048-bit MODP group of RFC 3526: p is a safe prime,
+// p = 2q + 1, and g = 4 generates the subgroup of prime order q.
+var (
+	p = mustHex(`
+		FFFFFFFF FFFFFFFF C90FDAA2 2168C234 C4C6628B 80DC1CD1
+		29024E08 8A67CC74 020BBEA6 3B139B22 514A0879 8E3404DD
+		EF9519B3 CD3A431B 302B0A6D F25F1437 4FE1356D 6D51C245
+		E485B576 625E7EC6 F44C42E9 A637ED6B 0BFF5CB6 F406B7ED
+		EE386BFB 5A899FA5 AE9F2411 7C4B1FE6 49286651 ECE45B3D
+		C2007CB8 A163BF05 98DA4836 1C55D39A 69163FA8 FD24CF5F
+		83655D23 DCA3AD96 1C62F356 208552BB 9ED52907 7096966D
+		670C354E 4ABC9804 F1746C08 CA18217C 32905E46 2E36CE3B
+		E39E772C 180E8603 9B2783A2 EC07A28F B5C55DF0 6F4C52C9
+		DE2BCBF6 95581718 3995497C EA956AE5 15D22618 98FA0510
+		15728E5A 8AACAA68 FFFFFFFF FFFFFFFF`)
+	q = new(big.Int).Rsh(p, 1)
+	g = big.NewInt(4)
+)
+
+func mustHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(strings.Join(strings.Fields(s), ""), 16)
+	if !ok {
+		panic("elgamal: invalid group constant")
+	}
+	return n
+}
+
+// Share is one trustee's share of an election's secret key: the value of
+// the sharing polynomial at Index.
+type Share struct {
+	Index int
+	Value *big.Int
+}
+
+// GenerateKey creates a key pair, returning the secret exponent and the
+// public key g^secret.
+func GenerateKey() (*big.Int, *big.Int, error) {
+	secret, err := randomExponent()
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, new(big.Int).Exp(g, secret, p), nil
+}
+
+// Deal picks a random secret and splits it into one share for each of the
+// given indices, any threshold of which can decrypt. It returns the
+// commitments to the sharing polynomial, g raised to each coefficient, with
+// which every share can be checked and the public key worked out; the
+// secret itself is not returned.
+//
+// The trustees of an election each deal a secret of their own. The
+// election's secret is the sum of them, and each trustee's share of it the
+// sum of the shares dealt to them, so the secret is never put together
+// anywhere.
+func Deal(threshold int, indices []int) ([]*big.Int, []Share, error) {
+	if threshold < 1 || threshold > len(indices) {
+		return nil, nil, fmt.Errorf("threshold must be between 1 and %d", len(indices))
+	}
+
+	// f(z) = a0 + a1 z + ... + a(t-1) z^(t-1) over Z_q, with a0 the secret.
+	coefficients := make([]*big.Int, threshold)
+	commitments := make([]*big.Int, threshold)
+	for i := range coefficients {
+		c, err := randomExponent()
+		if err != nil {
+			return nil, nil, err
+		}
+		coefficients[i] = c
+		commitments[i] = new(big.Int).Exp(g, c, p)
+	}
+
+	shares := make([]Share, len(indices))
+	for i, index := range indices {
+		if index < 1 {
+			return nil, nil, errors.New("elgamal: share indices start at 1")
+		}
+		z := big.NewInt(int64(index))
+		value := new(big.Int)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			value.Mul(value, z)
+			value.Add(value, coefficients[j])
+			value.Mod(value, q)
+		}
+		shares[i] = Share{Index: index, Value: value}
+	}
+
+	return commitments, shares, nil
+}
+
+// Committed is g raised to the value at index of the polynomial the
+// commitments were made to: the verification key of the share dealt for
+// index, worked out without knowing it. The first commitment is the
+// dealer's part of the public key.
+func Committed(commitments []*big.Int, index int) *big.Int {
+	z := big.NewInt(int64(index))
+	power := big.NewInt(1)
+	result := big.NewInt(1)
+	for _, c := range commitments {
+		result.Mul(result, new(big.Int).Exp(c, power, p))
+		result.Mod(result, p)
+		power.Mul(power, z)
+		power.Mod(power, q)
+	}
+	return result
+}
+
+// Product multiplies group elements, such as the dealers' parts of a
+// public key or verification key.
+func Product(elements []*big.Int) *big.Int {
+	result := big.NewInt(1)
+	for _, e := range elements {
+		result.Mul(result, e)
+		result.Mod(result, p)
+	}
+	return result
+}
+
+// VerificationKey is g raised to the share, published so that what a
+// trustee computes with their share can be checked without knowing it.
+func VerificationKey(share Share) *big.Int {
+	return new(big.Int).Exp(g, share.Value, p)
+}
+
+// CheckShare reports whether a dealt share is the one the dealer committed
+// to.
+func CheckShare(commitments []*big.Int, share Share) bool {
+	return VerificationKey(share).Cmp(Committed(commitments, share.Index)) == 0
+}
+
+// AddShares sums the shares dealt to one index into that index's share of
+// the combined secret.
+func AddShares(index int, values []*big.Int) Share {
+	sum := new(big.Int)
+	for _, v := range values {
+		sum.Add(sum, v)
+	}
+	return Share{Index: index, Value: sum.Mod(sum, q)}
+}
+
+// ParseExponent reads a secret exponent written in hex, such as a
+// trustee's own secret key or a share dealt to them.
+func ParseExponent(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(strings.TrimSpace(s), 16)
+	if !ok || n.Sign() <= 0 || n.Cmp(q) >= 0 {
+		return nil, errors.New("elgamal: not a valid exponent")
+	}
+	return n, nil
+}
+
+// Seal encrypts plaintext to the public key. It returns the ephemeral
+// public value g^r and the AES-GCM ciphertext, nonce first; additionalData
+// is authenticated but not encrypted, and must be the same when opening.
+func Seal(publicKey *big.Int, plaintext, additionalData []byte) (*big.Int, []byte, error) {
+	if !inGroup(publicKey) {
+		return nil, nil, errors.New("elgamal: public key is not in the group")
+	}
+
+	r, err := randomExponent()
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral := new(big.Int).Exp(g, r, p)
+	shared := new(big.Int).Exp(publicKey, r, p)
+
+	aead, err := newAEAD(shared)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return ephemeral, aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// PartialDecrypt is a trustee's contribution to opening a ballot sealed
+// with the given ephemeral value, with a proof that it was computed with
+// the share behind the trustee's verification key.
+func PartialDecrypt(ephemeral *big.Int, share Share) (*big.Int, *Proof, error) {
+	// Raising anything outside the group to the share would leak
+	// information about the share.
+	if !inGroup(ephemeral) {
+		return nil, nil, errors.New("elgamal: ephemeral value is not in the group")
+	}
+	partial := new(big.Int).Exp(ephemeral, share.Value, p)
+	proof, err := proveEqualLogs(share.Value, ephemeral, VerificationKey(share), partial)
+	if err != nil {
+		return nil, nil, err
+	}
+	return partial, proof, nil
+}
+
+// CheckPartial reports whether a partial decryption of the ballot sealed
+// with ephemeral was made with the share behind verificationKey.
+func CheckPartial(ephemeral, verificationKey, partial *big.Int, proof *Proof) bool {
+	if !inGroup(ephemeral) || !inGroup(verificationKey) || !inGroup(partial) {
+		return false
+	}
+	return checkEqualLogs(ephemeral, verificationKey, partial, proof)
+}
+
+// ProveShare proves that the trustee holds the share behind their
+// verification key, without revealing it.
+func ProveShare(share Share) (*Proof, error) {
+	w, err := randomExponent()
+	if err != nil {
+		return nil, err
+	}
+	vk := VerificationKey(share)
+	commitment := new(big.Int).Exp(g, w, p)
+	return respond(w, share.Value, challenge("share", vk, commitment)), nil
+}
+
+// CheckShareProof reports whether proof shows that its maker holds the
+// share behind verificationKey.
+func CheckShareProof(verificationKey *big.Int, proof *Proof) bool {
+	if !inGroup(verificationKey) || !proof.valid() {
+		return false
+	}
+	commitment := proof.recommit(g, verificationKey)
+	return challenge("share", verificationKey, commitment).Cmp(proof.Challenge) == 0
+}
+
+// Combine interpolates partial decryptions, keyed by share index, into the
+// shared secret a ballot was sealed with. It needs at least the threshold
+// number of partials; with fewer the result is wrong and Open fails.
+func Combine(partials map[int]*big.Int) (*big.Int, error) {
+	if len(partials) == 0 {
+		return nil, errors.New("elgamal: no partial decryptions")
+	}
+
+	shared := big.NewInt(1)
+	for i, partial := range partials {
+		// Lagrange coefficient of share i at zero: prod j / (j - i).
+		num, den := big.NewInt(1), big.NewInt(1)
+		for j := range partials {
+			if j == i {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(j)))
+			den.Mul(den, big.NewInt(int64(j-i)))
+		}
+		den.Mod(den, q)
+		if den.ModInverse(den, q) == nil {
+			return nil, errors.New("elgamal: duplicate share index")
+		}
+		lambda := num.Mul(num, den)
+		lambda.Mod(lambda, q)
+
+		shared.Mul(shared, new(big.Int).Exp(partial, lambda, p))
+		shared.Mod(shared, p)
+	}
+
+	return shared, nil
+}
+
+// Open decrypts a ciphertext made by Seal with the shared secret from
+// Combine.
+func Open(shared *big.Int, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(shared)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("elgamal: ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+// OpenWith decrypts a ciphertext sealed to the public key of secret, such
+// as a share dealt to a trustee.
+func OpenWith(secret, ephemeral *big.Int, ciphertext, additionalData []byte) ([]byte, error) {
+	if !inGroup(ephemeral) {
+		return nil, errors.New("elgamal: ephemeral value is not in the group")
+	}
+	return Open(new(big.Int).Exp(ephemeral, secret, p), ciphertext, additionalData)
+}
+
+// ParseElement reads a group element written in hex, such as a public key
+// or ephemeral value.
+func ParseElement(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok || !inGroup(n) {
+		return nil, errors.New("elgamal: not a group element")
+	}
+	return n, nil
+}
+
+func inGroup(n *big.Int) bool {
+	if n == nil || n.Cmp(big.NewInt(1)) <= 0 || n.Cmp(p) >= 0 {
+		return false
+	}
+	return new(big.Int).Exp(n, q, p).Cmp(big.NewInt(1)) == 0
+}
+
+// randomExponent returns a uniformly random exponent in [1, q).
+func randomExponent() (*big.Int, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Sub(q, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return n.Add(n, big.NewInt(1)), nil
+}
+
+// newAEAD derives the AES-256-GCM key from the shared group element.
+func newAEAD(shared *big.Int) (cipher.AEAD, error) {
+	key := sha256.Sum256(shared.FillBytes(make([]byte, (p.BitLen()+7)/8)))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// proveEqualLogs proves, for y = g^x and d = e^x, that both were raised to
+// the same x, as Chaum and Pedersen do.
+func proveEqualLogs(x, e, y, d *big.Int) (*Proof, error) {
+	w, err := randomExponent()
+	if err != nil {
+		return nil, err
+	}
+	t1 := new(big.Int).Exp(g, w, p)
+	t2 := new(big.Int).Exp(e, w, p)
+	return respond(w, x, challenge("partial", y, e, d, t1, t2)), nil
+}
+
+func checkEqualLogs(e, y, d *big.Int, proof *Proof) bool {
+	if !proof.valid() {
+		return false
+	}
+	t1 := proof.recommit(g, y)
+	t2 := proof.recommit(e, d)
+	return challenge("partial", y, e, d, t1, t2).Cmp(proof.Challenge) == 0
+}
+
+// Proof is a non-interactive proof of knowledge of a secret exponent: the
+// challenge, derived by hashing the statement and the prover's commitments,
+// and the response.
+type Proof struct {
+	Challenge *big.Int
+	Response  *big.Int
+}
+
+// String encodes the proof as "<challenge>-<response>" in hex.
+func (pr *Proof) String() string {
+	return pr.Challenge.Text(16) + "-" + pr.Response.Text(16)
+}
+
+// ParseProof reads a proof written by Proof.String.
+func ParseProof(s string) (*Proof, error) {
+	c, r, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return nil, errors.New("elgamal: not a valid proof")
+	}
+	challenge, ok1 := new(big.Int).SetString(c, 16)
+	response, ok2 := new(big.Int).SetString(r, 16)
+	proof := &Proof{Challenge: challenge, Response: response}
+	if !ok1 || !ok2 || !proof.valid() {
+		return nil, errors.New("elgamal: not a valid proof")
+	}
+	return proof, nil
+}
+
+func (pr *Proof) valid() bool {
+	return pr != nil && pr.Challenge != nil && pr.Response != nil &&
+		pr.Challenge.Sign() >= 0 && pr.Challenge.Cmp(q) < 0 &&
+		pr.Response.Sign() >= 0 && pr.Response.Cmp(q) < 0
+}
+
+// recommit works out the prover's commitment base^w from the response
+// w + cx and the public value base^x: base^response / value^challenge.
+func (pr *Proof) recommit(base, value *big.Int) *big.Int {
+	t := new(big.Int).Exp(value, pr.Challenge, p)
+	t.ModInverse(t, p)
+	t.Mul(t, new(big.Int).Exp(base, pr.Response, p))
+	return t.Mod(t, p)
+}
+
+// respond completes a proof for the secret x, committed to with w.
+func respond(w, x, c *big.Int) *Proof {
+	r := new(big.Int).Mul(c, x)
+	r.Add(r, w)
+	return &Proof{Challenge: c, Response: r.Mod(r, q)}
+}
+
+// challenge hashes a statement and the prover's commitments into an
+// exponent, labelled with what is being proved.
+func challenge(label string, elements ...*big.Int) *big.Int {
+	h := sha256.New()
+	h.Write([]byte("evoting-proof-v1\n" + label + "\n"))
+	size := (p.BitLen() + 7) / 8
+	for _, e := range elements {
+		h.Write(e.FillBytes(make([]byte, size)))
+	}
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
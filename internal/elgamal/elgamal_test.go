@@ -0,0 +1,167 @@
+package elgamal
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+// ceremony runs a key ceremony among the trustees at indices, each dealing a
+// secret of their own, and returns the public key and each trustee's share.
+func ceremony(t *testing.T, threshold int, indices []int) (*big.Int, map[int]Share) {
+	t.Helper()
+	dealt := make(map[int][]*big.Int)
+	var parts []*big.Int
+	for range indices {
+		commitments, shares, err := Deal(threshold, indices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, commitments[0])
+		for _, share := range shares {
+			if !CheckShare(commitments, share) {
+				t.Fatalf("share for #%d does not match its commitments", share.Index)
+			}
+			dealt[share.Index] = append(dealt[share.Index], share.Value)
+		}
+	}
+
+	shares := make(map[int]Share, len(indices))
+	for _, index := range indices {
+		shares[index] = AddShares(index, dealt[index])
+	}
+	return Product(parts), shares
+}
+
+// subsets returns every subset of indices with size elements.
+func subsets(indices []int, size int) [][]int {
+	if size == 0 {
+		return [][]int{nil}
+	}
+	var out [][]int
+	for i := range indices {
+		for _, rest := range subsets(indices[i+1:], size-1) {
+			out = append(out, append([]int{indices[i]}, rest...))
+		}
+	}
+	return out
+}
+
+func TestThresholdDecrypt(t *testing.T) {
+	indices := []int{1, 2, 3, 4}
+	const threshold = 3
+	publicKey, shares := ceremony(t, threshold, indices)
+
+	plaintext := []byte(`[{"ContestID":1,"Choices":["7"]}]`)
+	data := []byte("ballot 1")
+	ephemeral, sealed, err := Seal(publicKey, plaintext, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partials := make(map[int]*big.Int)
+	for _, index := range indices {
+		partial, proof, err := PartialDecrypt(ephemeral, shares[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CheckPartial(ephemeral, VerificationKey(shares[index]), partial, proof) {
+			t.Fatalf("partial decryption of #%d does not check", index)
+		}
+		partials[index] = partial
+	}
+
+	for size := 1; size <= len(indices); size++ {
+		for _, subset := range subsets(indices, size) {
+			some := make(map[int]*big.Int, len(subset))
+			for _, index := range subset {
+				some[index] = partials[index]
+			}
+			shared, err := Combine(some)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened, err := Open(shared, sealed, data)
+			switch {
+			case size < threshold && err == nil:
+				t.Errorf("trustees %v opened the ballot below the threshold", subset)
+			case size >= threshold && err != nil:
+				t.Errorf("trustees %v could not open the ballot: %v", subset, err)
+			case size >= threshold && !bytes.Equal(opened, plaintext):
+				t.Errorf("trustees %v opened %q, want %q", subset, opened, plaintext)
+			}
+		}
+	}
+
+	// The additional data is bound to the ciphertext.
+	shared, err := Combine(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(shared, sealed, []byte("ballot 2")); err == nil {
+		t.Error("the ballot opened with another ballot's additional data")
+	}
+}
+
+func TestCheckPartialWrongShare(t *testing.T) {
+	indices := []int{1, 2, 3}
+	publicKey, shares := ceremony(t, 2, indices)
+	ephemeral, _, err := Seal(publicKey, []byte("ballot"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Trustee 2's share, passed off as trustee 1's.
+	partial, proof, err := PartialDecrypt(ephemeral, Share{Index: 1, Value: shares[2].Value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckPartial(ephemeral, VerificationKey(shares[1]), partial, proof) {
+		t.Error("a partial decryption made with the wrong share checked")
+	}
+
+	// A good proof does not vouch for another partial.
+	good, goodProof, err := PartialDecrypt(ephemeral, shares[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckPartial(ephemeral, VerificationKey(shares[1]), partial, goodProof) {
+		t.Error("a proof checked for a partial decryption it was not made for")
+	}
+	if !CheckPartial(ephemeral, VerificationKey(shares[1]), good, goodProof) {
+		t.Error("a good partial decryption did not check")
+	}
+}
+
+func TestShareProof(t *testing.T) {
+	_, shares := ceremony(t, 2, []int{1, 2})
+	proof, err := ProveShare(shares[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckShareProof(VerificationKey(shares[1]), proof) {
+		t.Error("a proof of the trustee's own share did not check")
+	}
+	if CheckShareProof(VerificationKey(shares[2]), proof) {
+		t.Error("a proof checked against another trustee's verification key")
+	}
+
+	parsed, err := ParseProof(proof.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckShareProof(VerificationKey(shares[1]), parsed) {
+		t.Error("a proof did not survive being written out and read back")
+	}
+}
+
+func TestDealThreshold(t *testing.T) {
+	for _, threshold := range []int{0, 4} {
+		if _, _, err := Deal(threshold, []int{1, 2, 3}); err == nil {
+			t.Errorf("dealt with a threshold of %d among 3", threshold)
+		}
+	}
+	if _, _, err := Deal(1, []int{0}); err == nil {
+		t.Error("dealt a share at index 0, which would be the secret itself")
+	}
+}
@@ -2,15 +2,18 @@ package handlers
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"evoting-app/internal/middleware"
 	"evoting-app/internal/models"
+	"evoting-app/internal/tokens"
 
 	"github.com/gorilla/mux"
 )
@@ -34,6 +37,7 @@ func (h *Handlers) renderAdminTemplate(w http.ResponseWriter, templateName strin
 			}
 			return b
 		},
+		"percent": percentage,
 	}
 
 	tmpl, err := template.New("").Funcs(funcMap).ParseFiles(
@@ -117,16 +121,16 @@ func (h *Handlers) ManageCandidates(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	candidates, err := h.getCandidatesByElection(electionID)
+	contests, err := h.getBallotContests(electionID)
 	if err != nil {
 		http.Error(w, "Failed to load candidates", http.StatusInternalServerError)
 		return
 	}
 
 	data := map[string]interface{}{
-		"User":       user,
-		"Election":   election,
-		"Candidates": candidates,
+		"User":     user,
+		"Election": election,
+		"Contests": contests,
 	}
 
 	err = h.renderAdminTemplate(w, "manage_candidates.html", data)
@@ -154,9 +158,17 @@ func (h *Handlers) CreateCandidate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		contests, err := h.getContestsByElection(electionID)
+		if err != nil {
+			http.Error(w, "Failed to load contests", http.StatusInternalServerError)
+			return
+		}
+
 		err = h.renderAdminTemplate(w, "create_candidate.html", map[string]interface{}{
-			"User":     user,
-			"Election": election,
+			"User":      user,
+			"Election":  election,
+			"Contests":  contests,
+			"ContestID": r.URL.Query().Get("contest_id"),
 		})
 		if err != nil {
 			log.Printf("Error executing create candidate template: %v", err)
@@ -177,9 +189,15 @@ func (h *Handlers) CreateCandidate(w http.ResponseWriter, r *http.Request) {
 		order, _ = strconv.Atoi(orderStr)
 	}
 
+	contestID, ok := h.parseCandidateContest(r, electionID)
+	if !ok {
+		http.Error(w, "Invalid contest", http.StatusBadRequest)
+		return
+	}
+
 	_, err := h.db.Exec(
-		`INSERT INTO candidates (election_id, name, description, photo_url, order_num) VALUES (?, ?, ?, ?, ?)`,
-		electionID, name, description, photoURL, order,
+		`INSERT INTO candidates (election_id, contest_id, name, description, photo_url, order_num) VALUES (?, ?, ?, ?, ?, ?)`,
+		electionID, contestID, name, description, photoURL, order,
 	)
 
 	if err != nil {
@@ -214,10 +232,17 @@ func (h *Handlers) EditCandidate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		contests, err := h.getContestsByElection(electionID)
+		if err != nil {
+			http.Error(w, "Failed to load contests", http.StatusInternalServerError)
+			return
+		}
+
 		err = h.renderAdminTemplate(w, "edit_candidate.html", map[string]interface{}{
 			"User":      user,
 			"Election":  election,
 			"Candidate": candidate,
+			"Contests":  contests,
 		})
 		if err != nil {
 			log.Printf("Error executing edit candidate template: %v", err)
@@ -238,9 +263,15 @@ func (h *Handlers) EditCandidate(w http.ResponseWriter, r *http.Request) {
 		order, _ = strconv.Atoi(orderStr)
 	}
 
+	contestID, ok := h.parseCandidateContest(r, electionID)
+	if !ok {
+		http.Error(w, "Invalid contest", http.StatusBadRequest)
+		return
+	}
+
 	_, err := h.db.Exec(
-		`UPDATE candidates SET name = ?, description = ?, photo_url = ?, order_num = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
-		name, description, photoURL, order, candidateID,
+		`UPDATE candidates SET contest_id = ?, name = ?, description = ?, photo_url = ?, order_num = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		contestID, name, description, photoURL, order, candidateID,
 	)
 
 	if err != nil {
@@ -262,7 +293,19 @@ func (h *Handlers) DeleteCandidate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.db.Exec(`DELETE FROM candidates WHERE id = ?`, candidateID)
+	// Deleting a candidate deletes the votes for them, which would take
+	// them out of ballots already chained into the ledger.
+	cast, err := h.ballotsCast(electionID)
+	if err != nil {
+		http.Error(w, "Failed to delete candidate", http.StatusInternalServerError)
+		return
+	}
+	if cast {
+		http.Error(w, "Candidates cannot be deleted once ballots have been cast", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.Exec(`DELETE FROM candidates WHERE id = ? AND election_id = ?`, candidateID, electionID)
 	if err != nil {
 		http.Error(w, "Failed to delete candidate", http.StatusInternalServerError)
 		return
@@ -294,10 +337,45 @@ func (h *Handlers) ManageTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	batches, err := h.getPrintBatches(election.ID)
+	if err != nil {
+		http.Error(w, "Failed to load tokens", http.StatusInternalServerError)
+		return
+	}
+
+	var used, printed, revoked, expired int
+	for _, token := range tokens {
+		switch {
+		case token.IsUsed:
+			used++
+		case token.RevokedAt != nil:
+			revoked++
+		case token.Expired:
+			expired++
+		}
+		if token.PrintedAt != nil {
+			printed++
+		}
+	}
+
+	if loc, err := time.LoadLocation(election.Timezone); err == nil {
+		for i := range tokens {
+			if tokens[i].ExpiresAt != nil {
+				expires := tokens[i].ExpiresAt.In(loc)
+				tokens[i].ExpiresAt = &expires
+			}
+		}
+	}
+
 	data := map[string]interface{}{
 		"User":     user,
 		"Election": election,
 		"Tokens":   tokens,
+		"Used":     used,
+		"Printed":  printed,
+		"Revoked":  revoked,
+		"Expired":  expired,
+		"Batches":  batches,
 	}
 
 	err = h.renderAdminTemplate(w, "manage_tokens.html", data)
@@ -318,6 +396,12 @@ func (h *Handlers) GenerateTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
 	countStr := r.FormValue("count")
 	count, err := strconv.Atoi(countStr)
 	if err != nil || count <= 0 || count > 1000 {
@@ -325,12 +409,29 @@ func (h *Handlers) GenerateTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every token in a batch casts the same number of votes.
+	weight := 1
+	if weightStr := r.FormValue("weight"); weightStr != "" {
+		weight, err = strconv.Atoi(weightStr)
+		if err != nil || weight < 1 {
+			http.Error(w, "Votes per token must be at least 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A batch can also be given a time its tokens stop working.
+	expires, err := parseTokenExpiry(r.FormValue("expires_at"), election)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Generate tokens
 	for i := 0; i < count; i++ {
-		token := generateRandomToken()
+		token := h.newToken()
 		_, err := h.db.Exec(
-			`INSERT INTO voting_tokens (election_id, token) VALUES (?, ?)`,
-			electionID, token,
+			`INSERT INTO voting_tokens (election_id, token, weight, expires_at) VALUES (?, ?, ?, ?)`,
+			electionID, token, weight, expires,
 		)
 		if err != nil {
 			http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
@@ -358,16 +459,23 @@ func (h *Handlers) ManageVotes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	votes, err := h.getVotesByElection(electionID)
-	if err != nil {
-		http.Error(w, "Failed to load votes", http.StatusInternalServerError)
-		return
+	hidden, overridden := h.resultsAccess(r, user, election)
+
+	var votes []models.Vote
+	if !hidden {
+		votes, err = h.getVotesByElection(electionID)
+		if err != nil {
+			http.Error(w, "Failed to load votes", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	data := map[string]interface{}{
-		"User":     user,
-		"Election": election,
-		"Votes":    votes,
+		"User":              user,
+		"Election":          election,
+		"Votes":             votes,
+		"Embargoed":         hidden,
+		"EmbargoOverridden": overridden,
 	}
 
 	err = h.renderAdminTemplate(w, "manage_votes.html", data)
@@ -395,23 +503,44 @@ func (h *Handlers) ElectionReports(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	voteCounts, err := h.getVoteCountsByElection(electionID)
+	report, err := h.getElectionReport(election)
 	if err != nil {
-		http.Error(w, "Failed to load vote counts", http.StatusInternalServerError)
+		log.Printf("Error building election report: %v", err)
+		http.Error(w, "Failed to load election report", http.StatusInternalServerError)
 		return
 	}
 
-	stats, err := h.getElectionStats(electionID)
+	// Under embargo only turnout is shown.
+	hidden, overridden := h.resultsAccess(r, user, election)
+	if hidden {
+		report.Contests = nil
+		report.Stats.BlankBallots = 0
+	}
+
+	// Runoffs link back to the election they were created from.
+	var parent *models.Election
+	if election.ParentID != 0 {
+		parent, err = h.getElectionByID(strconv.Itoa(election.ParentID))
+		if err != nil {
+			log.Printf("Error loading parent election: %v", err)
+			parent = nil
+		}
+	}
+	runoffs, err := h.getRunoffs(election.ID)
 	if err != nil {
-		http.Error(w, "Failed to load election stats", http.StatusInternalServerError)
-		return
+		log.Printf("Error loading runoffs: %v", err)
 	}
 
 	data := map[string]interface{}{
-		"User":       user,
-		"Election":   election,
-		"VoteCounts": voteCounts,
-		"Stats":      stats,
+		"User":              user,
+		"Election":          election,
+		"Stats":             report.Stats,
+		"Contests":          report.Contests,
+		"Report":            report,
+		"Embargoed":         hidden,
+		"EmbargoOverridden": overridden,
+		"Parent":            parent,
+		"Runoffs":           runoffs,
 	}
 
 	err = h.renderAdminTemplate(w, "election_reports.html", data)
@@ -425,11 +554,10 @@ func (h *Handlers) ElectionReports(w http.ResponseWriter, r *http.Request) {
 // Helper functions
 func (h *Handlers) getAdminElections(userID int) ([]models.Election, error) {
 	query := `
-		SELECT DISTINCT e.id, e.title, e.description, e.start_date, e.end_date, e.status, e.created_at
-		FROM elections e
-		JOIN election_admins ea ON e.id = ea.election_id
-		WHERE ea.user_id = ?
-		ORDER BY e.created_at DESC
+		SELECT ` + electionColumns + `
+		FROM elections
+		WHERE id IN (SELECT election_id FROM election_admins WHERE user_id = ?)
+		ORDER BY created_at DESC
 	`
 	rows, err := h.db.Query(query, userID)
 	if err != nil {
@@ -440,10 +568,7 @@ func (h *Handlers) getAdminElections(userID int) ([]models.Election, error) {
 	var elections []models.Election
 	for rows.Next() {
 		var election models.Election
-		err := rows.Scan(
-			&election.ID, &election.Title, &election.Description,
-			&election.StartDate, &election.EndDate, &election.Status, &election.CreatedAt,
-		)
+		err := scanElection(rows, &election)
 		if err != nil {
 			return nil, err
 		}
@@ -469,8 +594,19 @@ func (h *Handlers) hasElectionAccess(userID int, electionID string) bool {
 	return count > 0
 }
 
+// ballotsCast reports whether any ballot has been cast in the election,
+// sealed or not, counting votes from before ballots had receipts.
+func (h *Handlers) ballotsCast(electionID string) (bool, error) {
+	var cast bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ballots WHERE election_id = ?)
+			OR EXISTS (SELECT 1 FROM votes WHERE election_id = ?)
+	`, electionID, electionID).Scan(&cast)
+	return cast, err
+}
+
 func (h *Handlers) getCandidatesByElection(electionID string) ([]models.Candidate, error) {
-	query := `SELECT id, name, description, photo_url, order_num, created_at FROM candidates WHERE election_id = ? ORDER BY order_num`
+	query := `SELECT id, contest_id, name, stance, description, photo_url, order_num, created_at FROM candidates WHERE election_id = ? ORDER BY order_num`
 	rows, err := h.db.Query(query, electionID)
 	if err != nil {
 		return nil, err
@@ -481,7 +617,7 @@ func (h *Handlers) getCandidatesByElection(electionID string) ([]models.Candidat
 	for rows.Next() {
 		var candidate models.Candidate
 		err := rows.Scan(
-			&candidate.ID, &candidate.Name, &candidate.Description,
+			&candidate.ID, &candidate.ContestID, &candidate.Name, &candidate.Stance, &candidate.Description,
 			&candidate.PhotoURL, &candidate.Order, &candidate.CreatedAt,
 		)
 		if err != nil {
@@ -493,12 +629,23 @@ func (h *Handlers) getCandidatesByElection(electionID string) ([]models.Candidat
 	return candidates, nil
 }
 
+// parseCandidateContest reads the contest a candidate stands in, which must
+// be a candidate race in the election; referendum options are managed on
+// the contest itself.
+func (h *Handlers) parseCandidateContest(r *http.Request, electionID string) (int, bool) {
+	contest, err := h.getContestByID(r.FormValue("contest_id"))
+	if err != nil || strconv.Itoa(contest.ElectionID) != electionID || contest.Kind == "referendum" {
+		return 0, false
+	}
+	return contest.ID, true
+}
+
 func (h *Handlers) getCandidateByID(id string) (*models.Candidate, error) {
 	candidate := &models.Candidate{}
-	query := `SELECT id, election_id, name, description, photo_url, order_num FROM candidates WHERE id = ?`
+	query := `SELECT id, election_id, contest_id, name, description, photo_url, order_num FROM candidates WHERE id = ?`
 
 	err := h.db.QueryRow(query, id).Scan(
-		&candidate.ID, &candidate.ElectionID, &candidate.Name,
+		&candidate.ID, &candidate.ElectionID, &candidate.ContestID, &candidate.Name,
 		&candidate.Description, &candidate.PhotoURL, &candidate.Order,
 	)
 
@@ -506,8 +653,14 @@ func (h *Handlers) getCandidateByID(id string) (*models.Candidate, error) {
 }
 
 func (h *Handlers) getTokensByElection(electionID string) ([]models.VotingToken, error) {
-	query := `SELECT id, token, is_used, used_at, created_at FROM voting_tokens WHERE election_id = ? ORDER BY created_at DESC`
-	rows, err := h.db.Query(query, electionID)
+	query := `
+		SELECT id, token, is_used, weight, used_at, COALESCE(print_batch, 0), COALESCE(print_serial, 0), printed_at,
+			expires_at, COALESCE(expires_at <= ?, FALSE), revoked_at, revoked_reason, COALESCE(replaced_by, 0), created_at
+		FROM voting_tokens
+		WHERE election_id = ?
+		ORDER BY created_at DESC
+	`
+	rows, err := h.db.Query(query, time.Now().UTC().Truncate(time.Second), electionID)
 	if err != nil {
 		return nil, err
 	}
@@ -516,7 +669,11 @@ func (h *Handlers) getTokensByElection(electionID string) ([]models.VotingToken,
 	var tokens []models.VotingToken
 	for rows.Next() {
 		var token models.VotingToken
-		err := rows.Scan(&token.ID, &token.Token, &token.IsUsed, &token.UsedAt, &token.CreatedAt)
+		err := rows.Scan(
+			&token.ID, &token.Token, &token.IsUsed, &token.Weight, &token.UsedAt,
+			&token.PrintBatch, &token.PrintSerial, &token.PrintedAt,
+			&token.ExpiresAt, &token.Expired, &token.RevokedAt, &token.RevokeReason, &token.ReplacedBy, &token.CreatedAt,
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -528,11 +685,12 @@ func (h *Handlers) getTokensByElection(electionID string) ([]models.VotingToken,
 
 func (h *Handlers) getVotesByElection(electionID string) ([]models.Vote, error) {
 	query := `
-		SELECT v.id, v.candidate_id, c.name, v.voted_at
+		SELECT v.id, v.ballot_id, v.contest_id, ct.title, COALESCE(v.candidate_id, 0), COALESCE(c.name, '')
 		FROM votes v
-		JOIN candidates c ON v.candidate_id = c.id
+		LEFT JOIN candidates c ON v.candidate_id = c.id
+		JOIN contests ct ON v.contest_id = ct.id
 		WHERE v.election_id = ?
-		ORDER BY v.voted_at DESC
+		ORDER BY v.ballot_id, ct.order_num, ct.id
 	`
 	rows, err := h.db.Query(query, electionID)
 	if err != nil {
@@ -543,27 +701,35 @@ func (h *Handlers) getVotesByElection(electionID string) ([]models.Vote, error)
 	var votes []models.Vote
 	for rows.Next() {
 		var vote models.Vote
-		var candidateName string
-		err := rows.Scan(&vote.ID, &vote.CandidateID, &candidateName, &vote.VotedAt)
+		err := rows.Scan(
+			&vote.ID, &vote.BallotID, &vote.ContestID, &vote.ContestTitle,
+			&vote.CandidateID, &vote.CandidateName,
+		)
 		if err != nil {
 			return nil, err
 		}
+		vote.Blank = vote.CandidateID == 0
 		votes = append(votes, vote)
 	}
 
 	return votes, nil
 }
 
-func (h *Handlers) getVoteCountsByElection(electionID string) ([]models.VoteCount, error) {
+// getVoteCountsByContest counts each of the contest's candidates' votes,
+// each ballot counting its weight. Approval ballots count every selection;
+// other methods count first preferences only.
+func (h *Handlers) getVoteCountsByContest(contestID int, votingMethod string) ([]models.VoteCount, error) {
 	query := `
-		SELECT c.id, c.name, COUNT(v.id) as vote_count
+		SELECT c.id, c.name, SUM(CASE WHEN vs.vote_id IS NULL THEN 0 ELSE COALESCE(b.weight, 1) END) as vote_count
 		FROM candidates c
-		LEFT JOIN votes v ON c.id = v.candidate_id
-		WHERE c.election_id = ?
+		LEFT JOIN vote_selections vs ON c.id = vs.candidate_id AND (vs.preference = 1 OR ? = 'approval')
+		LEFT JOIN votes v ON v.id = vs.vote_id
+		LEFT JOIN ballots b ON b.id = v.ballot_id
+		WHERE c.contest_id = ?
 		GROUP BY c.id, c.name
 		ORDER BY vote_count DESC, c.name
 	`
-	rows, err := h.db.Query(query, electionID)
+	rows, err := h.db.Query(query, votingMethod, contestID)
 	if err != nil {
 		return nil, err
 	}
@@ -585,11 +751,31 @@ func (h *Handlers) getVoteCountsByElection(electionID string) ([]models.VoteCoun
 func (h *Handlers) getElectionStats(electionID string) (*models.ElectionStats, error) {
 	stats := &models.ElectionStats{}
 
-	h.db.QueryRow("SELECT COUNT(*) FROM voting_tokens WHERE election_id = ?", electionID).Scan(&stats.TotalTokens)
+	// A revoked token never counts as issued: it could not be used, and a
+	// reissued one would otherwise count twice.
+	h.db.QueryRow("SELECT COUNT(*) FROM voting_tokens WHERE election_id = ? AND revoked_at IS NULL", electionID).Scan(&stats.TotalTokens)
 	h.db.QueryRow("SELECT COUNT(*) FROM voting_tokens WHERE election_id = ? AND is_used = TRUE", electionID).Scan(&stats.UsedTokens)
-	h.db.QueryRow("SELECT COUNT(*) FROM votes WHERE election_id = ?", electionID).Scan(&stats.TotalVotes)
+	h.db.QueryRow("SELECT COUNT(DISTINCT ballot_id) FROM votes WHERE election_id = ?", electionID).Scan(&stats.TotalVotes)
+	h.db.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT ballot_id FROM votes WHERE election_id = ?
+			GROUP BY ballot_id HAVING COUNT(candidate_id) = 0
+		)
+	`, electionID).Scan(&stats.BlankBallots)
 	h.db.QueryRow("SELECT COUNT(*) FROM candidates WHERE election_id = ?", electionID).Scan(&stats.TotalCandidates)
 
+	h.db.QueryRow(`
+		SELECT COALESCE(SUM(weight), 0), COALESCE(SUM(CASE WHEN is_used THEN weight ELSE 0 END), 0)
+		FROM voting_tokens WHERE election_id = ? AND revoked_at IS NULL
+	`, electionID).Scan(&stats.TotalWeight, &stats.UsedWeight)
+	h.db.QueryRow(`
+		SELECT COALESCE(SUM(COALESCE(b.weight, 1)), 0)
+		FROM (SELECT DISTINCT ballot_id FROM votes WHERE election_id = ?) v
+		LEFT JOIN ballots b ON b.id = v.ballot_id
+	`, electionID).Scan(&stats.WeightedVotes)
+	stats.Weighted = stats.TotalWeight != stats.TotalTokens
+	h.db.QueryRow("SELECT COUNT(*) FROM voters WHERE election_id = ?", electionID).Scan(&stats.RegisteredVoters)
+
 	return stats, nil
 }
 
@@ -610,8 +796,28 @@ func (h *Handlers) getAdminStats(userID int) map[string]int {
 	return stats
 }
 
+// newToken makes a voting token in the configured format.
+func (h *Handlers) newToken() string {
+	token, err := tokens.Generate(h.tokenFormat)
+	if err != nil {
+		// Config only lets through known formats; fall back to the form
+		// tokens had before there were formats, which is still accepted.
+		log.Printf("Error generating token: %v", err)
+		return generateRandomToken()
+	}
+	return token
+}
+
 func generateRandomToken() string {
 	bytes := make([]byte, 16)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
+
+// randomRowID picks a random positive row ID, so that the order of the rows
+// says nothing about the order they were written in.
+func randomRowID() int64 {
+	var bytes [8]byte
+	rand.Read(bytes[:])
+	return int64(binary.BigEndian.Uint64(bytes[:]) >> 1)
+}
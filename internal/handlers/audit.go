@@ -0,0 +1,49 @@
+package handlers
+
+import "database/sql"
+
+// audit records an event in the audit log. userID is 0 for events without a
+// signed-in user, such as a voter's submission.
+func (h *Handlers) audit(electionID, userID int, action, detail string) error {
+	return writeAudit(h.db, electionID, userID, action, detail)
+}
+
+// auditOnce records an event unless the same one is in the log already, for
+// events that anyone can set off again and again, such as by reloading a
+// public page, and that must not be able to bury the rest of the log.
+func (h *Handlers) auditOnce(electionID, userID int, action, detail string) error {
+	var user interface{}
+	if userID != 0 {
+		user = userID
+	}
+
+	_, err := h.db.Exec(`
+		INSERT INTO audit_log (election_id, user_id, action, detail)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM audit_log WHERE election_id = ? AND action = ? AND detail = ?)
+	`, electionID, user, action, detail, electionID, action, detail)
+	return err
+}
+
+// auditTx records an event as part of tx, for changes that must not be kept
+// without their audit entry.
+func auditTx(tx *sql.Tx, electionID, userID int, action, detail string) error {
+	return writeAudit(tx, electionID, userID, action, detail)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func writeAudit(db execer, electionID, userID int, action, detail string) error {
+	var user interface{}
+	if userID != 0 {
+		user = userID
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO audit_log (election_id, user_id, action, detail) VALUES (?, ?, ?, ?)`,
+		electionID, user, action, detail,
+	)
+	return err
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"sort"
+
+	"evoting-app/internal/models"
+	"evoting-app/internal/tally"
+)
+
+// getBallotsByContest loads every ballot cast in the contest with its
+// selections in preference order and its weight.
+func (h *Handlers) getBallotsByContest(contestID int) ([]tally.Ballot, error) {
+	query := `
+		SELECT vs.vote_id, vs.candidate_id, COALESCE(b.weight, 1)
+		FROM vote_selections vs
+		JOIN votes v ON vs.vote_id = v.id
+		LEFT JOIN ballots b ON b.id = v.ballot_id
+		WHERE v.contest_id = ?
+		ORDER BY vs.vote_id, vs.preference
+	`
+	rows, err := h.db.Query(query, contestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ballots []tally.Ballot
+	lastVoteID := 0
+	for rows.Next() {
+		var voteID, candidateID, weight int
+		if err := rows.Scan(&voteID, &candidateID, &weight); err != nil {
+			return nil, err
+		}
+		if voteID != lastVoteID {
+			ballots = append(ballots, tally.Ballot{Weight: weight})
+			lastVoteID = voteID
+		}
+		last := &ballots[len(ballots)-1]
+		last.Choices = append(last.Choices, candidateID)
+	}
+
+	return ballots, rows.Err()
+}
+
+// getRunoffReport runs an instant-runoff count over the contest's ranked
+// ballots and lays it out round by round for the reports page.
+func (h *Handlers) getRunoffReport(contest models.Contest) (*models.RunoffReport, error) {
+	candidates := contest.Candidates
+
+	ballots, err := h.getBallotsByContest(contest.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(candidates))
+	names := make(map[int]string, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.ID
+		names[candidate.ID] = candidate.Name
+	}
+
+	result := tally.InstantRunoff(ids, ballots)
+
+	report := &models.RunoffReport{Winner: names[result.Winner], WinnerID: result.Winner}
+	for _, id := range result.Tied {
+		report.Tied = append(report.Tied, names[id])
+		report.TiedIDs = append(report.TiedIDs, id)
+	}
+
+	eliminatedIn := make(map[int]int)
+	for i, round := range result.Rounds {
+		report.Rounds = append(report.Rounds, i+1)
+		report.Exhausted = append(report.Exhausted, round.Exhausted)
+		for _, id := range round.Eliminated {
+			eliminatedIn[id] = i + 1
+		}
+	}
+
+	for _, candidate := range candidates {
+		row := models.RunoffRow{
+			CandidateID:   candidate.ID,
+			CandidateName: candidate.Name,
+			EliminatedIn:  eliminatedIn[candidate.ID],
+		}
+		for _, round := range result.Rounds {
+			votes, ok := round.Counts[candidate.ID]
+			if !ok {
+				break
+			}
+			row.Counts = append(row.Counts, votes)
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	// List candidates in the order they finished: those still standing at the
+	// end first, then by how late they were eliminated.
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		a, b := report.Rows[i], report.Rows[j]
+		if len(a.Counts) != len(b.Counts) {
+			return len(a.Counts) > len(b.Counts)
+		}
+		if len(a.Counts) == 0 {
+			return false
+		}
+		return a.Counts[len(a.Counts)-1] > b.Counts[len(b.Counts)-1]
+	})
+
+	return report, nil
+}
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+	"evoting-app/internal/tally"
+
+	"github.com/gorilla/mux"
+)
+
+// Contest Management
+func (h *Handlers) ManageContests(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	contests, err := h.getBallotContests(electionID)
+	if err != nil {
+		http.Error(w, "Failed to load contests", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"User":     user,
+		"Election": election,
+		"Contests": contests,
+	}
+
+	err = h.renderAdminTemplate(w, "manage_contests.html", data)
+	if err != nil {
+		log.Printf("Error executing manage contests template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handlers) CreateContest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		err = h.renderAdminTemplate(w, "create_contest.html", map[string]interface{}{
+			"User":     user,
+			"Election": election,
+		})
+		if err != nil {
+			log.Printf("Error executing create contest template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	// Handle POST
+	title := r.FormValue("title")
+	description := r.FormValue("description")
+	orderStr := r.FormValue("order")
+
+	order := 0
+	if orderStr != "" {
+		order, _ = strconv.Atoi(orderStr)
+	}
+
+	kind := parseContestKind(r.FormValue("kind"))
+	threshold := parsePassThreshold(r.FormValue("pass_threshold"))
+
+	seats, maxSelections := 1, 1
+	options := referendumOptions(r)
+	if kind == "referendum" {
+		if options["yes"] == "" || options["no"] == "" {
+			err = errors.New("Yes and No options need a label")
+		}
+	} else {
+		seats, maxSelections, err = parseContestLimits(r, election.VotingMethod)
+	}
+	if err != nil {
+		h.renderAdminTemplate(w, "create_contest.html", map[string]interface{}{
+			"User":     user,
+			"Election": election,
+			"Error":    err.Error(),
+		})
+		return
+	}
+
+	err = h.createContest(election.ID, title, description, kind, threshold, seats, maxSelections, order, options)
+	if err != nil {
+		http.Error(w, "Failed to create contest", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/contests", http.StatusSeeOther)
+}
+
+func (h *Handlers) EditContest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+	contestID := vars["contest_id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	contest, err := h.getContestByID(contestID)
+	if err != nil || contest.ElectionID != election.ID {
+		http.Error(w, "Contest not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		err = h.renderAdminTemplate(w, "edit_contest.html", map[string]interface{}{
+			"User":     user,
+			"Election": election,
+			"Contest":  contest,
+			"Options":  h.getReferendumLabels(contest.ID),
+		})
+		if err != nil {
+			log.Printf("Error executing edit contest template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	// Handle POST
+	title := r.FormValue("title")
+	description := r.FormValue("description")
+	orderStr := r.FormValue("order")
+
+	order := 0
+	if orderStr != "" {
+		order, _ = strconv.Atoi(orderStr)
+	}
+
+	// A contest keeps its kind; only a referendum's threshold and option
+	// labels can change.
+	threshold := parsePassThreshold(r.FormValue("pass_threshold"))
+
+	seats, maxSelections := 1, 1
+	if contest.Kind == "referendum" {
+		err = h.updateReferendumOptions(contest.ID, referendumOptions(r))
+	} else {
+		seats, maxSelections, err = parseContestLimits(r, election.VotingMethod)
+	}
+	if err != nil {
+		h.renderAdminTemplate(w, "edit_contest.html", map[string]interface{}{
+			"User":     user,
+			"Election": election,
+			"Contest":  contest,
+			"Options":  h.getReferendumLabels(contest.ID),
+			"Error":    err.Error(),
+		})
+		return
+	}
+
+	_, err = h.db.Exec(
+		`UPDATE contests SET title = ?, description = ?, pass_threshold = ?, seats = ?, max_selections = ?, order_num = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		title, description, threshold, seats, maxSelections, order, contestID,
+	)
+
+	if err != nil {
+		http.Error(w, "Failed to update contest", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/contests", http.StatusSeeOther)
+}
+
+func (h *Handlers) DeleteContest(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+	contestID := vars["contest_id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Deleting a contest deletes its votes, which would take them out of
+	// ballots already chained into the ledger.
+	var cast bool
+	err := h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ballots WHERE election_id = ?)`, electionID).Scan(&cast)
+	if err != nil {
+		http.Error(w, "Failed to delete contest", http.StatusInternalServerError)
+		return
+	}
+	if cast {
+		http.Error(w, "Contests cannot be deleted once ballots have been cast", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.Exec(`DELETE FROM contests WHERE id = ? AND election_id = ?`, contestID, electionID)
+	if err != nil {
+		http.Error(w, "Failed to delete contest", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/contests", http.StatusSeeOther)
+}
+
+// Helper functions
+func (h *Handlers) getContestsByElection(electionID string) ([]models.Contest, error) {
+	query := `
+		SELECT id, election_id, title, description, kind, pass_threshold, seats, max_selections, order_num, created_at
+		FROM contests WHERE election_id = ? ORDER BY order_num, id
+	`
+	rows, err := h.db.Query(query, electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contests []models.Contest
+	for rows.Next() {
+		var contest models.Contest
+		var description *string
+		err := rows.Scan(
+			&contest.ID, &contest.ElectionID, &contest.Title, &description,
+			&contest.Kind, &contest.PassThreshold,
+			&contest.Seats, &contest.MaxSelections, &contest.Order, &contest.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if description != nil {
+			contest.Description = *description
+		}
+		contests = append(contests, contest)
+	}
+
+	return contests, nil
+}
+
+func (h *Handlers) getContestByID(id string) (*models.Contest, error) {
+	contest := &models.Contest{}
+	var description *string
+	query := `SELECT id, election_id, title, description, kind, pass_threshold, seats, max_selections, order_num FROM contests WHERE id = ?`
+
+	err := h.db.QueryRow(query, id).Scan(
+		&contest.ID, &contest.ElectionID, &contest.Title, &description,
+		&contest.Kind, &contest.PassThreshold, &contest.Seats, &contest.MaxSelections, &contest.Order,
+	)
+	if description != nil {
+		contest.Description = *description
+	}
+
+	return contest, err
+}
+
+func (h *Handlers) createContest(electionID int, title, description, kind, threshold string, seats, maxSelections, order int, options map[string]string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO contests (election_id, title, description, kind, pass_threshold, seats, max_selections, order_num) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		electionID, title, description, kind, threshold, seats, maxSelections, order,
+	)
+	if err != nil {
+		return err
+	}
+
+	contestID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if kind == "referendum" {
+		for i, stance := range referendumStances {
+			if options[stance] == "" {
+				continue
+			}
+			_, err = tx.Exec(
+				`INSERT INTO candidates (election_id, contest_id, name, stance, description, photo_url, order_num) VALUES (?, ?, ?, ?, '', '', ?)`,
+				electionID, contestID, options[stance], stance, i,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateReferendumOptions renames a referendum's options. Yes and No are
+// required; clearing the abstain label removes that option, as long as no
+// ballot has been cast, since a sealed ballot may have chosen it without it
+// showing yet.
+func (h *Handlers) updateReferendumOptions(contestID int, options map[string]string) error {
+	if options["yes"] == "" || options["no"] == "" {
+		return errors.New("Yes and No options need a label")
+	}
+
+	var electionID int
+	err := h.db.QueryRow(`SELECT election_id FROM contests WHERE id = ?`, contestID).Scan(&electionID)
+	if err != nil {
+		return err
+	}
+
+	if options["abstain"] == "" {
+		var abstain bool
+		err := h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM candidates WHERE contest_id = ? AND stance = 'abstain')`, contestID).Scan(&abstain)
+		if err != nil {
+			return err
+		}
+		cast, err := h.ballotsCast(strconv.Itoa(electionID))
+		if err != nil {
+			return err
+		}
+		if abstain && cast {
+			return errors.New("The abstain option cannot be removed once ballots have been cast")
+		}
+	}
+
+	for i, stance := range referendumStances {
+		label := options[stance]
+		if label == "" {
+			_, err = h.db.Exec(`DELETE FROM candidates WHERE contest_id = ? AND stance = ?`, contestID, stance)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		result, err := h.db.Exec(
+			`UPDATE candidates SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE contest_id = ? AND stance = ?`,
+			label, contestID, stance,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			_, err = h.db.Exec(
+				`INSERT INTO candidates (election_id, contest_id, name, stance, description, photo_url, order_num) VALUES (?, ?, ?, ?, '', '', ?)`,
+				electionID, contestID, label, stance, i,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getReferendumLabels returns the referendum's option labels by stance.
+func (h *Handlers) getReferendumLabels(contestID int) map[string]string {
+	labels := make(map[string]string)
+	rows, err := h.db.Query(`SELECT stance, name FROM candidates WHERE contest_id = ? AND stance != ''`, contestID)
+	if err != nil {
+		return labels
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stance, name string
+		if rows.Scan(&stance, &name) == nil {
+			labels[stance] = name
+		}
+	}
+
+	return labels
+}
+
+// referendumStances lists a referendum's options in ballot order.
+var referendumStances = []string{"yes", "no", "abstain"}
+
+// referendumOptions reads the option labels from a contest form.
+func referendumOptions(r *http.Request) map[string]string {
+	options := make(map[string]string, len(referendumStances))
+	for _, stance := range referendumStances {
+		options[stance] = strings.TrimSpace(r.FormValue(stance + "_label"))
+	}
+	return options
+}
+
+// parseContestKind maps the submitted contest kind to a supported one,
+// falling back to a candidate race.
+func parseContestKind(kind string) string {
+	if kind == "referendum" {
+		return kind
+	}
+	return "candidates"
+}
+
+// passThresholds maps the stored threshold names to the share of Yes votes
+// a motion needs and a label for reports.
+var passThresholds = map[string]struct {
+	threshold tally.Threshold
+	label     string
+}{
+	"majority":       {tally.SimpleMajority, "Simple majority (more than half)"},
+	"three_fifths":   {tally.ThreeFifths, "Three-fifths majority"},
+	"two_thirds":     {tally.TwoThirds, "Two-thirds majority"},
+	"three_quarters": {tally.ThreeQuarters, "Three-quarters majority"},
+	"unanimous":      {tally.Unanimous, "Unanimous"},
+}
+
+// parsePassThreshold maps the submitted threshold to a supported one,
+// falling back to a simple majority.
+func parsePassThreshold(threshold string) string {
+	if _, ok := passThresholds[threshold]; ok {
+		return threshold
+	}
+	return "majority"
+}
+
+// getBallotContests loads the election's contests with their candidates, in
+// ballot order.
+func (h *Handlers) getBallotContests(electionID string) ([]models.Contest, error) {
+	contests, err := h.getContestsByElection(electionID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := h.getCandidatesByElection(electionID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range contests {
+		for _, candidate := range candidates {
+			if candidate.ContestID == contests[i].ID {
+				contests[i].Candidates = append(contests[i].Candidates, candidate)
+			}
+		}
+	}
+
+	return contests, nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// embargoOverrideDuration is how long a superadmin's break-glass override
+// of a results embargo lasts before it has to be asked for again.
+const embargoOverrideDuration = 15 * time.Minute
+
+// resultsEmbargoed reports whether the election's tallies and vote listings
+// are still withheld: it has an embargo, its end date has not passed and it
+// is not completed.
+func resultsEmbargoed(election *models.Election, now time.Time) bool {
+	return election.ResultsEmbargo && election.Status != "completed" && now.Before(election.EndDate)
+}
+
+func embargoOverrideKey(electionID int) string {
+	return "results_override_" + strconv.Itoa(electionID)
+}
+
+// resultsAccess reports whether the election's results must be hidden from
+// the user, and whether they are shown only because of an override.
+func (h *Handlers) resultsAccess(r *http.Request, user *models.User, election *models.Election) (hidden, overridden bool) {
+	if !resultsEmbargoed(election, time.Now()) {
+		return false, false
+	}
+	if user == nil || user.Role != "superadmin" {
+		return true, false
+	}
+
+	session, _ := h.store.Get(r, "session")
+	expires, ok := session.Values[embargoOverrideKey(election.ID)].(int64)
+	if !ok || time.Now().Unix() >= expires {
+		return true, false
+	}
+	return false, true
+}
+
+// OverrideResultsEmbargo is the superadmin's break-glass: it shows an
+// embargoed election's results for a short while, after recording who
+// asked and why in the audit log.
+func (h *Handlers) OverrideResultsEmbargo(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+
+	election, err := h.getElectionByID(vars["id"])
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	reportsURL := "/admin/admin/elections/" + strconv.Itoa(election.ID) + "/reports"
+	if !resultsEmbargoed(election, time.Now()) {
+		http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "A reason is required to override the results embargo", http.StatusBadRequest)
+		return
+	}
+
+	// The override is only granted once it is on record.
+	detail := fmt.Sprintf("Results embargo overridden for %s: %s", embargoOverrideDuration, reason)
+	if err := h.audit(election.ID, user.ID, "results_embargo_override", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+		http.Error(w, "Failed to record the override", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := h.store.Get(r, "session")
+	session.Values[embargoOverrideKey(election.ID)] = time.Now().Add(embargoOverrideDuration).Unix()
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Error saving session: %v", err)
+		http.Error(w, "Failed to record the override", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+}
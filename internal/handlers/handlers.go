@@ -2,13 +2,22 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"math/big"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/mailer"
 	"evoting-app/internal/middleware"
 	"evoting-app/internal/models"
+	"evoting-app/internal/tokens"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
@@ -19,9 +28,15 @@ type Handlers struct {
 	store sessions.Store
 	tmpl  *template.Template
 	auth  *middleware.AuthService
+	mail  *mailer.Dispatcher // nil when email delivery is not configured
+	// baseURL is where voters reach the application, for the links printed
+	// on token slips
+	baseURL string
+	// tokenFormat is how new voting tokens look, one of tokens.Formats
+	tokenFormat string
 }
 
-func New(db *sql.DB, store sessions.Store) *Handlers {
+func New(db *sql.DB, store sessions.Store, mail *mailer.Dispatcher, baseURL, tokenFormat string) *Handlers {
 	// Create function map for templates
 	funcMap := template.FuncMap{
 		"add": func(a, b int) int { return a + b },
@@ -39,6 +54,7 @@ func New(db *sql.DB, store sessions.Store) *Handlers {
 			}
 			return b
 		},
+		"percent": percentage,
 	}
 
 	// Load templates with custom functions
@@ -52,6 +68,10 @@ func New(db *sql.DB, store sessions.Store) *Handlers {
 		store: store,
 		tmpl:  tmpl,
 		auth:  middleware.NewAuthService(db),
+		mail:  mail,
+
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		tokenFormat: tokenFormat,
 	}
 }
 
@@ -74,6 +94,7 @@ func (h *Handlers) renderTemplate(w http.ResponseWriter, templateName string, da
 			}
 			return b
 		},
+		"percent": percentage,
 	}
 
 	tmpl, err := template.New("").Funcs(funcMap).ParseFiles(
@@ -168,9 +189,11 @@ func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
 
 // Voting handlers
 func (h *Handlers) VoteForm(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		err := h.renderTemplate(w, "vote_token.html", nil)
+	typed := r.URL.Query().Get("token")
+	if typed == "" {
+		err := h.renderTemplate(w, "vote_token.html", map[string]string{
+			"Format": tokens.Formats[h.tokenFormat],
+		})
 		if err != nil {
 			log.Printf("Error executing vote token template: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -179,11 +202,33 @@ func (h *Handlers) VoteForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A mistyped token is caught by its check character, so the voter can be
+	// told to look again rather than that it does not exist.
+	token, err := tokens.Normalize(typed)
+	if err != nil {
+		err = h.renderTemplate(w, "vote_token.html", map[string]string{
+			"Error":  err.Error(),
+			"Format": tokens.Formats[h.tokenFormat],
+			"Token":  typed,
+		})
+		if err != nil {
+			log.Printf("Error executing vote token template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
 	// Validate token and get election
-	election, candidates, err := h.getElectionByToken(token)
+	election, contests, err := h.getElectionByToken(token)
 	if err != nil {
+		message := "Invalid or expired token"
+		if errors.Is(err, errTokenUsed) || errors.Is(err, errTokenRevoked) || errors.Is(err, errTokenExpired) {
+			message = err.Error()
+		}
 		err = h.renderTemplate(w, "vote_token.html", map[string]string{
-			"Error": "Invalid or expired token",
+			"Error":  message,
+			"Format": tokens.Formats[h.tokenFormat],
+			"Token":  typed,
 		})
 		if err != nil {
 			log.Printf("Error executing vote token template: %v", err)
@@ -193,10 +238,20 @@ func (h *Handlers) VoteForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if window := votingWindow(election, time.Now()); window != "open" {
+		h.renderVotingWindow(w, election, window)
+		return
+	}
+
+	if _, err := h.sealingKey(election); err != nil {
+		h.renderSealingKeyError(w, err)
+		return
+	}
+
 	data := map[string]interface{}{
-		"Election":   election,
-		"Candidates": candidates,
-		"Token":      token,
+		"Election": election,
+		"Contests": contests,
+		"Token":    token,
 	}
 
 	err = h.renderTemplate(w, "vote_form.html", data)
@@ -208,125 +263,448 @@ func (h *Handlers) VoteForm(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handlers) SubmitVote(w http.ResponseWriter, r *http.Request) {
-	token := r.FormValue("token")
-	candidateID := r.FormValue("candidate_id")
+	token, err := tokens.Normalize(r.FormValue("token"))
+	if err != nil {
+		h.renderVoteResult(w, false, err.Error())
+		return
+	}
 
 	// Validate token
 	tokenRecord, err := h.getTokenRecord(token)
-	if err != nil || tokenRecord.IsUsed {
-		err = h.renderTemplate(w, "vote_result.html", map[string]interface{}{
-			"Success": false,
-			"Message": "Invalid or already used token",
-		})
-		if err != nil {
-			log.Printf("Error executing vote result template: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	if err != nil {
+		h.renderVoteResult(w, false, "Invalid token")
+		return
+	}
+	if err := tokenUsable(tokenRecord); err != nil {
+		h.renderVoteResult(w, false, err.Error())
 		return
 	}
 
-	// Submit vote
-	err = h.submitVote(tokenRecord.ID, tokenRecord.ElectionID, candidateID)
+	// The ballot names the election it was issued for; a token from another
+	// election cannot cast it.
+	if posted := r.FormValue("election_id"); posted != "" && posted != strconv.Itoa(tokenRecord.ElectionID) {
+		h.renderVoteResult(w, false, errTokenWrongElection.Error())
+		return
+	}
+
+	election, err := h.getElectionByID(strconv.Itoa(tokenRecord.ElectionID))
 	if err != nil {
-		err = h.renderTemplate(w, "vote_result.html", map[string]interface{}{
-			"Success": false,
-			"Message": "Failed to submit vote",
-		})
-		if err != nil {
-			log.Printf("Error executing vote result template: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		h.renderVoteResult(w, false, "Invalid token")
+		return
+	}
+
+	if election.Status != "active" {
+		h.renderVoteResult(w, false, "This election is not accepting votes")
+		return
+	}
+
+	if window := votingWindow(election, time.Now()); window != "open" {
+		h.renderVotingWindow(w, election, window)
+		return
+	}
+
+	contests, err := h.getBallotContests(strconv.Itoa(election.ID))
+	if err != nil {
+		h.renderVoteResult(w, false, "Failed to submit vote")
+		return
+	}
+
+	ballot, message := parseBallot(r, election, contests)
+	if message != "" {
+		h.renderVoteResult(w, false, message)
+		return
+	}
+
+	if err := checkBallotSelections(contests, ballot); err != nil {
+		detail := fmt.Sprintf("Ballot for token %d rejected: %v", tokenRecord.ID, err)
+		if err := h.audit(election.ID, 0, "ballot_rejected", detail); err != nil {
+			log.Printf("Error recording audit entry: %v", err)
 		}
+		h.renderVoteResult(w, false, "Your ballot contains a choice that is not on this election's ballot, so it was not recorded")
+		return
+	}
+
+	sealingKey, err := h.sealingKey(election)
+	if err != nil {
+		h.renderSealingKeyError(w, err)
+		return
+	}
+
+	// Submit vote
+	receipt, err := h.submitVote(tokenRecord, election.ID, ballot, sealingKey)
+	switch {
+	case errors.Is(err, errTokenUsed), errors.Is(err, errTokenRevoked), errors.Is(err, errTokenExpired),
+		errors.Is(err, errTokenWrongElection), errors.Is(err, errTokenRaceLost):
+		h.renderVoteResult(w, false, err.Error())
+		return
+	case errors.Is(err, ledger.ErrTooLarge):
+		h.renderVoteResult(w, false, "This ballot holds too many choices to be encrypted, so it was not recorded")
+		return
+	case err != nil:
+		log.Printf("Error submitting vote: %v", err)
+		h.renderVoteResult(w, false, "Failed to submit vote")
 		return
 	}
 
 	err = h.renderTemplate(w, "vote_result.html", map[string]interface{}{
 		"Success": true,
 		"Message": "Vote submitted successfully",
+		"Receipt": formatReceipt(receipt),
 	})
 	if err != nil {
 		log.Printf("Error executing vote result template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	}
+}
+
+// contestBallot holds the voter's choices in one contest, in preference
+// order. A blank vote has no choices.
+type contestBallot struct {
+	ContestID int
+	Choices   []string
+}
+
+// parseBallot reads the voter's choices in every contest from the submitted
+// form. Fields are suffixed with the contest ID: a ranked or STV ballot posts
+// one "ranking_<id>" value per candidate, most preferred first, and an
+// approval ballot posts up to the contest's MaxSelections "candidate_id_<id>"
+// values; every other ballot, including referendum questions, posts a single
+// "candidate_id_<id>". A voter abstains from a contest by posting
+// "blank_<id>", or from the whole ballot by posting "blank". Contests without
+// candidates are skipped. A non-empty message means the ballot was rejected.
+func parseBallot(r *http.Request, election *models.Election, contests []models.Contest) ([]contestBallot, string) {
+	blankBallot := r.FormValue("blank") != ""
+
+	var ballot []contestBallot
+	for _, contest := range contests {
+		if len(contest.Candidates) == 0 {
+			continue
+		}
+
+		suffix := "_" + strconv.Itoa(contest.ID)
+		if blankBallot || r.FormValue("blank"+suffix) != "" {
+			ballot = append(ballot, contestBallot{ContestID: contest.ID})
+			continue
+		}
+
+		method := election.VotingMethod
+		if contest.Kind == "referendum" {
+			// Referendum questions take a single answer whatever the
+			// election's voting method.
+			method = "referendum"
+		}
+
+		var choices []string
+		switch method {
+		case "ranked", "stv":
+			choices = r.PostForm["ranking"+suffix]
+			if len(choices) == 0 {
+				return nil, "Please rank at least one candidate for " + contest.Title
+			}
+		case "approval":
+			choices = r.PostForm["candidate_id"+suffix]
+			if len(choices) == 0 {
+				return nil, "Please select at least one candidate for " + contest.Title
+			}
+			if len(choices) > contest.MaxSelections {
+				return nil, fmt.Sprintf("You may select at most %d candidates for %s", contest.MaxSelections, contest.Title)
+			}
+		case "referendum":
+			choice := r.FormValue("candidate_id" + suffix)
+			if choice == "" {
+				return nil, "Please answer " + contest.Title
+			}
+			choices = []string{choice}
+		default:
+			choice := r.FormValue("candidate_id" + suffix)
+			if choice == "" {
+				return nil, "Please select a candidate for " + contest.Title
+			}
+			choices = []string{choice}
+		}
+
+		seen := make(map[string]bool, len(choices))
+		for _, candidateID := range choices {
+			if seen[candidateID] {
+				return nil, "Each candidate can only be chosen once"
+			}
+			seen[candidateID] = true
+		}
+
+		ballot = append(ballot, contestBallot{ContestID: contest.ID, Choices: choices})
+	}
+
+	if len(ballot) == 0 {
+		return nil, "This election has no candidates to vote for"
+	}
+
+	return ballot, ""
+}
+
+// checkBallotSelections makes sure every choice is a candidate of the
+// contest it was made in. The vote form only offers those, so anything else,
+// such as a candidate of another contest or election or an unknown ID, comes
+// from a crafted request.
+func checkBallotSelections(contests []models.Contest, ballot []contestBallot) error {
+	onBallot := make(map[int]map[string]bool, len(contests))
+	for _, contest := range contests {
+		candidates := make(map[string]bool, len(contest.Candidates))
+		for _, candidate := range contest.Candidates {
+			candidates[strconv.Itoa(candidate.ID)] = true
+		}
+		onBallot[contest.ID] = candidates
+	}
+
+	for _, contest := range ballot {
+		for _, choice := range contest.Choices {
+			if !onBallot[contest.ContestID][choice] {
+				return fmt.Errorf("candidate %q is not on the ballot for contest %d", choice, contest.ContestID)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *Handlers) renderVoteResult(w http.ResponseWriter, success bool, message string) {
+	err := h.renderTemplate(w, "vote_result.html", map[string]interface{}{
+		"Success": success,
+		"Message": message,
+	})
+	if err != nil {
+		log.Printf("Error executing vote result template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// votingWindow reports where now falls relative to the election's voting
+// window: "not_open" before StartDate, "closed" from EndDate on, and "open"
+// in between.
+func votingWindow(election *models.Election, now time.Time) string {
+	switch {
+	case now.Before(election.StartDate):
+		return "not_open"
+	case !now.Before(election.EndDate):
+		return "closed"
+	default:
+		return "open"
+	}
+}
+
+// renderVotingWindow explains that voting has not opened yet or has closed.
+func (h *Handlers) renderVotingWindow(w http.ResponseWriter, election *models.Election, window string) {
+	err := h.renderTemplate(w, "vote_window.html", map[string]interface{}{
+		"Election": election,
+		"Closed":   window == "closed",
+	})
+	if err != nil {
+		log.Printf("Error executing vote window template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
 
 // Helper functions
-func (h *Handlers) getElectionByToken(token string) (*models.Election, []models.Candidate, error) {
-	// Get election from token
+
+// getElectionByToken finds the active election a token can vote in. A used,
+// revoked or expired token gets the error saying so.
+func (h *Handlers) getElectionByToken(token string) (*models.Election, []models.Contest, error) {
+	record, err := h.getTokenRecord(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tokenUsable(record); err != nil {
+		return nil, nil, err
+	}
+
 	query := `
-		SELECT e.id, e.title, e.description, e.start_date, e.end_date, e.status
-		FROM elections e
-		JOIN voting_tokens vt ON e.id = vt.election_id
-		WHERE vt.token = ? AND vt.is_used = FALSE AND e.status = 'active'
+		SELECT ` + electionColumns + `
+		FROM elections
+		WHERE status = 'active' AND id = ?
 	`
 
 	election := &models.Election{}
-	err := h.db.QueryRow(query, token).Scan(
-		&election.ID, &election.Title, &election.Description,
-		&election.StartDate, &election.EndDate, &election.Status,
-	)
+	err = scanElection(h.db.QueryRow(query, record.ElectionID), election)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Get candidates
-	candidatesQuery := `SELECT id, name, description, photo_url FROM candidates WHERE election_id = ? ORDER BY order_num`
-	rows, err := h.db.Query(candidatesQuery, election.ID)
+	// Get contests and their candidates
+	contests, err := h.getBallotContests(strconv.Itoa(election.ID))
 	if err != nil {
 		return nil, nil, err
 	}
-	defer rows.Close()
-
-	var candidates []models.Candidate
-	for rows.Next() {
-		var candidate models.Candidate
-		err := rows.Scan(&candidate.ID, &candidate.Name, &candidate.Description, &candidate.PhotoURL)
-		if err != nil {
-			return nil, nil, err
-		}
-		candidates = append(candidates, candidate)
-	}
 
-	return election, candidates, nil
+	return election, contests, nil
 }
 
 func (h *Handlers) getTokenRecord(token string) (*models.VotingToken, error) {
 	tokenRecord := &models.VotingToken{}
-	query := `SELECT id, election_id, token, is_used FROM voting_tokens WHERE token = ?`
+	now := time.Now().UTC().Truncate(time.Second)
+	err := scanTokenRecord(h.db.QueryRow(tokenRecordQuery+` WHERE token = ?`, now, token), tokenRecord)
+	return tokenRecord, err
+}
 
-	err := h.db.QueryRow(query, token).Scan(
-		&tokenRecord.ID, &tokenRecord.ElectionID, &tokenRecord.Token, &tokenRecord.IsUsed,
+// tokenRecordQuery reads a token and whether it had expired by the time
+// given as the first argument.
+const tokenRecordQuery = `
+	SELECT id, election_id, token, is_used, weight,
+		expires_at, COALESCE(expires_at <= ?, FALSE), revoked_at, revoked_reason, COALESCE(replaced_by, 0)
+	FROM voting_tokens`
+
+func scanTokenRecord(row *sql.Row, token *models.VotingToken) error {
+	return row.Scan(
+		&token.ID, &token.ElectionID, &token.Token, &token.IsUsed, &token.Weight,
+		&token.ExpiresAt, &token.Expired, &token.RevokedAt, &token.RevokeReason, &token.ReplacedBy,
 	)
+}
 
-	return tokenRecord, err
+// tokenUsable says why a token can no longer vote, or nil if it can.
+func tokenUsable(token *models.VotingToken) error {
+	switch {
+	case token.IsUsed:
+		return errTokenUsed
+	case token.RevokedAt != nil:
+		return errTokenRevoked
+	case token.Expired:
+		return errTokenExpired
+	}
+	return nil
 }
 
-func (h *Handlers) submitVote(tokenID int, electionID int, candidateID string) error {
+// Reasons a token cannot be redeemed, worded for the voter.
+var (
+	errTokenUsed          = errors.New("This token has already been used to vote")
+	errTokenRevoked       = errors.New("This token has been revoked; ask the election administrator for a new one")
+	errTokenExpired       = errors.New("This token has expired")
+	errTokenWrongElection = errors.New("This token is not valid for this election")
+	errTokenRaceLost      = errors.New("This token was used to submit another ballot at the same moment, so this ballot was not recorded")
+)
+
+// submitVote redeems the token and records its ballot, one votes row per
+// contest, in a single transaction, and returns the ballot's receipt code.
+// The token is marked used, and the ballot takes its weight but nothing
+// that leads back to it. With a sealing key, the ballot is sealed to it instead of going
+// into the ballot box, which it only reaches once the trustees decrypt it.
+func (h *Handlers) submitVote(token *models.VotingToken, electionID int, ballot []contestBallot, sealingKey *big.Int) (string, error) {
 	tx, err := h.db.Begin()
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer tx.Rollback()
 
-	// Insert vote
+	if err := redeemToken(tx, token, electionID); err != nil {
+		return "", err
+	}
+
+	// The ballot is not linked to the token: it only shares a random ballot
+	// ID between its contests, and each vote gets a random row ID.
+	ballotID := generateRandomToken()
+	var digest string
+	if sealingKey != nil {
+		digest, err = ledger.Seal(tx, electionID, ballotID, token.Weight, sealingKey, ledgerBallot(ballot))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if err := storeBallot(tx, electionID, ballotID, ballot); err != nil {
+			return "", err
+		}
+		digest = ledger.Digest(electionID, ballotID, token.Weight, ledgerBallot(ballot))
+	}
+
+	receipt := digestReceipt(digest)
 	_, err = tx.Exec(
-		`INSERT INTO votes (election_id, candidate_id, token_id) VALUES (?, ?, ?)`,
-		electionID, candidateID, tokenID,
+		`INSERT INTO ballots (id, election_id, receipt, weight) VALUES (?, ?, ?, ?)`,
+		ballotID, electionID, receipt, token.Weight,
 	)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ledger.Append(tx, electionID, ballotID, digest); err != nil {
+		return "", err
+	}
+
+	return receipt, tx.Commit()
+}
+
+// storeBallot puts a ballot in the ballot box. Each contest's choices are
+// candidate IDs in preference order; the first one is also stored on the
+// votes row. A blank vote is stored without a candidate or selections, so
+// it counts towards turnout but not for anyone.
+func storeBallot(tx *sql.Tx, electionID int, ballotID string, ballot []contestBallot) error {
+	for _, contest := range ballot {
+		var firstChoice interface{}
+		if len(contest.Choices) > 0 {
+			firstChoice = contest.Choices[0]
+		}
+
+		// Insert vote
+		voteID := randomRowID()
+		_, err := tx.Exec(
+			`INSERT INTO votes (id, ballot_id, election_id, contest_id, candidate_id) VALUES (?, ?, ?, ?, ?)`,
+			voteID, ballotID, electionID, contest.ContestID, firstChoice,
+		)
+		if err != nil {
+			return err
+		}
+
+		for i, candidateID := range contest.Choices {
+			_, err = tx.Exec(
+				`INSERT INTO vote_selections (vote_id, candidate_id, preference) VALUES (?, ?, ?)`,
+				voteID, candidateID, i+1,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redeemToken marks the token used for electionID. The update only matches
+// an unused, unrevoked and unexpired token of that election, so of several
+// submissions racing with the same token exactly one gets past it; the
+// others wait for its transaction and then find the token spent. A token
+// revoked while its ballot was being filled in does not get past it either.
+// When nothing matched, the token is read again to tell the voter why. Only the day the token was used
+// is kept: the ballot ledger records the order ballots were cast in, and
+// exact times on the tokens would line the two up.
+func redeemToken(tx *sql.Tx, token *models.VotingToken, electionID int) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := tx.Exec(`
+		UPDATE voting_tokens SET is_used = TRUE, used_at = CURRENT_DATE
+		WHERE id = ? AND election_id = ? AND is_used = FALSE
+			AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+	`, token.ID, electionID, now)
 	if err != nil {
 		return err
 	}
 
-	// Mark token as used
-	_, err = tx.Exec(
-		`UPDATE voting_tokens SET is_used = TRUE, used_at = CURRENT_TIMESTAMP WHERE id = ?`,
-		tokenID,
-	)
+	redeemed, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if redeemed == 1 {
+		return nil
+	}
 
-	return tx.Commit()
+	var current models.VotingToken
+	err = scanTokenRecord(tx.QueryRow(tokenRecordQuery+` WHERE id = ?`, now, token.ID), &current)
+	switch {
+	case err == sql.ErrNoRows:
+		return errTokenUsed
+	case err != nil:
+		return err
+	case current.ElectionID != electionID:
+		return errTokenWrongElection
+	case current.IsUsed && !token.IsUsed:
+		// Unused when the submission started: another one won the race.
+		return errTokenRaceLost
+	}
+	if err := tokenUsable(&current); err != nil {
+		return err
+	}
+	return errTokenUsed
 }
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"evoting-app/internal/database"
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+	"evoting-app/internal/tokens"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// newTestHandlers sets up handlers over a fresh, migrated database.
+func newTestHandlers(t *testing.T) (*Handlers, *sql.DB) {
+	t.Helper()
+	// The handlers load their templates relative to the repository root
+	t.Chdir(filepath.Join("..", ".."))
+
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "evoting.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return New(db, sessions.NewCookieStore([]byte("test")), nil, "http://localhost", tokens.Base32), db
+}
+
+// createTestElection adds an active election with one contest and the
+// named candidates, returning their IDs.
+func createTestElection(t *testing.T, db *sql.DB, names ...string) (electionID, contestID int64, candidateIDs []int64) {
+	t.Helper()
+	now := time.Now().UTC()
+	result, err := db.Exec(
+		`INSERT INTO elections (title, description, start_date, end_date, status, created_by) VALUES (?, '', ?, ?, 'active', 1)`,
+		"Test", now.Add(-time.Hour), now.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	electionID, _ = result.LastInsertId()
+	result, err = db.Exec(`INSERT INTO contests (election_id, title) VALUES (?, 'Chair')`, electionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contestID, _ = result.LastInsertId()
+	for i, name := range names {
+		result, err = db.Exec(`INSERT INTO candidates (election_id, contest_id, name, description, photo_url, order_num) VALUES (?, ?, ?, '', '', ?)`, electionID, contestID, name, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		candidateIDs = append(candidateIDs, id)
+	}
+	return electionID, contestID, candidateIDs
+}
+
+// issueTestToken adds an unused token to the election.
+func issueTestToken(t *testing.T, db *sql.DB, electionID int64) string {
+	t.Helper()
+	token, err := tokens.Generate(tokens.Base32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO voting_tokens (election_id, token) VALUES (?, ?)`, electionID, token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// voteForm is a single-contest ballot for the candidate.
+func voteForm(token string, electionID, contestID, candidateID int64) string {
+	return url.Values{
+		"token":       {token},
+		"election_id": {strconv.FormatInt(electionID, 10)},
+		"candidate_id_" + strconv.FormatInt(contestID, 10): {strconv.FormatInt(candidateID, 10)},
+	}.Encode()
+}
+
+// adminRequest is a form POST by the superadmin, with the given route
+// variables.
+func adminRequest(path string, form url.Values, vars map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, &models.User{ID: 1, Role: "superadmin"}))
+	return mux.SetURLVars(r, vars)
+}
+
+// TestSubmitVoteSameTokenConcurrently fires many submissions with one token
+// at once: exactly one ballot may be recorded, and every other voter must be
+// told the token was used.
+func TestSubmitVoteSameTokenConcurrently(t *testing.T) {
+	h, db := newTestHandlers(t)
+	electionID, contestID, candidateIDs := createTestElection(t, db, "Alice")
+	form := voteForm(issueTestToken(t, db, electionID), electionID, contestID, candidateIDs[0])
+
+	const submissions = 20
+	bodies := make([]string, submissions)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			<-start
+			h.SubmitVote(w, r)
+			bodies[i] = w.Body.String()
+		}()
+	}
+	// Hold the write lock while the submissions start, so that they all find
+	// the token unused and then queue up to redeem it, rather than running
+	// one after another.
+	lock, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(start)
+	time.Sleep(500 * time.Millisecond)
+	lock.Rollback()
+	wg.Wait()
+
+	var accepted int
+	for i, body := range bodies {
+		switch {
+		case strings.Contains(body, "Vote submitted successfully"):
+			accepted++
+		case strings.Contains(body, template.HTMLEscapeString(errTokenRaceLost.Error())),
+			strings.Contains(body, template.HTMLEscapeString(errTokenUsed.Error())):
+		default:
+			t.Errorf("submission %d was neither accepted nor turned away as a used token:\n%s", i, body)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("%d submissions accepted, want 1", accepted)
+	}
+
+	for table, want := range map[string]int{"ballots": 1, "ballot_ledger": 1} {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%d %s rows, want %d", n, table, want)
+		}
+	}
+}
+
+// TestDeleteCandidateAfterVoting checks that a candidate cannot be deleted
+// once ballots have been cast, which would take votes out of them.
+func TestDeleteCandidateAfterVoting(t *testing.T) {
+	h, db := newTestHandlers(t)
+	electionID, contestID, candidateIDs := createTestElection(t, db, "Alice", "Bob")
+
+	for _, candidateID := range candidateIDs {
+		r := httptest.NewRequest(http.MethodPost, "/vote", strings.NewReader(voteForm(issueTestToken(t, db, electionID), electionID, contestID, candidateID)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.SubmitVote(w, r)
+		if !strings.Contains(w.Body.String(), "Vote submitted successfully") {
+			t.Fatalf("vote not accepted:\n%s", w.Body.String())
+		}
+	}
+
+	id := strconv.FormatInt(electionID, 10)
+	w := httptest.NewRecorder()
+	h.DeleteCandidate(w, adminRequest("/admin/admin/elections/"+id+"/candidates/delete", nil, map[string]string{
+		"id": id, "candidate_id": strconv.FormatInt(candidateIDs[0], 10),
+	}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("delete after voting answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for table, want := range map[string]int{"candidates": 2, "votes": 2} {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%d %s rows after the delete, want %d", n, table, want)
+		}
+	}
+}
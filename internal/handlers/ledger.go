@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// VerifyElectionLedger recomputes the election's ballot ledger and shows
+// the first broken link, if any.
+func (h *Handlers) VerifyElectionLedger(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := ledger.Verify(h.db, election.ID)
+	if err != nil {
+		log.Printf("Error verifying ballot ledger: %v", err)
+		http.Error(w, "Failed to verify the ballot ledger", http.StatusInternalServerError)
+		return
+	}
+
+	if !result.OK() {
+		detail := fmt.Sprintf("Ledger verification failed at entry %d: %s", result.BrokenAt, result.Problem)
+		if err := h.audit(election.ID, user.ID, "ledger_verification_failed", detail); err != nil {
+			log.Printf("Error recording audit entry: %v", err)
+		}
+	}
+
+	data := map[string]interface{}{
+		"User":     user,
+		"Election": election,
+		"Result":   result,
+	}
+
+	err = h.renderAdminTemplate(w, "ledger.html", data)
+	if err != nil {
+		log.Printf("Error executing ledger template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/mailer"
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// SendInvitations queues an email with their token for every voter on the
+// roll who has not been sent one, or with a voter_id in the path for that
+// voter alone, e.g. after their address was corrected.
+func (h *Handlers) SendInvitations(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case h.mail == nil:
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Email delivery is not configured"})
+		return
+	case election.Status == "completed":
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "The election has closed"})
+		return
+	}
+
+	var queued int
+	if voterID, ok := vars["voter_id"]; ok {
+		id, convErr := strconv.Atoi(voterID)
+		if convErr != nil {
+			http.Error(w, "Voter not found", http.StatusNotFound)
+			return
+		}
+		queued, err = mailer.QueueInvitation(h.db, election.ID, id)
+	} else {
+		queued, err = mailer.QueueInvitations(h.db, election.ID)
+	}
+	if err != nil {
+		log.Printf("Error queueing invitations: %v", err)
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Failed to queue the invitations"})
+		return
+	}
+
+	h.queued(w, user, election, queued, mailer.Invitation,
+		"No voter is waiting for an invitation: each needs an email address that has not bounced, an unused token and no message already queued")
+}
+
+// SendReminders queues a reminder for every voter on the roll who has not
+// voted yet.
+func (h *Handlers) SendReminders(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case h.mail == nil:
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Email delivery is not configured"})
+		return
+	case election.Status != "active":
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Reminders can only be sent while the election is active"})
+		return
+	}
+
+	queued, err := mailer.QueueReminders(h.db, election.ID)
+	if err != nil {
+		log.Printf("Error queueing reminders: %v", err)
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Failed to queue the reminders"})
+		return
+	}
+
+	h.queued(w, user, election, queued, mailer.Reminder,
+		"Every voter with an email address has voted or already has a message queued")
+}
+
+// queued reports how many messages were queued, and wakes the dispatcher to
+// send them.
+func (h *Handlers) queued(w http.ResponseWriter, user *models.User, election *models.Election, queued int, kind, none string) {
+	if queued == 0 {
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": none})
+		return
+	}
+
+	detail := fmt.Sprintf("%d %s email(s) queued", queued, kind)
+	if err := h.audit(election.ID, user.ID, kind+"s_queued", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+	h.mail.Wake()
+
+	h.renderVoters(w, user, election, map[string]interface{}{
+		"Success": fmt.Sprintf("%d %s(s) queued; the status column shows when each is sent", queued, kind),
+	})
+}
+
+// MailBounce is the webhook a mail server or provider calls when a message
+// comes back undelivered. It is authorized by the MAIL_BOUNCE_SECRET bearer
+// token and takes the bounced message's Message-ID or the address it was
+// sent to, with an optional reason, as form fields or JSON.
+func (h *Handlers) MailBounce(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var report struct {
+			MessageID string `json:"message_id"`
+			Email     string `json:"email"`
+			Reason    string `json:"reason"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		} else {
+			report.MessageID = r.FormValue("message_id")
+			report.Email = r.FormValue("email")
+			report.Reason = r.FormValue("reason")
+		}
+		if report.MessageID == "" && report.Email == "" {
+			http.Error(w, "A message_id or email is required", http.StatusBadRequest)
+			return
+		}
+		if report.Reason == "" {
+			report.Reason = "Bounced"
+		}
+
+		bounces, err := mailer.RecordBounce(h.db, report.MessageID, report.Email, report.Reason)
+		if err != nil {
+			log.Printf("Error recording bounce: %v", err)
+			http.Error(w, "Failed to record the bounce", http.StatusInternalServerError)
+			return
+		}
+		for _, bounce := range bounces {
+			detail := fmt.Sprintf("%s email to voter %s bounced: %s", bounce.Kind, bounce.MemberID, report.Reason)
+			if err := h.audit(bounce.ElectionID, 0, "email_bounced", detail); err != nil {
+				log.Printf("Error recording audit entry: %v", err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"bounced": len(bounces)})
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/models"
+)
+
+// quorumBasisLabels names what an election's turnout can be measured
+// against.
+var quorumBasisLabels = map[string]string{
+	"tokens": "Issued tokens",
+	"roll":   "Registered voters",
+}
+
+// parseQuorumRule reads the quorum rule entered on an election form. Empty
+// fields mean no requirement.
+func parseQuorumRule(r *http.Request) (models.QuorumRule, error) {
+	rule := models.QuorumRule{Basis: r.FormValue("quorum_basis")}
+	if _, ok := quorumBasisLabels[rule.Basis]; !ok {
+		rule.Basis = "tokens"
+	}
+
+	fields := []struct {
+		name  string
+		value *int
+		max   int
+		err   string
+	}{
+		{"quorum_percent", &rule.Percent, 100, "Quorum must be a percentage between 0 and 100"},
+		{"min_winning_share", &rule.MinWinningShare, 100, "Minimum winning share must be a percentage between 0 and 100"},
+		{"registered_voters", &rule.RegisteredVoters, -1, "Registered voters must be a whole number of at least 0"},
+	}
+	for _, field := range fields {
+		value := strings.TrimSpace(r.FormValue(field.name))
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (field.max >= 0 && n > field.max) {
+			return rule, errors.New(field.err)
+		}
+		*field.value = n
+	}
+
+	return rule, nil
+}
+
+// resultValidity judges an election's result against its quorum rule, or
+// returns nil if it has none. A result is pending until the election is
+// completed; it is invalid if turnout fell below the quorum or a winner won
+// less than the minimum share of the ballots counted in their contest.
+func resultValidity(election *models.Election, report *models.ElectionReport) *models.ResultValidity {
+	rule := election.Quorum
+	if rule.Percent == 0 && rule.MinWinningShare == 0 {
+		return nil
+	}
+
+	// Measured against the tokens, turnout is in votes, so that a quorum of
+	// shares counts each member's shares; the voter roll counts heads. A
+	// number of registered voters entered with the rule stands in for a roll
+	// kept outside the application.
+	validity := &models.ResultValidity{Basis: rule.Basis, Eligible: report.Stats.TotalWeight}
+	ballots := report.Stats.WeightedVotes
+	if rule.Basis == "roll" {
+		validity.Eligible = rule.RegisteredVoters
+		if validity.Eligible == 0 {
+			validity.Eligible = report.Stats.RegisteredVoters
+		}
+		ballots = report.Stats.TotalVotes
+	}
+	validity.Turnout = percentage(ballots, validity.Eligible)
+
+	if election.Status != "completed" {
+		validity.Status = "pending"
+		validity.Reason = "The election has not been completed"
+		return validity
+	}
+	if rule.Percent > 0 && rule.Basis == "roll" && validity.Eligible == 0 {
+		validity.Status = "pending"
+		validity.Reason = "No voters are registered to measure the quorum against"
+		return validity
+	}
+
+	if rule.Percent > 0 && (validity.Eligible == 0 || ballots*100 < rule.Percent*validity.Eligible) {
+		validity.Status = "invalid"
+		validity.Reason = fmt.Sprintf("Turnout of %.1f%% is below the quorum of %d%% of %s",
+			validity.Turnout, rule.Percent, quorumBasisNoun(rule.Basis))
+		return validity
+	}
+
+	if rule.MinWinningShare > 0 {
+		if report.Sealed != nil && !report.Sealed.Opened {
+			validity.Status = "pending"
+			validity.Reason = "The winning shares are known once the trustees have decrypted the ballots"
+			return validity
+		}
+		for _, contest := range report.Contests {
+			if share, ok := winningShare(contest); ok && share*100 < float64(rule.MinWinningShare) {
+				validity.Short = append(validity.Short, contest.Contest.Title)
+			}
+		}
+		if len(validity.Short) > 0 {
+			validity.Status = "invalid"
+			validity.Reason = fmt.Sprintf("The winner of %s won less than the minimum share of %d%%",
+				strings.Join(validity.Short, ", "), rule.MinWinningShare)
+			return validity
+		}
+	}
+
+	validity.Status = "valid"
+	if rule.Percent > 0 {
+		validity.Reason = fmt.Sprintf("Turnout of %.1f%% meets the quorum of %d%%", validity.Turnout, rule.Percent)
+	} else {
+		validity.Reason = "Every winner reached the minimum share"
+	}
+	return validity
+}
+
+// winningShare is the smallest share, as a fraction, that any winner of a
+// contest won: of the ballots that chose someone, or for an instant-runoff
+// count of the ballots still in the final round. Referendums, STV contests
+// and contests without a winner have none.
+func winningShare(report models.ContestReport) (float64, bool) {
+	switch {
+	case report.Referendum != nil, report.STV != nil:
+		return 0, false
+	case report.Runoff != nil:
+		if report.Runoff.WinnerID == 0 {
+			return 0, false
+		}
+		final := len(report.Runoff.Rounds)
+		var winner, continuing int
+		for _, row := range report.Runoff.Rows {
+			if len(row.Counts) != final {
+				continue
+			}
+			continuing += row.Counts[final-1]
+			if row.CandidateID == report.Runoff.WinnerID {
+				winner = row.Counts[final-1]
+			}
+		}
+		if continuing == 0 {
+			return 0, false
+		}
+		return float64(winner) / float64(continuing), true
+	}
+
+	counted := report.TotalBallots - report.BlankVotes
+	share, found := 1.0, false
+	for _, vc := range report.VoteCounts {
+		if vc.Elected && counted > 0 {
+			found = true
+			if s := float64(vc.VoteCount) / float64(counted); s < share {
+				share = s
+			}
+		}
+	}
+	return share, found
+}
+
+// quorumSummary describes a quorum rule, for report exports.
+func quorumSummary(rule models.QuorumRule) string {
+	var parts []string
+	if rule.Percent > 0 {
+		parts = append(parts, fmt.Sprintf("%d%% turnout of %s", rule.Percent, quorumBasisNoun(rule.Basis)))
+	}
+	if rule.MinWinningShare > 0 {
+		parts = append(parts, fmt.Sprintf("winners need %d%% of the counted ballots", rule.MinWinningShare))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// quorumBasisNoun names a quorum basis in the middle of a sentence.
+func quorumBasisNoun(basis string) string {
+	return strings.ToLower(quorumBasisLabels[basis])
+}
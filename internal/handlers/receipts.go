@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/models"
+)
+
+// receiptLength is the number of hex digits of the ballot digest a voter is
+// given, shown in groups of four.
+const receiptLength = 24
+
+// VerifyReceipt lets a voter check that the ballot behind a receipt code is
+// in the ballot box and unchanged, without showing what was on it.
+func (h *Handlers) VerifyReceipt(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{}
+
+	input := r.URL.Query().Get("receipt")
+	if input != "" {
+		data["Input"] = input
+		receipt := normalizeReceipt(input)
+		if len(receipt) != receiptLength {
+			data["Error"] = "A receipt code has " + strconv.Itoa(receiptLength) + " letters and digits"
+		} else {
+			result, err := h.verifyReceipt(receipt)
+			switch {
+			case err == sql.ErrNoRows:
+				data["Error"] = "No ballot with this receipt code was found"
+			case err != nil:
+				log.Printf("Error verifying receipt: %v", err)
+				data["Error"] = "Failed to verify the receipt"
+			default:
+				data["Result"] = result
+			}
+		}
+	}
+
+	err := h.renderTemplate(w, "verify.html", data)
+	if err != nil {
+		log.Printf("Error executing verify template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// receiptCheck is what the verify page may tell anyone holding a receipt.
+type receiptCheck struct {
+	Receipt  string
+	Election *models.Election
+	Intact   bool // the stored ballot still produces the receipt
+}
+
+// verifyReceipt finds the ballot issued the receipt and recomputes the
+// receipt from the ballot as it is stored now, sealed or not.
+func (h *Handlers) verifyReceipt(receipt string) (*receiptCheck, error) {
+	var ballotID string
+	var electionID int
+	err := h.db.QueryRow(
+		`SELECT id, election_id FROM ballots WHERE receipt = ?`, receipt,
+	).Scan(&ballotID, &electionID)
+	if err != nil {
+		return nil, err
+	}
+
+	election, err := h.getElectionByID(strconv.Itoa(electionID))
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := ledger.StoredDigest(h.db, electionID, ballotID)
+	if err != nil && err != ledger.ErrInconsistent && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	check := &receiptCheck{
+		Receipt:  formatReceipt(receipt),
+		Election: election,
+		Intact:   err == nil && digestReceipt(digest) == receipt,
+	}
+	// Anyone may look a receipt up, so a mismatch is recorded once per
+	// ballot however often it is looked up.
+	if !check.Intact {
+		detail := fmt.Sprintf("Ballot %s no longer matches its receipt", ballotID)
+		if err := h.auditOnce(electionID, 0, "receipt_mismatch", detail); err != nil {
+			log.Printf("Error recording audit entry: %v", err)
+		}
+	}
+
+	return check, nil
+}
+
+// digestReceipt is the receipt code for a ballot: the start of the digest
+// its ledger entry records.
+func digestReceipt(digest string) string {
+	return strings.ToUpper(digest)[:receiptLength]
+}
+
+func ledgerBallot(ballot []contestBallot) []ledger.Contest {
+	contests := make([]ledger.Contest, len(ballot))
+	for i, contest := range ballot {
+		contests[i] = ledger.Contest{ContestID: contest.ContestID, Choices: contest.Choices}
+	}
+	return contests
+}
+
+// normalizeReceipt drops the separators and spaces a voter may type and
+// upper-cases the rest.
+func normalizeReceipt(input string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(input) {
+		if (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F') {
+			b.WriteRune(c)
+		} else if c != '-' && c != ' ' {
+			return ""
+		}
+	}
+	return b.String()
+}
+
+// formatReceipt splits a receipt code into groups of four for reading.
+func formatReceipt(receipt string) string {
+	var groups []string
+	for i := 0; i < len(receipt); i += 4 {
+		end := i + 4
+		if end > len(receipt) {
+			end = len(receipt)
+		}
+		groups = append(groups, receipt[i:end])
+	}
+	return strings.Join(groups, "-")
+}
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+	"evoting-app/internal/tally"
+
+	"github.com/gorilla/mux"
+)
+
+// ExportElectionReport downloads the election report as CSV, including the
+// round-by-round tables for ranked and STV counts.
+func (h *Handlers) ExportElectionReport(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if hidden, _ := h.resultsAccess(r, user, election); hidden {
+		http.Error(w, "Results are embargoed until the election closes", http.StatusForbidden)
+		return
+	}
+
+	report, err := h.getElectionReport(election)
+	if err != nil {
+		log.Printf("Error building election report: %v", err)
+		http.Error(w, "Failed to load election report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="election-%d-report.csv"`, election.ID))
+
+	cw := csv.NewWriter(w)
+	writeReportCSV(cw, election, report)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error writing election report export: %v", err)
+	}
+}
+
+// getElectionReport counts each of the election's contests with its voting
+// method.
+func (h *Handlers) getElectionReport(election *models.Election) (*models.ElectionReport, error) {
+	electionID := strconv.Itoa(election.ID)
+
+	stats, err := h.getElectionStats(electionID)
+	if err != nil {
+		return nil, err
+	}
+
+	contests, err := h.getBallotContests(electionID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.ElectionReport{Stats: stats}
+	report.LedgerBallots, report.LedgerHead, err = ledger.Head(h.db, election.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing of an encrypted election can be counted until its trustees
+	// have decrypted the ballots.
+	if election.Encrypted {
+		report.Sealed, err = h.getSealedTally(election.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !report.Sealed.Opened {
+			stats.TotalVotes = report.Sealed.Ballots
+			stats.WeightedVotes = report.Sealed.Weight
+			report.Validity = resultValidity(election, report)
+			return report, nil
+		}
+	}
+
+	for _, contest := range contests {
+		contestReport, err := h.getContestReport(election, contest)
+		if err != nil {
+			return nil, err
+		}
+		report.Contests = append(report.Contests, *contestReport)
+	}
+
+	report.Validity = resultValidity(election, report)
+	return report, nil
+}
+
+// getContestReport counts a single contest's ballots.
+func (h *Handlers) getContestReport(election *models.Election, contest models.Contest) (*models.ContestReport, error) {
+	voteCounts, err := h.getVoteCountsByContest(contest.ID, election.VotingMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.ContestReport{Contest: contest, VoteCounts: voteCounts}
+	err = h.db.QueryRow(`
+		SELECT COALESCE(SUM(COALESCE(b.weight, 1)), 0),
+			COALESCE(SUM(CASE WHEN v.candidate_id IS NULL THEN COALESCE(b.weight, 1) ELSE 0 END), 0)
+		FROM votes v LEFT JOIN ballots b ON b.id = v.ballot_id
+		WHERE v.contest_id = ?
+	`, contest.ID).Scan(&report.TotalBallots, &report.BlankVotes)
+	if err != nil {
+		return nil, err
+	}
+
+	if contest.Kind == "referendum" {
+		report.Referendum = referendumReport(contest, voteCounts)
+		return report, nil
+	}
+
+	// Ranked and STV contests are decided by their transfer counts;
+	// otherwise the candidates with the most votes fill the available seats.
+	switch election.VotingMethod {
+	case "ranked":
+		report.Runoff, err = h.getRunoffReport(contest)
+		if err == nil {
+			report.Tie, err = h.runoffTie(election, contest, report.Runoff)
+		}
+	case "stv":
+		report.STV, report.Tie, err = h.getSTVReport(election, contest)
+	default:
+		report.Tie, err = h.electSeats(election, contest, voteCounts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Transfer counts elect their own winners; mark them among the first
+	// preferences too.
+	if elected := transferWinners(report); elected != nil {
+		for i := range report.VoteCounts {
+			report.VoteCounts[i].Elected = elected[report.VoteCounts[i].CandidateID]
+		}
+	}
+
+	return report, nil
+}
+
+// transferWinners returns the candidates a ranked or STV count elected,
+// counting an instant-runoff winner drawn by lot, or nil for other
+// contests.
+func transferWinners(report *models.ContestReport) map[int]bool {
+	elected := make(map[int]bool)
+	switch {
+	case report.Runoff != nil:
+		winner := report.Runoff.WinnerID
+		if tie := report.Tie; tie != nil && tie.Draw != nil {
+			winner = tie.Draw.WinnerIDs[0]
+		}
+		if winner != 0 {
+			elected[winner] = true
+		}
+	case report.STV != nil:
+		for _, row := range report.STV.Rows {
+			if row.ElectedIn > 0 {
+				elected[row.CandidateID] = true
+			}
+		}
+	default:
+		return nil
+	}
+	return elected
+}
+
+// getSTVReport runs a Single Transferable Vote count over the contest's
+// ranked ballots and lays out the transfers stage by stage. A tie the count
+// cannot break from earlier totals is returned and settled under the
+// election's tie-break rule: a recorded lot drawing orders the candidates
+// for the whole count, and otherwise the count stops at the tie.
+func (h *Handlers) getSTVReport(election *models.Election, contest models.Contest) (*models.STVReport, *models.TieReport, error) {
+	candidates := contest.Candidates
+	seats := contest.Seats
+
+	ballots, err := h.getBallotsByContest(contest.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int, len(candidates))
+	names := make(map[int]string, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.ID
+		names[candidate.ID] = candidate.Name
+	}
+
+	result := tally.STV(ids, ballots, seats)
+	tie, err := h.stvTie(election, contest, result)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tie != nil && tie.Draw != nil {
+		// The lot orders every candidate, so it settles this tie and any
+		// the count comes to after it.
+		result = tally.STV(tally.DrawLots(tie.Draw.Seed, ids), ballots, seats)
+	} else if tie != nil {
+		result.Stages = result.Stages[:result.Tie.Stage]
+		result.Elected = nil
+		for _, stage := range result.Stages {
+			result.Elected = append(result.Elected, stage.Elected...)
+		}
+	}
+
+	report := &models.STVReport{
+		Seats:      seats,
+		ValidVotes: tally.FormatValue(result.ValidVotes),
+		Quota:      tally.FormatValue(result.Quota),
+	}
+	for _, id := range result.Elected {
+		report.Elected = append(report.Elected, names[id])
+	}
+
+	electedIn := make(map[int]int)
+	excludedIn := make(map[int]int)
+	for i, stage := range result.Stages {
+		var action string
+		switch stage.Action {
+		case "first":
+			action = "First preferences"
+		case "surplus":
+			action = "Surplus of " + names[stage.Candidate]
+		case "exclusion":
+			action = "Exclusion of " + names[stage.Candidate]
+			excludedIn[stage.Candidate] = i + 1
+		case "remaining":
+			action = "Remaining candidates elected"
+		}
+		for _, id := range stage.Elected {
+			electedIn[id] = i + 1
+		}
+		report.Stages = append(report.Stages, models.STVStage{
+			Number:    i + 1,
+			Action:    action,
+			Exhausted: tally.FormatValue(stage.Exhausted),
+		})
+	}
+
+	for _, candidate := range candidates {
+		row := models.STVRow{
+			CandidateID:   candidate.ID,
+			CandidateName: candidate.Name,
+			ElectedIn:     electedIn[candidate.ID],
+			ExcludedIn:    excludedIn[candidate.ID],
+		}
+		for _, stage := range result.Stages {
+			row.Transfers = append(row.Transfers, tally.FormatValue(stage.Transfers[candidate.ID]))
+			row.Totals = append(row.Totals, tally.FormatValue(stage.Totals[candidate.ID]))
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	return report, tie, nil
+}
+
+// referendumReport decides whether a referendum carried from the votes for
+// each of its options.
+func referendumReport(contest models.Contest, voteCounts []models.VoteCount) *models.ReferendumReport {
+	report := &models.ReferendumReport{}
+	stances := make(map[int]string, len(contest.Candidates))
+	for _, option := range contest.Candidates {
+		stances[option.ID] = option.Stance
+		switch option.Stance {
+		case "yes":
+			report.YesLabel = option.Name
+		case "no":
+			report.NoLabel = option.Name
+		case "abstain":
+			report.AbstainLabel = option.Name
+		}
+	}
+
+	for _, vc := range voteCounts {
+		switch stances[vc.CandidateID] {
+		case "yes":
+			report.Yes = vc.VoteCount
+		case "no":
+			report.No = vc.VoteCount
+		case "abstain":
+			report.Abstain = vc.VoteCount
+		}
+	}
+
+	rule := passThresholds[parsePassThreshold(contest.PassThreshold)]
+	report.Threshold = rule.label
+	report.Carried = rule.threshold.Carried(report.Yes, report.No)
+	if decided := report.Yes + report.No; decided > 0 {
+		report.YesShare = fmt.Sprintf("%.1f%%", float64(report.Yes)*100/float64(decided))
+	} else {
+		report.YesShare = "0%"
+	}
+
+	return report
+}
+
+func votingMethodLabel(method string) string {
+	switch method {
+	case "ranked":
+		return "Ranked choice (instant runoff)"
+	case "stv":
+		return "Single transferable vote"
+	case "approval":
+		return "Approval"
+	default:
+		return "Plurality"
+	}
+}
+
+func writeReportCSV(cw *csv.Writer, election *models.Election, report *models.ElectionReport) {
+	cw.Write([]string{"Election", election.Title})
+	cw.Write([]string{"Status", election.Status})
+	if election.ParentID != 0 {
+		cw.Write([]string{"Runoff of election", strconv.Itoa(election.ParentID)})
+	}
+	cw.Write([]string{"Voting method", votingMethodLabel(election.VotingMethod)})
+	cw.Write([]string{"Ties", tieBreakLabels[parseTieBreak(election.TieBreak)]})
+	cw.Write([]string{"Total tokens", strconv.Itoa(report.Stats.TotalTokens)})
+	cw.Write([]string{"Votes cast", strconv.Itoa(report.Stats.TotalVotes)})
+	if report.Stats.Weighted {
+		cw.Write([]string{"Votes held by tokens", strconv.Itoa(report.Stats.TotalWeight)})
+		cw.Write([]string{"Weighted votes cast", strconv.Itoa(report.Stats.WeightedVotes)})
+	}
+	cw.Write([]string{"Blank ballots", strconv.Itoa(report.Stats.BlankBallots)})
+	cw.Write([]string{"Ballot ledger entries", strconv.Itoa(report.LedgerBallots)})
+	cw.Write([]string{"Ballot ledger head", report.LedgerHead})
+	if sealed := report.Sealed; sealed != nil && !sealed.Opened {
+		cw.Write([]string{"Results", fmt.Sprintf("Sealed until %d of %d trustees decrypt the ballots", sealed.Threshold, sealed.Trustees)})
+	}
+	if validity := report.Validity; validity != nil {
+		cw.Write([]string{"Quorum", quorumSummary(election.Quorum)})
+		eligible := quorumBasisNoun(validity.Basis)
+		if validity.Basis == "tokens" && report.Stats.Weighted {
+			eligible = "votes held by " + eligible
+		}
+		cw.Write([]string{"Turnout", fmt.Sprintf("%.1f%% of %d %s", validity.Turnout, validity.Eligible, eligible)})
+		cw.Write([]string{"Result validity", validity.Status, validity.Reason})
+	}
+
+	for _, contest := range report.Contests {
+		cw.Write(nil)
+		writeContestCSV(cw, election, report.Stats.Weighted, &contest)
+	}
+}
+
+func writeContestCSV(cw *csv.Writer, election *models.Election, weighted bool, report *models.ContestReport) {
+	cw.Write([]string{"Contest", report.Contest.Title})
+	if report.Contest.Kind == "referendum" {
+		cw.Write([]string{"Type", "Referendum"})
+	} else {
+		cw.Write([]string{"Seats", strconv.Itoa(report.Contest.Seats)})
+	}
+	if weighted {
+		cw.Write([]string{"Weighted ballots", strconv.Itoa(report.TotalBallots)})
+	} else {
+		cw.Write([]string{"Ballots", strconv.Itoa(report.TotalBallots)})
+	}
+	cw.Write([]string{"Blank votes", strconv.Itoa(report.BlankVotes)})
+	cw.Write(nil)
+	if referendum := report.Referendum; referendum != nil {
+		cw.Write([]string{"Option", "Votes"})
+		cw.Write([]string{referendum.YesLabel, strconv.Itoa(referendum.Yes)})
+		cw.Write([]string{referendum.NoLabel, strconv.Itoa(referendum.No)})
+		if referendum.AbstainLabel != "" {
+			cw.Write([]string{referendum.AbstainLabel, strconv.Itoa(referendum.Abstain)})
+		}
+		cw.Write(nil)
+		cw.Write([]string{"Threshold", referendum.Threshold})
+		cw.Write([]string{"Yes share", referendum.YesShare})
+		result := "Not carried"
+		if referendum.Carried {
+			result = "Carried"
+		}
+		cw.Write([]string{"Result", result})
+		return
+	}
+
+	countLabel := "Votes"
+	switch election.VotingMethod {
+	case "ranked", "stv":
+		countLabel = "First preferences"
+	case "approval":
+		countLabel = "Approvals"
+	}
+	cw.Write([]string{"Candidate", countLabel, "Elected"})
+	for _, vc := range report.VoteCounts {
+		elected := ""
+		if vc.Elected {
+			elected = "yes"
+		}
+		cw.Write([]string{vc.CandidateName, strconv.Itoa(vc.VoteCount), elected})
+	}
+	if report.Tie != nil {
+		cw.Write([]string{"Tie", tieSummary(report.Tie)})
+	}
+
+	if runoff := report.Runoff; runoff != nil {
+		cw.Write(nil)
+		cw.Write([]string{"Instant-runoff count"})
+		header := []string{"Candidate"}
+		for _, round := range runoff.Rounds {
+			header = append(header, fmt.Sprintf("Round %d", round))
+		}
+		cw.Write(header)
+		for _, row := range runoff.Rows {
+			record := []string{row.CandidateName}
+			for i := range runoff.Rounds {
+				if i < len(row.Counts) {
+					record = append(record, strconv.Itoa(row.Counts[i]))
+				} else {
+					record = append(record, "")
+				}
+			}
+			cw.Write(record)
+		}
+		exhausted := []string{"Exhausted"}
+		for _, n := range runoff.Exhausted {
+			exhausted = append(exhausted, strconv.Itoa(n))
+		}
+		cw.Write(exhausted)
+		cw.Write([]string{"Winner", runoff.Winner})
+	}
+
+	if stv := report.STV; stv != nil {
+		cw.Write(nil)
+		cw.Write([]string{"STV count"})
+		cw.Write([]string{"Valid votes", stv.ValidVotes})
+		cw.Write([]string{"Droop quota", stv.Quota})
+		header := []string{"Candidate"}
+		actions := []string{"Action"}
+		for _, stage := range stv.Stages {
+			header = append(header, fmt.Sprintf("Stage %d transfer", stage.Number), fmt.Sprintf("Stage %d total", stage.Number))
+			actions = append(actions, stage.Action, "")
+		}
+		cw.Write(header)
+		cw.Write(actions)
+		for _, row := range stv.Rows {
+			record := []string{row.CandidateName}
+			for i := range stv.Stages {
+				record = append(record, row.Transfers[i], row.Totals[i])
+			}
+			cw.Write(record)
+		}
+		exhausted := []string{"Exhausted"}
+		for _, stage := range stv.Stages {
+			exhausted = append(exhausted, "", stage.Exhausted)
+		}
+		cw.Write(exhausted)
+		cw.Write(append([]string{"Elected"}, stv.Elected...))
+	}
+}
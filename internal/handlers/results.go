@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// errResultsNotPublished is returned for elections whose results are not on
+// the public results page; to the public they do not exist.
+var errResultsNotPublished = errors.New("results not published")
+
+// PublicResults shows the published results of a completed election.
+func (h *Handlers) PublicResults(w http.ResponseWriter, r *http.Request) {
+	results, err := h.getPublishedResults(mux.Vars(r)["id"])
+	if err != nil {
+		if err != errResultsNotPublished {
+			log.Printf("Error loading published results: %v", err)
+			http.Error(w, "Failed to load results", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	err = h.renderTemplate(w, "public_results.html", map[string]interface{}{"Results": results})
+	if err != nil {
+		log.Printf("Error executing public results template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// PublicResultsJSON serves the same results as PublicResults as JSON.
+func (h *Handlers) PublicResultsJSON(w http.ResponseWriter, r *http.Request) {
+	results, err := h.getPublishedResults(mux.Vars(r)["id"])
+	if err != nil {
+		if err != errResultsNotPublished {
+			log.Printf("Error loading published results: %v", err)
+			http.Error(w, "Failed to load results", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("Error writing published results: %v", err)
+	}
+}
+
+// PublishResults puts a completed election's results on its public results
+// page.
+func (h *Handlers) PublishResults(w http.ResponseWriter, r *http.Request) {
+	h.setResultsPublished(w, r, true)
+}
+
+// UnpublishResults takes an election's results off its public results page.
+func (h *Handlers) UnpublishResults(w http.ResponseWriter, r *http.Request) {
+	h.setResultsPublished(w, r, false)
+}
+
+func (h *Handlers) setResultsPublished(w http.ResponseWriter, r *http.Request, publish bool) {
+	user := middleware.GetUserFromContext(r.Context())
+	electionID := mux.Vars(r)["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	reportsURL := "/admin/admin/elections/" + strconv.Itoa(election.ID) + "/reports"
+	if election.Published == publish {
+		http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+		return
+	}
+
+	action, detail := "results_unpublished", "Results withdrawn from the public results page"
+	if publish {
+		if election.Status != "completed" {
+			http.Error(w, "Results can only be published once the election is completed", http.StatusBadRequest)
+			return
+		}
+		if election.Encrypted {
+			tally, err := h.getSealedTally(election.ID)
+			if err != nil {
+				log.Printf("Error loading sealed tally: %v", err)
+				http.Error(w, "Failed to publish results", http.StatusInternalServerError)
+				return
+			}
+			if !tally.Opened {
+				http.Error(w, "Results can only be published once the trustees have decrypted the ballots", http.StatusBadRequest)
+				return
+			}
+		}
+		action, detail = "results_published", "Results published on the public results page"
+	}
+
+	if err := h.audit(election.ID, user.ID, action, detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+		http.Error(w, "Failed to update the results page", http.StatusInternalServerError)
+		return
+	}
+
+	var publishedAt interface{}
+	if publish {
+		publishedAt = time.Now().UTC()
+	}
+	_, err = h.db.Exec(`UPDATE elections SET results_published_at = ? WHERE id = ?`, publishedAt, election.ID)
+	if err != nil {
+		log.Printf("Error updating results publication: %v", err)
+		http.Error(w, "Failed to update the results page", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+}
+
+// getPublishedResults builds the public view of an election's results. It
+// returns errResultsNotPublished unless the election is completed, an admin
+// has published its results and its ballots can be counted.
+func (h *Handlers) getPublishedResults(electionID string) (*models.PublishedResults, error) {
+	election, err := h.getElectionByID(electionID)
+	if err == sql.ErrNoRows {
+		return nil, errResultsNotPublished
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A completed election is past any results embargo; the check only
+	// guards against that ever changing.
+	if election.Status != "completed" || !election.Published || resultsEmbargoed(election, time.Now()) {
+		return nil, errResultsNotPublished
+	}
+
+	report, err := h.getElectionReport(election)
+	if err != nil {
+		return nil, err
+	}
+	if report.Sealed != nil && !report.Sealed.Opened {
+		return nil, errResultsNotPublished
+	}
+
+	results := &models.PublishedResults{
+		ElectionID:   election.ID,
+		Title:        election.Title,
+		Description:  election.Description,
+		VotingMethod: election.VotingMethod,
+		StartDate:    election.StartDate,
+		EndDate:      election.EndDate,
+		Turnout: models.Turnout{
+			Eligible:     report.Stats.TotalTokens,
+			Ballots:      report.Stats.TotalVotes,
+			BlankBallots: report.Stats.BlankBallots,
+			Percentage:   percentage(report.Stats.TotalVotes, report.Stats.TotalTokens),
+
+			Weighted:           report.Stats.Weighted,
+			EligibleVotes:      report.Stats.TotalWeight,
+			Votes:              report.Stats.WeightedVotes,
+			WeightedPercentage: percentage(report.Stats.WeightedVotes, report.Stats.TotalWeight),
+		},
+		Validity:      report.Validity,
+		LedgerBallots: report.LedgerBallots,
+		LedgerHead:    report.LedgerHead,
+	}
+
+	err = h.db.QueryRow(`SELECT results_published_at FROM elections WHERE id = ?`, election.ID).Scan(&results.PublishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if loc, err := time.LoadLocation(election.Timezone); err == nil {
+		results.PublishedAt = results.PublishedAt.In(loc)
+	}
+
+	for _, contest := range report.Contests {
+		results.Contests = append(results.Contests, publishedContest(election, contest))
+	}
+
+	return results, nil
+}
+
+// publishedContest reduces a contest report to its counts and winners.
+func publishedContest(election *models.Election, report models.ContestReport) models.PublishedContest {
+	contest := models.PublishedContest{
+		Title:      report.Contest.Title,
+		Kind:       report.Contest.Kind,
+		Seats:      report.Contest.Seats,
+		Counted:    "votes",
+		Ballots:    report.TotalBallots,
+		BlankVotes: report.BlankVotes,
+		Winners:    []string{},
+		Referendum: report.Referendum,
+		Tie:        report.Tie,
+	}
+
+	switch {
+	case report.Referendum != nil:
+	case report.STV != nil:
+		// In the order they were elected
+		contest.Counted = "first preferences"
+		contest.Winners = append(contest.Winners, report.STV.Elected...)
+	default:
+		switch {
+		case report.Runoff != nil:
+			contest.Counted = "first preferences"
+		case election.VotingMethod == "approval":
+			contest.Counted = "approvals"
+		}
+		for _, vc := range report.VoteCounts {
+			if vc.Elected {
+				contest.Winners = append(contest.Winners, vc.CandidateName)
+			}
+		}
+	}
+
+	for _, vc := range report.VoteCounts {
+		contest.Candidates = append(contest.Candidates, models.PublishedCount{
+			Name:       vc.CandidateName,
+			Votes:      vc.VoteCount,
+			Percentage: percentage(vc.VoteCount, report.TotalBallots),
+			Elected:    vc.Elected,
+		})
+	}
+
+	return contest
+}
+
+// percentage is part as a percentage of whole, rounded to one decimal place.
+func percentage(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(float64(part)*1000/float64(whole)) / 10
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// parseTokenExpiry reads an expiry entered on a token form. The
+// datetime-local value is a wall-clock time in the election's time zone and
+// is returned in UTC. An empty value means the tokens do not expire.
+func parseTokenExpiry(value string, election *models.Election) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(election.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	expires, err := time.ParseInLocation("2006-01-02T15:04", value, loc)
+	if err != nil {
+		return nil, errors.New("Invalid expiry date format")
+	}
+	if !expires.After(time.Now()) {
+		return nil, errors.New("The expiry must be in the future; revoke a token to stop it working now")
+	}
+	expires = expires.UTC()
+	return &expires, nil
+}
+
+// SetTokenExpiry sets when the chosen tokens stop working, or with no
+// expires_at lets them work until the election closes. Used and revoked
+// tokens are left as they are.
+func (h *Handlers) SetTokenExpiry(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	expires, err := parseTokenExpiry(r.FormValue("expires_at"), election)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to set the expiry", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var updated int64
+	for _, value := range r.Form["token_id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusBadRequest)
+			return
+		}
+		result, err := tx.Exec(
+			`UPDATE voting_tokens SET expires_at = ? WHERE id = ? AND election_id = ? AND is_used = FALSE AND revoked_at IS NULL`,
+			expires, id, election.ID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to set the expiry", http.StatusInternalServerError)
+			return
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, "Failed to set the expiry", http.StatusInternalServerError)
+			return
+		}
+		updated += n
+	}
+	if updated == 0 {
+		http.Error(w, "Select the unused tokens to set the expiry of", http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to set the expiry", http.StatusInternalServerError)
+		return
+	}
+
+	detail := fmt.Sprintf("Expiry of %d token(s) cleared", updated)
+	if expires != nil {
+		detail = fmt.Sprintf("%d token(s) set to expire at %s", updated, expires.Format("2006-01-02 15:04 MST"))
+	}
+	if err := h.audit(election.ID, user.ID, "token_expiry_set", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/admin/elections/%d/tokens", election.ID), http.StatusSeeOther)
+}
+
+// RevokeToken stops an unused token from working, such as one that leaked,
+// and records why.
+func (h *Handlers) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "Give a reason for revoking the token", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE voting_tokens SET revoked_at = ?, revoked_reason = ?
+		WHERE id = ? AND election_id = ? AND is_used = FALSE AND revoked_at IS NULL
+	`, time.Now().UTC().Truncate(time.Second), reason, vars["token_id"], election.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke the token", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "Only an unused token that has not been revoked can be revoked", http.StatusBadRequest)
+		return
+	}
+
+	var memberID sql.NullString
+	h.db.QueryRow(`SELECT member_id FROM voters WHERE token_id = ?`, vars["token_id"]).Scan(&memberID)
+	detail := fmt.Sprintf("Token %s revoked: %s", vars["token_id"], reason)
+	if memberID.Valid {
+		detail = fmt.Sprintf("Token %s of voter %s revoked: %s", vars["token_id"], memberID.String, reason)
+	}
+	if err := h.audit(election.ID, user.ID, "token_revoked", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/admin/elections/%d/tokens", election.ID), http.StatusSeeOther)
+}
+
+// ReissueToken replaces a lost token: in one transaction it revokes the
+// token with the reason given and issues a new one with the same weight,
+// which the voter holding the old one, if any, gets in its place. The new
+// token keeps the old one's expiry unless another is given, and the audit
+// entry is written in the same transaction. With a voter_id
+// in the path the voter's token is reissued, and the voter roll shown after.
+func (h *Handlers) ReissueToken(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+	if election.Status == "completed" {
+		http.Error(w, "The election has closed", http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "Give a reason for reissuing the token", http.StatusBadRequest)
+		return
+	}
+	expires, err := parseTokenExpiry(r.FormValue("expires_at"), election)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	tokenID := vars["token_id"]
+	returnTo := "tokens"
+	if voterID, ok := vars["voter_id"]; ok {
+		var id sql.NullInt64
+		err := tx.QueryRow(`SELECT token_id FROM voters WHERE id = ? AND election_id = ?`, voterID, election.ID).Scan(&id)
+		if err != nil || !id.Valid {
+			http.Error(w, "Voter not found or has no token", http.StatusNotFound)
+			return
+		}
+		tokenID = strconv.FormatInt(id.Int64, 10)
+		returnTo = "voters"
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var old models.VotingToken
+	err = scanTokenRecord(tx.QueryRow(tokenRecordQuery+` WHERE id = ? AND election_id = ?`, now, tokenID, election.ID), &old)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Token not found in this election", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case old.IsUsed:
+		http.Error(w, "This token has already been used to vote and cannot be reissued", http.StatusBadRequest)
+		return
+	case old.RevokedAt != nil:
+		http.Error(w, "This token has already been revoked", http.StatusBadRequest)
+		return
+	}
+	if expires == nil && !old.Expired {
+		expires = old.ExpiresAt
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO voting_tokens (election_id, token, weight, expires_at) VALUES (?, ?, ?, ?)`,
+		election.ID, h.newToken(), old.Weight, expires,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+	replacementID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(
+		`UPDATE voting_tokens SET revoked_at = ?, revoked_reason = ?, replaced_by = ? WHERE id = ?`,
+		now, reason, replacementID, old.ID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+
+	// The voter has not been given the new token yet
+	var memberID sql.NullString
+	tx.QueryRow(`SELECT member_id FROM voters WHERE token_id = ?`, old.ID).Scan(&memberID)
+	_, err = tx.Exec(`UPDATE voters SET token_id = ?, delivered_at = NULL WHERE token_id = ?`, replacementID, old.ID)
+	if err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+
+	// A token is not reissued without a record of it
+	detail := fmt.Sprintf("Token %d revoked and replaced by token %d: %s", old.ID, replacementID, reason)
+	if memberID.Valid {
+		detail = fmt.Sprintf("Token %d of voter %s revoked and replaced by token %d: %s", old.ID, memberID.String, replacementID, reason)
+	}
+	if err := auditTx(tx, election.ID, user.ID, "token_reissued", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reissue the token", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/admin/elections/%d/%s", election.ID, returnTo), http.StatusSeeOther)
+}
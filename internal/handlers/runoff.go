@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// runoffContest is one of a completed election's candidate contests as
+// offered on the runoff form.
+type runoffContest struct {
+	Contest   models.Contest
+	Finishers []models.Candidate // in finishing order, best first
+	Undecided bool               // no candidate won a majority, or the count ended in a tie
+
+	scores map[int]string // equal for candidates finishingOrder could not separate
+}
+
+// CreateRunoff creates a new draft election from a completed one, with each
+// chosen contest narrowed to its top candidates. It can also issue the
+// runoff one new token for every token of the original election, to be
+// handed to the same voters.
+func (h *Handlers) CreateRunoff(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+
+	election, err := h.getElectionByID(vars["id"])
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if election.Status != "completed" {
+		http.Error(w, "A runoff can only be created from a completed election", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.getElectionReport(election)
+	if err != nil {
+		log.Printf("Error building election report: %v", err)
+		http.Error(w, "Failed to count the election", http.StatusInternalServerError)
+		return
+	}
+	if report.Sealed != nil && !report.Sealed.Opened {
+		http.Error(w, "A runoff can only be created once the trustees have decrypted the ballots", http.StatusBadRequest)
+		return
+	}
+
+	var contests []runoffContest
+	for _, contestReport := range report.Contests {
+		if contestReport.Referendum != nil {
+			continue
+		}
+		contests = append(contests, runoffContest{
+			Contest:   contestReport.Contest,
+			Finishers: finishingOrder(contestReport),
+			Undecided: undecided(contestReport),
+			scores:    finishingScores(contestReport),
+		})
+	}
+
+	var tokens int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM voting_tokens WHERE election_id = ? AND revoked_at IS NULL`, election.ID).Scan(&tokens); err != nil {
+		log.Printf("Error counting tokens: %v", err)
+		http.Error(w, "Failed to load election", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"User":     user,
+		"Election": election,
+		"Contests": contests,
+		"Tokens":   tokens,
+	}
+	render := func(errMsg string) {
+		data["Error"] = errMsg
+		if err := h.renderSuperAdminTemplate(w, "create_runoff.html", data); err != nil {
+			log.Printf("Error executing create runoff template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}
+
+	if r.Method == "GET" {
+		render("")
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		render("Title is required")
+		return
+	}
+
+	start, end, timezone, err := parseElectionWindow(r.FormValue("start_date"), r.FormValue("end_date"), r.FormValue("timezone"))
+	if err != nil {
+		render(err.Error())
+		return
+	}
+
+	top, err := strconv.Atoi(r.FormValue("top"))
+	if err != nil || top < 2 {
+		render("A runoff needs at least the top 2 candidates")
+		return
+	}
+
+	chosen := make(map[string]bool)
+	for _, id := range r.Form["contest_id"] {
+		chosen[id] = true
+	}
+	var plans []runoffContest
+	for _, contest := range contests {
+		if !chosen[strconv.Itoa(contest.Contest.ID)] {
+			continue
+		}
+		contest.Finishers = topFinishers(contest, top)
+		if len(contest.Finishers) <= contest.Contest.Seats {
+			render(fmt.Sprintf("%s would have no more candidates than seats", contest.Contest.Title))
+			return
+		}
+		plans = append(plans, contest)
+	}
+	if len(plans) == 0 {
+		render("Choose at least one contest for the runoff")
+		return
+	}
+
+	reissue := r.FormValue("reissue_tokens") == "on"
+	runoffID, err := h.createRunoff(election, title, r.FormValue("description"), start, end, timezone, plans, reissue, user.ID)
+	if err != nil {
+		log.Printf("Error creating runoff: %v", err)
+		render("Failed to create runoff")
+		return
+	}
+
+	detail := fmt.Sprintf("Runoff #%d created with the top %d candidates of %d contest(s)", runoffID, top, len(plans))
+	if reissue {
+		detail += fmt.Sprintf(" and %d new token(s)", tokens)
+	}
+	if err := h.audit(election.ID, user.ID, "runoff_created", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	if reissue {
+		http.Redirect(w, r, fmt.Sprintf("/admin/admin/elections/%d/tokens", runoffID), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin/superadmin/elections", http.StatusSeeOther)
+}
+
+// createRunoff stores the runoff election with its contests and candidates,
+// hands it to the original election's admins and, if asked, issues it as
+// many tokens as the original election had.
+func (h *Handlers) createRunoff(parent *models.Election, title, description string, start, end time.Time, timezone string, contests []runoffContest, reissueTokens bool, createdBy int) (int64, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO elections (title, description, start_date, end_date, timezone, auto_status, voting_method, tie_break,
+			quorum_percent, quorum_basis, registered_voters, min_winning_share, encrypted, results_embargo, parent_election_id, created_by)
+		VALUES (?, ?, ?, ?, ?, TRUE, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		title, description, start, end, timezone, parent.VotingMethod, parent.TieBreak,
+		parent.Quorum.Percent, parent.Quorum.Basis, parent.Quorum.RegisteredVoters, parent.Quorum.MinWinningShare,
+		parent.Encrypted, parent.ResultsEmbargo, parent.ID, createdBy,
+	)
+	if err != nil {
+		return 0, err
+	}
+	runoffID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, contest := range contests {
+		maxSelections := contest.Contest.MaxSelections
+		if maxSelections > len(contest.Finishers) {
+			maxSelections = len(contest.Finishers)
+		}
+		result, err := tx.Exec(
+			`INSERT INTO contests (election_id, title, description, seats, max_selections, order_num) VALUES (?, ?, ?, ?, ?, ?)`,
+			runoffID, contest.Contest.Title, contest.Contest.Description, contest.Contest.Seats, maxSelections, contest.Contest.Order,
+		)
+		if err != nil {
+			return 0, err
+		}
+		contestID, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+
+		for i, candidate := range contest.Finishers {
+			_, err = tx.Exec(
+				`INSERT INTO candidates (election_id, contest_id, name, description, photo_url, order_num) VALUES (?, ?, ?, ?, ?, ?)`,
+				runoffID, contestID, candidate.Name, candidate.Description, candidate.PhotoURL, i,
+			)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO election_admins (election_id, user_id) SELECT ?, user_id FROM election_admins WHERE election_id = ?`,
+		runoffID, parent.ID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if reissueTokens {
+		if err := h.reissueRunoffTokens(tx, parent.ID, runoffID); err != nil {
+			return 0, err
+		}
+	}
+
+	return runoffID, tx.Commit()
+}
+
+// reissueRunoffTokens gives the runoff a new token for each unrevoked token
+// of the original election, with the same weight. Voters on the original roll are
+// put on the runoff's roll with their new token.
+func (h *Handlers) reissueRunoffTokens(tx *sql.Tx, parentID int, runoffID int64) error {
+	type issued struct {
+		weight  int
+		voterID sql.NullInt64
+	}
+
+	rows, err := tx.Query(`
+		SELECT t.weight, v.id
+		FROM voting_tokens t LEFT JOIN voters v ON v.token_id = t.id
+		WHERE t.election_id = ? AND t.revoked_at IS NULL
+		ORDER BY t.id
+	`, parentID)
+	if err != nil {
+		return err
+	}
+	var tokens []issued
+	for rows.Next() {
+		var token issued
+		if err := rows.Scan(&token.weight, &token.voterID); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		result, err := tx.Exec(
+			`INSERT INTO voting_tokens (election_id, token, weight) VALUES (?, ?, ?)`,
+			runoffID, h.newToken(), token.weight,
+		)
+		if err != nil {
+			return err
+		}
+		if !token.voterID.Valid {
+			continue
+		}
+		tokenID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO voters (election_id, member_id, name, email, group_name, token_id)
+			SELECT ?, member_id, name, email, group_name, ? FROM voters WHERE id = ?
+		`, runoffID, tokenID, token.voterID.Int64)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRunoffs lists the runoffs created from an election.
+func (h *Handlers) getRunoffs(electionID int) ([]models.Election, error) {
+	rows, err := h.db.Query(`SELECT `+electionColumns+` FROM elections WHERE parent_election_id = ? ORDER BY id`, electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runoffs []models.Election
+	for rows.Next() {
+		var election models.Election
+		if err := scanElection(rows, &election); err != nil {
+			return nil, err
+		}
+		runoffs = append(runoffs, election)
+	}
+	return runoffs, rows.Err()
+}
+
+// finishingOrder lists a contest's candidates from best placed to worst: by
+// how long they lasted in an instant-runoff count, otherwise by votes.
+func finishingOrder(report models.ContestReport) []models.Candidate {
+	byID := make(map[int]models.Candidate, len(report.Contest.Candidates))
+	for _, candidate := range report.Contest.Candidates {
+		byID[candidate.ID] = candidate
+	}
+
+	var order []models.Candidate
+	if report.Runoff != nil {
+		for _, row := range report.Runoff.Rows {
+			order = append(order, byID[row.CandidateID])
+		}
+		return order
+	}
+	for _, vc := range report.VoteCounts {
+		order = append(order, byID[vc.CandidateID])
+	}
+	return order
+}
+
+// topFinishers keeps a contest's first n finishers, along with any tied with
+// the last of them, so that a runoff never drops one of two equal candidates.
+func topFinishers(contest runoffContest, n int) []models.Candidate {
+	finishers := contest.Finishers
+	if n >= len(finishers) {
+		return finishers
+	}
+
+	cut := n
+	for cut < len(finishers) && contest.scores[finishers[cut].ID] == contest.scores[finishers[n-1].ID] {
+		cut++
+	}
+	return finishers[:cut]
+}
+
+// finishingScores gives each candidate a score that is equal for two
+// candidates exactly when finishingOrder could not separate them.
+func finishingScores(report models.ContestReport) map[int]string {
+	scores := make(map[int]string)
+	if report.Runoff != nil {
+		for _, row := range report.Runoff.Rows {
+			last := 0
+			if len(row.Counts) > 0 {
+				last = row.Counts[len(row.Counts)-1]
+			}
+			scores[row.CandidateID] = fmt.Sprintf("%d/%d", len(row.Counts), last)
+		}
+		return scores
+	}
+	for _, vc := range report.VoteCounts {
+		scores[vc.CandidateID] = strconv.Itoa(vc.VoteCount)
+	}
+	return scores
+}
+
+// undecided reports whether a contest is a candidate for a runoff: it ended
+// in a tie, or a single-seat plurality or approval winner fell short of a
+// majority of the ballots that chose someone.
+func undecided(report models.ContestReport) bool {
+	if report.Tie != nil {
+		return true
+	}
+	switch {
+	case report.Runoff != nil:
+		return report.Runoff.WinnerID == 0
+	case report.STV != nil:
+		return false
+	}
+	if report.Contest.Seats != 1 || len(report.VoteCounts) == 0 {
+		return false
+	}
+	counted := report.TotalBallots - report.BlankVotes
+	return counted > 0 && report.VoteCounts[0].VoteCount*2 <= counted
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/qr"
+
+	"github.com/gorilla/mux"
+)
+
+// printBatch is one print run of token slips.
+type printBatch struct {
+	Number    int
+	Slips     int
+	PrintedAt time.Time
+}
+
+// tokenSlip is a token laid out as a cut-out slip.
+type tokenSlip struct {
+	Token   string
+	Weight  int
+	Serial  int
+	Void    string // why the token can no longer vote, if it cannot
+	Expires *time.Time
+	URL     string
+	QR      template.HTML // the URL as an SVG QR code
+}
+
+// PrintTokens marks the chosen unused tokens as printed, numbering them as a
+// new batch, and opens the batch's slips for printing. Tokens printed before
+// move to the new batch, so a lost or spoiled sheet can be printed again.
+func (h *Handlers) PrintTokens(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+	var tokenIDs []int
+	for _, value := range r.Form["token_id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusBadRequest)
+			return
+		}
+		tokenIDs = append(tokenIDs, id)
+	}
+	if len(tokenIDs) == 0 {
+		http.Error(w, "Select the tokens to print", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var batch int
+	err = tx.QueryRow(
+		`SELECT COALESCE(MAX(print_batch), 0) + 1 FROM voting_tokens WHERE election_id = ?`, election.ID,
+	).Scan(&batch)
+	if err != nil {
+		http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+		return
+	}
+
+	// Number the slips in the order the tokens were issued
+	rows, err := tx.Query(`
+		SELECT id, is_used OR revoked_at IS NOT NULL OR COALESCE(expires_at <= ?, FALSE)
+		FROM voting_tokens WHERE election_id = ? ORDER BY id
+	`, time.Now().UTC().Truncate(time.Second), election.ID)
+	if err != nil {
+		http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+		return
+	}
+	chosen := make(map[int]bool, len(tokenIDs))
+	for _, id := range tokenIDs {
+		chosen[id] = true
+	}
+	var printing []int
+	for rows.Next() {
+		var id int
+		var void bool
+		if err := rows.Scan(&id, &void); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+			return
+		}
+		if chosen[id] {
+			if void {
+				rows.Close()
+				http.Error(w, "Only tokens that can still vote can be printed", http.StatusBadRequest)
+				return
+			}
+			printing = append(printing, id)
+			delete(chosen, id)
+		}
+	}
+	rows.Close()
+	if len(chosen) > 0 {
+		http.Error(w, "Token not found in this election", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	for i, id := range printing {
+		_, err := tx.Exec(
+			`UPDATE voting_tokens SET print_batch = ?, print_serial = ?, printed_at = ? WHERE id = ?`,
+			batch, i+1, now, id,
+		)
+		if err != nil {
+			http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to print tokens", http.StatusInternalServerError)
+		return
+	}
+
+	detail := fmt.Sprintf("Batch %d: %d token slip(s) printed", batch, len(printing))
+	if err := h.audit(election.ID, user.ID, "tokens_printed", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/admin/elections/%d/tokens/batches/%d", election.ID, batch), http.StatusSeeOther)
+}
+
+// TokenSlips shows a batch of token slips laid out for printing on A4, each
+// with a QR code of the link that opens the voter's ballot.
+func (h *Handlers) TokenSlips(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	batch, err := strconv.Atoi(vars["batch"])
+	if err != nil {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT token, weight, print_serial,
+			CASE
+				WHEN is_used THEN 'Already used'
+				WHEN revoked_at IS NOT NULL THEN 'Revoked'
+				WHEN expires_at <= ? THEN 'Expired'
+				ELSE ''
+			END,
+			expires_at
+		FROM voting_tokens
+		WHERE election_id = ? AND print_batch = ?
+		ORDER BY print_serial
+	`, time.Now().UTC().Truncate(time.Second), election.ID, batch)
+	if err != nil {
+		http.Error(w, "Failed to load tokens", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var slips []tokenSlip
+	for rows.Next() {
+		var slip tokenSlip
+		if err := rows.Scan(&slip.Token, &slip.Weight, &slip.Serial, &slip.Void, &slip.Expires); err != nil {
+			http.Error(w, "Failed to load tokens", http.StatusInternalServerError)
+			return
+		}
+		slip.URL = h.baseURL + "/vote?token=" + url.QueryEscape(slip.Token)
+		code, err := qr.Encode(slip.URL)
+		if err != nil {
+			log.Printf("Error encoding QR code: %v", err)
+			http.Error(w, "The voting link is too long for a QR code; shorten BASE_URL", http.StatusInternalServerError)
+			return
+		}
+		slip.QR = template.HTML(code.SVG())
+		slips = append(slips, slip)
+	}
+	if len(slips) == 0 {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	if loc, err := time.LoadLocation(election.Timezone); err == nil {
+		election.EndDate = election.EndDate.In(loc)
+		for i := range slips {
+			if slips[i].Expires != nil {
+				expires := slips[i].Expires.In(loc)
+				slips[i].Expires = &expires
+			}
+		}
+	}
+
+	err = h.renderAdminTemplate(w, "token_slips.html", map[string]interface{}{
+		"User":     user,
+		"Election": election,
+		"Batch":    batch,
+		"Slips":    slips,
+		"VoteURL":  h.baseURL + "/vote",
+	})
+	if err != nil {
+		log.Printf("Error executing token slips template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// getPrintBatches lists an election's print runs, latest first. A batch
+// counts the slips still in it, not those printed again since. Every slip of
+// a batch has the same printed_at.
+func (h *Handlers) getPrintBatches(electionID int) ([]printBatch, error) {
+	rows, err := h.db.Query(`
+		SELECT print_batch, COUNT(*), printed_at
+		FROM voting_tokens
+		WHERE election_id = ? AND print_batch IS NOT NULL
+		GROUP BY print_batch
+		ORDER BY print_batch DESC
+	`, electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []printBatch
+	for rows.Next() {
+		var batch printBatch
+		if err := rows.Scan(&batch.Number, &batch.Slips, &batch.PrintedAt); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
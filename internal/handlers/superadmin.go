@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"evoting-app/internal/middleware"
@@ -33,6 +35,7 @@ func (h *Handlers) renderSuperAdminTemplate(w http.ResponseWriter, templateName
 			}
 			return b
 		},
+		"percent": percentage,
 	}
 
 	tmpl, err := template.New("").Funcs(funcMap).ParseFiles(
@@ -111,31 +114,41 @@ func (h *Handlers) CreateElection(w http.ResponseWriter, r *http.Request) {
 	startDate := r.FormValue("start_date")
 	endDate := r.FormValue("end_date")
 
-	// Parse dates
-	start, err := time.Parse("2006-01-02T15:04", startDate)
+	votingMethod := parseVotingMethod(r.FormValue("voting_method"))
+	encrypted := r.FormValue("encrypted") == "on"
+	resultsEmbargo := r.FormValue("results_embargo") == "on"
+	tieBreak := parseTieBreak(r.FormValue("tie_break"))
+
+	seats, maxSelections, err := parseContestLimits(r, votingMethod)
 	if err != nil {
 		h.renderSuperAdminTemplate(w, "create_election.html", map[string]interface{}{
 			"User":  user,
-			"Error": "Invalid start date format",
+			"Error": err.Error(),
 		})
 		return
 	}
 
-	end, err := time.Parse("2006-01-02T15:04", endDate)
+	start, end, timezone, err := parseElectionWindow(startDate, endDate, r.FormValue("timezone"))
 	if err != nil {
 		h.renderSuperAdminTemplate(w, "create_election.html", map[string]interface{}{
 			"User":  user,
-			"Error": "Invalid end date format",
+			"Error": err.Error(),
 		})
 		return
 	}
 
-	// Create election
-	_, err = h.db.Exec(
-		`INSERT INTO elections (title, description, start_date, end_date, created_by) VALUES (?, ?, ?, ?, ?)`,
-		title, description, start, end, user.ID,
-	)
+	quorum, err := parseQuorumRule(r)
+	if err != nil {
+		h.renderSuperAdminTemplate(w, "create_election.html", map[string]interface{}{
+			"User":  user,
+			"Error": err.Error(),
+		})
+		return
+	}
 
+	// Create election along with its first contest, which takes the
+	// election's title until more contests are added.
+	err = h.createElection(title, description, start, end, timezone, votingMethod, tieBreak, quorum, encrypted, resultsEmbargo, seats, maxSelections, user.ID)
 	if err != nil {
 		h.renderSuperAdminTemplate(w, "create_election.html", map[string]interface{}{
 			"User":  user,
@@ -158,10 +171,16 @@ func (h *Handlers) EditElection(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Election not found", http.StatusNotFound)
 			return
 		}
+		cast, err := h.ballotsCast(electionID)
+		if err != nil {
+			http.Error(w, "Failed to load election", http.StatusInternalServerError)
+			return
+		}
 
 		err = h.renderSuperAdminTemplate(w, "edit_election.html", map[string]interface{}{
-			"User":     user,
-			"Election": election,
+			"User":        user,
+			"Election":    election,
+			"BallotsCast": cast,
 		})
 		if err != nil {
 			log.Printf("Error executing edit election template: %v", err)
@@ -177,22 +196,54 @@ func (h *Handlers) EditElection(w http.ResponseWriter, r *http.Request) {
 	startDate := r.FormValue("start_date")
 	endDate := r.FormValue("end_date")
 	status := r.FormValue("status")
+	autoStatus := r.FormValue("auto_status") == "on"
+	resultsEmbargo := r.FormValue("results_embargo") == "on"
+	votingMethod := parseVotingMethod(r.FormValue("voting_method"))
+	tieBreak := parseTieBreak(r.FormValue("tie_break"))
+
+	start, end, timezone, err := parseElectionWindow(startDate, endDate, r.FormValue("timezone"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	start, err := time.Parse("2006-01-02T15:04", startDate)
+	quorum, err := parseQuorumRule(r)
 	if err != nil {
-		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	end, err := time.Parse("2006-01-02T15:04", endDate)
+	election, err := h.getElectionByID(electionID)
 	if err != nil {
-		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		http.Error(w, "Election not found", http.StatusNotFound)
 		return
 	}
 
+	// The ballots cast so far were filled in for the election's method, and
+	// would be miscounted under another one.
+	cast, err := h.ballotsCast(electionID)
+	if err != nil {
+		http.Error(w, "Failed to update election", http.StatusInternalServerError)
+		return
+	}
+	if cast {
+		if r.FormValue("voting_method") != "" && votingMethod != election.VotingMethod {
+			http.Error(w, "The voting method cannot be changed once ballots have been cast", http.StatusBadRequest)
+			return
+		}
+		votingMethod = election.VotingMethod
+	}
+
+	// An explicit status change is a manual override: the scheduler would
+	// otherwise put the election straight back where the dates say it belongs.
+	if status != election.Status {
+		autoStatus = false
+	}
+
 	_, err = h.db.Exec(
-		`UPDATE elections SET title = ?, description = ?, start_date = ?, end_date = ?, status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
-		title, description, start, end, status, electionID,
+		`UPDATE elections SET title = ?, description = ?, start_date = ?, end_date = ?, timezone = ?, status = ?, auto_status = ?, voting_method = ?, tie_break = ?, quorum_percent = ?, quorum_basis = ?, registered_voters = ?, min_winning_share = ?, results_embargo = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		title, description, start, end, timezone, status, autoStatus, votingMethod, tieBreak,
+		quorum.Percent, quorum.Basis, quorum.RegisteredVoters, quorum.MinWinningShare, resultsEmbargo, electionID,
 	)
 
 	if err != nil {
@@ -350,7 +401,7 @@ func (h *Handlers) getSuperAdminStats() map[string]int {
 	h.db.QueryRow("SELECT COUNT(*) FROM elections").Scan(&totalElections)
 	h.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&totalAdmins)
 	h.db.QueryRow("SELECT COUNT(*) FROM elections WHERE status = 'active'").Scan(&activeElections)
-	h.db.QueryRow("SELECT COUNT(*) FROM votes").Scan(&totalVotes)
+	h.db.QueryRow("SELECT COUNT(DISTINCT ballot_id) FROM votes").Scan(&totalVotes)
 
 	stats["total_elections"] = totalElections
 	stats["total_admins"] = totalAdmins
@@ -361,7 +412,7 @@ func (h *Handlers) getSuperAdminStats() map[string]int {
 }
 
 func (h *Handlers) getAllElections() ([]models.Election, error) {
-	query := `SELECT id, title, description, start_date, end_date, status, created_at FROM elections ORDER BY created_at DESC`
+	query := `SELECT ` + electionColumns + ` FROM elections ORDER BY created_at DESC`
 	rows, err := h.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -371,10 +422,7 @@ func (h *Handlers) getAllElections() ([]models.Election, error) {
 	var elections []models.Election
 	for rows.Next() {
 		var election models.Election
-		err := rows.Scan(
-			&election.ID, &election.Title, &election.Description,
-			&election.StartDate, &election.EndDate, &election.Status, &election.CreatedAt,
-		)
+		err := scanElection(rows, &election)
 		if err != nil {
 			return nil, err
 		}
@@ -384,18 +432,140 @@ func (h *Handlers) getAllElections() ([]models.Election, error) {
 	return elections, nil
 }
 
-func (h *Handlers) getElectionByID(id string) (*models.Election, error) {
-	election := &models.Election{}
-	query := `SELECT id, title, description, start_date, end_date, status, created_at FROM elections WHERE id = ?`
+func (h *Handlers) createElection(title, description string, start, end time.Time, timezone, votingMethod, tieBreak string, quorum models.QuorumRule, encrypted, resultsEmbargo bool, seats, maxSelections, createdBy int) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO elections (title, description, start_date, end_date, timezone, auto_status, voting_method, tie_break, quorum_percent, quorum_basis, registered_voters, min_winning_share, encrypted, results_embargo, created_by) VALUES (?, ?, ?, ?, ?, TRUE, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		title, description, start, end, timezone, votingMethod, tieBreak,
+		quorum.Percent, quorum.Basis, quorum.RegisteredVoters, quorum.MinWinningShare, encrypted, resultsEmbargo, createdBy,
+	)
+	if err != nil {
+		return err
+	}
+
+	electionID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO contests (election_id, title, seats, max_selections) VALUES (?, ?, ?, ?)`,
+		electionID, title, seats, maxSelections,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// electionColumns lists the columns read by scanElection, in order.
+const electionColumns = `id, title, description, start_date, end_date, timezone, status, auto_status, voting_method, encrypted, results_embargo, results_published_at IS NOT NULL, tie_break, COALESCE(parent_election_id, 0), quorum_percent, quorum_basis, registered_voters, min_winning_share, created_at`
 
-	err := h.db.QueryRow(query, id).Scan(
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanElection reads an election row and presents its voting window in the
+// election's own time zone.
+func scanElection(row rowScanner, election *models.Election) error {
+	err := row.Scan(
 		&election.ID, &election.Title, &election.Description,
-		&election.StartDate, &election.EndDate, &election.Status, &election.CreatedAt,
+		&election.StartDate, &election.EndDate, &election.Timezone, &election.Status,
+		&election.AutoStatus, &election.VotingMethod, &election.Encrypted,
+		&election.ResultsEmbargo, &election.Published, &election.TieBreak,
+		&election.ParentID, &election.Quorum.Percent, &election.Quorum.Basis,
+		&election.Quorum.RegisteredVoters, &election.Quorum.MinWinningShare, &election.CreatedAt,
 	)
+	if err != nil {
+		return err
+	}
+
+	if loc, err := time.LoadLocation(election.Timezone); err == nil {
+		election.StartDate = election.StartDate.In(loc)
+		election.EndDate = election.EndDate.In(loc)
+	}
+
+	return nil
+}
+
+func (h *Handlers) getElectionByID(id string) (*models.Election, error) {
+	election := &models.Election{}
+	query := `SELECT ` + electionColumns + ` FROM elections WHERE id = ?`
+
+	err := scanElection(h.db.QueryRow(query, id), election)
 
 	return election, err
 }
 
+// parseVotingMethod maps the submitted voting method to a supported one,
+// falling back to plurality.
+func parseVotingMethod(method string) string {
+	switch method {
+	case "ranked", "stv", "approval":
+		return method
+	default:
+		return "plurality"
+	}
+}
+
+// parseElectionWindow reads the voting window entered on an election form.
+// The datetime-local values are wall-clock times in the given IANA time
+// zone and are returned in UTC.
+func parseElectionWindow(startDate, endDate, timezone string) (start, end time.Time, zone string, err error) {
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return start, end, "", errors.New("Unknown time zone " + timezone)
+	}
+
+	start, err = time.ParseInLocation("2006-01-02T15:04", startDate, loc)
+	if err != nil {
+		return start, end, "", errors.New("Invalid start date format")
+	}
+
+	end, err = time.ParseInLocation("2006-01-02T15:04", endDate, loc)
+	if err != nil {
+		return start, end, "", errors.New("Invalid end date format")
+	}
+
+	if !end.After(start) {
+		return start, end, "", errors.New("End date must be after the start date")
+	}
+
+	return start.UTC(), end.UTC(), loc.String(), nil
+}
+
+// parseContestLimits reads the number of seats and the ballot selection limit
+// from a contest form, keeping them consistent with the voting method.
+func parseContestLimits(r *http.Request, method string) (seats int, maxSelections int, err error) {
+	seats, err = strconv.Atoi(r.FormValue("seats"))
+	if err != nil || seats < 1 {
+		return 0, 0, errors.New("Number of seats must be at least 1")
+	}
+
+	maxSelections, err = strconv.Atoi(r.FormValue("max_selections"))
+	if err != nil || maxSelections < 1 {
+		return 0, 0, errors.New("Maximum selections must be at least 1")
+	}
+
+	switch method {
+	case "plurality":
+		maxSelections = 1
+	case "ranked":
+		seats = 1
+	}
+
+	return seats, maxSelections, nil
+}
+
 func (h *Handlers) getAllAdmins() ([]models.User, error) {
 	query := `SELECT id, username, role, created_at FROM users WHERE role = 'admin' ORDER BY username`
 	rows, err := h.db.Query(query)
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+	"evoting-app/internal/tally"
+
+	"github.com/gorilla/mux"
+)
+
+// tieBreakLabels names the ways a tie for a winning place can be settled.
+var tieBreakLabels = map[string]string{
+	"unresolved": "Left unresolved",
+	"runoff":     "Decided by a runoff",
+	"lot":        "Decided by drawing lots",
+}
+
+// parseTieBreak maps the submitted tie-break rule to a supported one,
+// falling back to leaving ties unresolved.
+func parseTieBreak(rule string) string {
+	if _, ok := tieBreakLabels[rule]; ok {
+		return rule
+	}
+	return "unresolved"
+}
+
+// electSeats marks the candidates with the most votes as elected, up to the
+// contest's seats. Candidates tied for the last seats are only elected if a
+// recorded lot drawing picked them; the tie is returned either way.
+// voteCounts must be ordered by votes, most first.
+func (h *Handlers) electSeats(election *models.Election, contest models.Contest, voteCounts []models.VoteCount) (*models.TieReport, error) {
+	seats := contest.Seats
+	if seats > len(voteCounts) {
+		seats = len(voteCounts)
+	}
+	if seats == 0 {
+		return nil, nil
+	}
+
+	// A tie matters only where it straddles the last seat.
+	last := voteCounts[seats-1].VoteCount
+	if last == 0 || seats == len(voteCounts) || voteCounts[seats].VoteCount != last {
+		for i := 0; i < seats; i++ {
+			voteCounts[i].Elected = voteCounts[i].VoteCount > 0
+		}
+		return nil, nil
+	}
+
+	var tied []models.Candidate
+	open := seats
+	for i := range voteCounts {
+		switch {
+		case voteCounts[i].VoteCount > last:
+			voteCounts[i].Elected = true
+			open--
+		case voteCounts[i].VoteCount == last:
+			tied = append(tied, models.Candidate{ID: voteCounts[i].CandidateID, Name: voteCounts[i].CandidateName})
+		}
+	}
+
+	tie, err := h.getTieReport(election, contest, tied, open)
+	if err != nil || tie.Draw == nil {
+		return tie, err
+	}
+	winners := make(map[int]bool, open)
+	for _, id := range tally.DrawLots(tie.Draw.Seed, tie.CandidateIDs)[:open] {
+		winners[id] = true
+	}
+	for i := range voteCounts {
+		if winners[voteCounts[i].CandidateID] {
+			voteCounts[i].Elected = true
+		}
+	}
+	return tie, nil
+}
+
+// runoffTie reports the tie an instant-runoff count ended in, if any.
+func (h *Handlers) runoffTie(election *models.Election, contest models.Contest, runoff *models.RunoffReport) (*models.TieReport, error) {
+	if len(runoff.TiedIDs) == 0 {
+		return nil, nil
+	}
+
+	ids := make(map[int]bool, len(runoff.TiedIDs))
+	for _, id := range runoff.TiedIDs {
+		ids[id] = true
+	}
+	var tied []models.Candidate
+	for _, candidate := range contest.Candidates {
+		if ids[candidate.ID] {
+			tied = append(tied, candidate)
+		}
+	}
+
+	return h.getTieReport(election, contest, tied, 1)
+}
+
+// stvTie reports the first tie an STV count could only break by the order
+// of the candidates, if any. The places that go ahead are the candidates
+// kept in the count, or the one whose surplus is transferred first.
+func (h *Handlers) stvTie(election *models.Election, contest models.Contest, result tally.STVResult) (*models.TieReport, error) {
+	if result.Tie == nil {
+		return nil, nil
+	}
+
+	ids := make(map[int]bool, len(result.Tie.Candidates))
+	for _, id := range result.Tie.Candidates {
+		ids[id] = true
+	}
+	var tied []models.Candidate
+	for _, candidate := range contest.Candidates {
+		if ids[candidate.ID] {
+			tied = append(tied, candidate)
+		}
+	}
+
+	places := 1
+	if result.Tie.Action == "exclusion" {
+		places = len(tied) - 1
+	}
+	tie, err := h.getTieReport(election, contest, tied, places)
+	if err != nil {
+		return nil, err
+	}
+	tie.Stage = result.Tie.Stage + 1
+	tie.Action = result.Tie.Action
+	return tie, nil
+}
+
+// getTieReport describes a tie between the given candidates for seats
+// places, with the lot drawn to settle it when the election draws lots and
+// a draw for exactly these candidates has been recorded.
+func (h *Handlers) getTieReport(election *models.Election, contest models.Contest, tied []models.Candidate, seats int) (*models.TieReport, error) {
+	sort.Slice(tied, func(i, j int) bool { return tied[i].ID < tied[j].ID })
+
+	tie := &models.TieReport{Seats: seats, Rule: parseTieBreak(election.TieBreak)}
+	names := make(map[int]string, len(tied))
+	for _, candidate := range tied {
+		tie.CandidateIDs = append(tie.CandidateIDs, candidate.ID)
+		tie.Candidates = append(tie.Candidates, candidate.Name)
+		names[candidate.ID] = candidate.Name
+	}
+	if tie.Rule != "lot" {
+		return tie, nil
+	}
+
+	draw := &models.TieDraw{}
+	var candidates string
+	var drawnBy sql.NullString
+	err := h.db.QueryRow(`
+		SELECT d.candidates, d.seed, u.username, d.drawn_at
+		FROM tie_draws d LEFT JOIN users u ON u.id = d.drawn_by
+		WHERE d.contest_id = ?
+	`, contest.ID).Scan(&candidates, &draw.Seed, &drawnBy, &draw.DrawnAt)
+	if err == sql.ErrNoRows {
+		return tie, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A draw made for a different set of tied candidates no longer applies.
+	if candidates != joinIDs(tie.CandidateIDs) {
+		return tie, nil
+	}
+
+	draw.DrawnBy = drawnBy.String
+	for i, id := range tally.DrawLots(draw.Seed, tie.CandidateIDs) {
+		draw.Order = append(draw.Order, names[id])
+		if i < seats {
+			draw.Winners = append(draw.Winners, names[id])
+			draw.WinnerIDs = append(draw.WinnerIDs, id)
+		}
+	}
+	tie.Draw = draw
+	return tie, nil
+}
+
+// DrawTieLots draws lots to settle a contest's tie, for elections whose
+// tie-break rule is drawing lots. The seed is always random and made only
+// once the tie is known. An admin may add to it, such as the result of a
+// public dice roll, but since an admin also knows the tied candidates by
+// then, what they add cannot choose the outcome on its own.
+func (h *Handlers) DrawTieLots(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	var contest *models.Contest
+	contests, err := h.getBallotContests(electionID)
+	if err != nil {
+		log.Printf("Error loading contests: %v", err)
+		http.Error(w, "Failed to load contest", http.StatusInternalServerError)
+		return
+	}
+	for i := range contests {
+		if strconv.Itoa(contests[i].ID) == vars["contest_id"] {
+			contest = &contests[i]
+		}
+	}
+	if contest == nil {
+		http.Error(w, "Contest not found", http.StatusNotFound)
+		return
+	}
+
+	if election.Status != "completed" {
+		http.Error(w, "Lots can only be drawn once the election is completed", http.StatusBadRequest)
+		return
+	}
+	if parseTieBreak(election.TieBreak) != "lot" {
+		http.Error(w, "This election does not break ties by drawing lots", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.getContestReport(election, *contest)
+	if err != nil {
+		log.Printf("Error counting contest: %v", err)
+		http.Error(w, "Failed to count the contest", http.StatusInternalServerError)
+		return
+	}
+
+	reportsURL := "/admin/admin/elections/" + strconv.Itoa(election.ID) + "/reports"
+	if report.Tie == nil {
+		http.Error(w, "This contest has no tie to break", http.StatusBadRequest)
+		return
+	}
+	if report.Tie.Draw != nil {
+		http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+		return
+	}
+
+	// The recorded seed is the admin's part, if any, and the random part
+	// joined by a slash.
+	seed := generateRandomToken()
+	if public := strings.TrimSpace(r.FormValue("seed")); public != "" {
+		seed = public + "/" + seed
+	}
+
+	// A recorded draw is only replaced once the tie it settled is gone.
+	candidates := joinIDs(report.Tie.CandidateIDs)
+	result, err := h.db.Exec(`
+		INSERT INTO tie_draws (contest_id, candidates, seed, drawn_by) VALUES (?, ?, ?, ?)
+		ON CONFLICT (contest_id) DO UPDATE SET
+			candidates = excluded.candidates, seed = excluded.seed,
+			drawn_by = excluded.drawn_by, drawn_at = CURRENT_TIMESTAMP
+		WHERE tie_draws.candidates != excluded.candidates
+	`, contest.ID, candidates, seed, user.ID)
+	if err != nil {
+		log.Printf("Error recording lot drawing: %v", err)
+		http.Error(w, "Failed to draw lots", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+		return
+	}
+
+	names := make(map[int]string, len(contest.Candidates))
+	for _, candidate := range contest.Candidates {
+		names[candidate.ID] = candidate.Name
+	}
+	var order []string
+	for _, id := range tally.DrawLots(seed, report.Tie.CandidateIDs) {
+		order = append(order, fmt.Sprintf("%s (#%d)", names[id], id))
+	}
+	detail := fmt.Sprintf("Lots drawn for %s, %d seat(s): seed %q, order %s",
+		contest.Title, report.Tie.Seats, seed, strings.Join(order, ", "))
+	if report.Tie.Stage > 0 {
+		detail = fmt.Sprintf("Lots drawn for %s, tie at stage %d: seed %q, order %s",
+			contest.Title, report.Tie.Stage, seed, strings.Join(order, ", "))
+	}
+	if err := h.audit(election.ID, user.ID, "tie_lots_drawn", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, reportsURL, http.StatusSeeOther)
+}
+
+func joinIDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// tieSummary describes how a tie stands, for report exports.
+func tieSummary(tie *models.TieReport) string {
+	tied := fmt.Sprintf("Tie between %s for %d seat(s)", strings.Join(tie.Candidates, ", "), tie.Seats)
+	if tie.Stage > 0 {
+		tied = fmt.Sprintf("Tie between %s at stage %d, for %s", strings.Join(tie.Candidates, ", "), tie.Stage, tie.Action)
+	}
+	switch {
+	case tie.Draw != nil && tie.Stage > 0:
+		return fmt.Sprintf("%s, settled by lot (seed %q) in the order %s",
+			tied, tie.Draw.Seed, strings.Join(tie.Draw.Order, ", "))
+	case tie.Draw != nil:
+		return fmt.Sprintf("%s, settled by lot (seed %q): %s",
+			tied, tie.Draw.Seed, strings.Join(tie.Draw.Winners, ", "))
+	case tie.Rule == "lot":
+		return tied + ", awaiting a lot drawing"
+	case tie.Rule == "runoff":
+		return tied + ", to be decided by a runoff"
+	default:
+		return tied + ", unresolved"
+	}
+}
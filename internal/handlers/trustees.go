@@ -0,0 +1,1037 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"evoting-app/internal/elgamal"
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+	"evoting-app/internal/trustee"
+
+	"github.com/gorilla/mux"
+)
+
+// Reasons an encrypted election cannot take a ballot, worded for the voter.
+var (
+	errSealingNotReady = errors.New("This election is not ready to accept votes yet")
+	errSealingClosed   = errors.New("This election is not accepting votes")
+)
+
+var (
+	errBundleNotReady = errors.New("Not every trustee has registered their key yet")
+	errAlreadyDealt   = errors.New("trustee has already dealt")
+)
+
+// maxTrusteeFileSize caps the size of a file a trustee uploads.
+const maxTrusteeFileSize = 32 << 20
+
+// sealingKey returns the public key the election's ballots are sealed to,
+// or nil if the election is not encrypted. Ballots are only taken once the
+// trustees have made the key and every one of them has proved they hold
+// their share, and no longer once the ballots have been decrypted.
+func (h *Handlers) sealingKey(election *models.Election) (*big.Int, error) {
+	if !election.Encrypted {
+		return nil, nil
+	}
+
+	var publicKey sql.NullString
+	var opened bool
+	var unconfirmed int
+	err := h.db.QueryRow(`
+		SELECT k.public_key, k.decrypted_at IS NOT NULL,
+		       (SELECT COUNT(*) FROM trustees t WHERE t.election_id = k.election_id AND t.confirmed_at IS NULL)
+		FROM election_keys k
+		WHERE k.election_id = ?
+	`, election.ID).Scan(&publicKey, &opened, &unconfirmed)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errSealingNotReady
+	case err != nil:
+		return nil, err
+	case opened:
+		return nil, errSealingClosed
+	case !publicKey.Valid || unconfirmed > 0:
+		return nil, errSealingNotReady
+	}
+
+	return elgamal.ParseElement(publicKey.String)
+}
+
+func (h *Handlers) renderSealingKeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSealingNotReady) || errors.Is(err, errSealingClosed) {
+		h.renderVoteResult(w, false, err.Error())
+		return
+	}
+	log.Printf("Error loading election key: %v", err)
+	h.renderVoteResult(w, false, "Failed to load the election key")
+}
+
+// getSealedTally reports how far the making of an encrypted election's key
+// and the decryption of its ballots have got.
+func (h *Handlers) getSealedTally(electionID int) (*models.SealedTally, error) {
+	tally := &models.SealedTally{}
+
+	err := h.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(COALESCE(b.weight, 1)), 0)
+		FROM sealed_ballots s LEFT JOIN ballots b ON b.id = s.id
+		WHERE s.election_id = ?
+	`, electionID).Scan(&tally.Ballots, &tally.Weight)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.db.QueryRow(
+		`SELECT threshold, decrypted_at IS NOT NULL FROM election_keys WHERE election_id = ?`, electionID,
+	).Scan(&tally.Threshold, &tally.Opened)
+	if err == sql.ErrNoRows {
+		return tally, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tally.HasKey = true
+
+	err = h.db.QueryRow(`
+		SELECT COUNT(*), COUNT(personal_key), COUNT(commitments), COUNT(confirmed_at), COUNT(decrypted_at)
+		FROM trustees
+		WHERE election_id = ?
+	`, electionID).Scan(&tally.Trustees, &tally.Registered, &tally.Dealt, &tally.Confirmed, &tally.Decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return tally, nil
+}
+
+// trusteeColumns are the columns scanned by scanTrustee.
+const trusteeColumns = `t.election_id, t.user_id, u.username, t.share_index,
+	t.personal_key IS NOT NULL, t.commitments IS NOT NULL, t.confirmed_at IS NOT NULL, t.decrypted_at IS NOT NULL`
+
+func scanTrustee(row interface{ Scan(...interface{}) error }, t *models.Trustee) error {
+	return row.Scan(&t.ElectionID, &t.UserID, &t.Username, &t.ShareIndex, &t.Registered, &t.Dealt, &t.Confirmed, &t.Decrypted)
+}
+
+func (h *Handlers) getTrustees(electionID int) ([]models.Trustee, error) {
+	rows, err := h.db.Query(`
+		SELECT `+trusteeColumns+`
+		FROM trustees t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.election_id = ?
+		ORDER BY t.share_index
+	`, electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trustees []models.Trustee
+	for rows.Next() {
+		var t models.Trustee
+		if err := scanTrustee(rows, &t); err != nil {
+			return nil, err
+		}
+		trustees = append(trustees, t)
+	}
+
+	return trustees, rows.Err()
+}
+
+// getTrustee loads the signed-in user's place among the election's
+// trustees; sql.ErrNoRows means they are not one.
+func (h *Handlers) getTrustee(electionID, userID int) (*models.Trustee, error) {
+	var t models.Trustee
+	err := scanTrustee(h.db.QueryRow(`
+		SELECT `+trusteeColumns+`
+		FROM trustees t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.election_id = ? AND t.user_id = ?
+	`, electionID, userID), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ElectionTrustees lets the superadmin pick the trustees of an encrypted
+// election and how many of them are needed to decrypt. The trustees then
+// make the key between them from their Key Shares pages; the server only
+// ever sees its public half. The trustees can be chosen again, starting
+// the key over, until the first ballot is sealed to it.
+func (h *Handlers) ElectionTrustees(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+
+	election, err := h.getElectionByID(vars["id"])
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	render := func(message string) {
+		users, err := h.getAllUsers()
+		if err != nil {
+			http.Error(w, "Failed to load users", http.StatusInternalServerError)
+			return
+		}
+		trustees, err := h.getTrustees(election.ID)
+		if err != nil {
+			http.Error(w, "Failed to load trustees", http.StatusInternalServerError)
+			return
+		}
+		tally, err := h.getSealedTally(election.ID)
+		if err != nil {
+			http.Error(w, "Failed to load the election key", http.StatusInternalServerError)
+			return
+		}
+
+		err = h.renderSuperAdminTemplate(w, "election_trustees.html", map[string]interface{}{
+			"User":     user,
+			"Election": election,
+			"Users":    users,
+			"Trustees": trustees,
+			"Tally":    tally,
+			"Error":    message,
+		})
+		if err != nil {
+			log.Printf("Error executing election trustees template: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}
+
+	if r.Method == "GET" {
+		render("")
+		return
+	}
+
+	// Handle POST
+	if !election.Encrypted {
+		render("Only encrypted elections have trustees")
+		return
+	}
+
+	tally, err := h.getSealedTally(election.ID)
+	if err != nil {
+		http.Error(w, "Failed to load the election key", http.StatusInternalServerError)
+		return
+	}
+	if tally.Ballots > 0 {
+		render("Ballots have already been sealed to this election's key, so it cannot be replaced")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		render("Invalid form")
+		return
+	}
+	trusteeIDs := r.PostForm["trustee_id"]
+	if len(trusteeIDs) == 0 {
+		render("Choose at least one trustee")
+		return
+	}
+	threshold, err := strconv.Atoi(r.FormValue("threshold"))
+	if err != nil || threshold < 1 || threshold > len(trusteeIDs) {
+		render(fmt.Sprintf("The number of trustees needed to decrypt must be between 1 and %d", len(trusteeIDs)))
+		return
+	}
+
+	if err := h.chooseTrustees(election.ID, threshold, trusteeIDs); err != nil {
+		log.Printf("Error choosing trustees: %v", err)
+		render("Failed to choose the trustees")
+		return
+	}
+
+	detail := fmt.Sprintf("Trustees chosen to make the election key; %d of %d needed to decrypt", threshold, len(trusteeIDs))
+	if err := h.audit(election.ID, user.ID, "trustees_chosen", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, "/admin/superadmin/elections/"+strconv.Itoa(election.ID)+"/trustees", http.StatusSeeOther)
+}
+
+// chooseTrustees gives each trustee a share index and starts the election
+// key over, discarding whatever the trustees had done towards an earlier
+// one.
+func (h *Handlers) chooseTrustees(electionID, threshold int, trusteeIDs []string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"dealt_shares", "trustees", "election_keys"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE election_id = ?`, electionID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO election_keys (election_id, threshold) VALUES (?, ?)`, electionID, threshold)
+	if err != nil {
+		return err
+	}
+
+	for i, trusteeID := range trusteeIDs {
+		_, err := tx.Exec(
+			`INSERT INTO trustees (election_id, user_id, share_index) VALUES (?, ?, ?)`,
+			electionID, trusteeID, i+1,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// trusteeAssignment is one election key share on the trustee page.
+type trusteeAssignment struct {
+	Election *models.Election
+	Trustee  models.Trustee
+	Tally    *models.SealedTally
+}
+
+// TrusteeDashboard lists the elections the signed-in user is a trustee of,
+// with the next step each is waiting for.
+func (h *Handlers) TrusteeDashboard(w http.ResponseWriter, r *http.Request) {
+	h.renderTrusteePage(w, middleware.GetUserFromContext(r.Context()), map[string]interface{}{})
+}
+
+func (h *Handlers) renderTrusteePage(w http.ResponseWriter, user *models.User, data map[string]interface{}) {
+	rows, err := h.db.Query(`
+		SELECT `+trusteeColumns+`
+		FROM trustees t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.user_id = ?
+		ORDER BY t.election_id DESC
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+		return
+	}
+	var trustees []models.Trustee
+	for rows.Next() {
+		var t models.Trustee
+		if err := scanTrustee(rows, &t); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+			return
+		}
+		trustees = append(trustees, t)
+	}
+	rows.Close()
+
+	var assignments []trusteeAssignment
+	for _, trustee := range trustees {
+		election, err := h.getElectionByID(strconv.Itoa(trustee.ElectionID))
+		if err != nil {
+			http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+			return
+		}
+		tally, err := h.getSealedTally(trustee.ElectionID)
+		if err != nil {
+			http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+			return
+		}
+		assignments = append(assignments, trusteeAssignment{Election: election, Trustee: trustee, Tally: tally})
+	}
+
+	data["User"] = user
+	data["Assignments"] = assignments
+
+	err = h.renderAdminTemplate(w, "trustee.html", data)
+	if err != nil {
+		log.Printf("Error executing trustee template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// trusteeStep loads what a trustee's step needs: the election, the
+// signed-in user's place among its trustees and how far the key has got.
+// If it cannot, it writes the error response and returns a nil trustee.
+func (h *Handlers) trusteeStep(w http.ResponseWriter, r *http.Request) (*models.User, *models.Election, *models.Trustee, *models.SealedTally) {
+	user := middleware.GetUserFromContext(r.Context())
+
+	election, err := h.getElectionByID(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return nil, nil, nil, nil
+	}
+
+	t, err := h.getTrustee(election.ID, user.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+		return nil, nil, nil, nil
+	}
+
+	tally, err := h.getSealedTally(election.ID)
+	if err != nil {
+		http.Error(w, "Failed to load the election key", http.StatusInternalServerError)
+		return nil, nil, nil, nil
+	}
+
+	return user, election, t, tally
+}
+
+// readTrusteeFile decodes the JSON file a trustee uploaded in field.
+func readTrusteeFile(r *http.Request, field string, v interface{}) error {
+	if err := r.ParseMultipartForm(maxTrusteeFileSize); err != nil {
+		return errors.New("The file is too large or could not be read")
+	}
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return errors.New("Choose the file to upload")
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return errors.New("The file is not one made by the trustee tool")
+	}
+	return nil
+}
+
+// RegisterTrusteeKey records the public half of a key the trustee made on
+// their own machine, which the other trustees seal the shares they deal to
+// them to.
+func (h *Handlers) RegisterTrusteeKey(w http.ResponseWriter, r *http.Request) {
+	user, election, t, tally := h.trusteeStep(w, r)
+	if t == nil {
+		return
+	}
+	fail := func(message string) {
+		h.renderTrusteePage(w, user, map[string]interface{}{"Error": message})
+	}
+
+	if t.Registered {
+		fail("You have already registered your key for " + election.Title)
+		return
+	}
+	if tally.Ballots > 0 {
+		fail("Ballots have already been sealed to the key of " + election.Title)
+		return
+	}
+	publicKey := strings.ToLower(strings.Join(strings.Fields(r.FormValue("public_key")), ""))
+	if _, err := elgamal.ParseElement(publicKey); err != nil {
+		fail("That is not a public key made by the trustee tool")
+		return
+	}
+
+	result, err := h.db.Exec(
+		`UPDATE trustees SET personal_key = ? WHERE election_id = ? AND user_id = ? AND personal_key IS NULL`,
+		publicKey, election.ID, user.ID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to register the key", http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		fail("You have already registered your key for " + election.Title)
+		return
+	}
+
+	fingerprint := trustee.Fingerprint(publicKey)
+	detail := fmt.Sprintf("Trustee %d registered their key, fingerprint %s", t.ShareIndex, fingerprint)
+	if err := h.audit(election.ID, user.ID, "trustee_key_registered", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	h.renderTrusteePage(w, user, map[string]interface{}{
+		"Success": "Your key for " + election.Title + " has been registered. Its fingerprint is " + fingerprint +
+			"; compare it with the one the other trustees see before you deal.",
+	})
+}
+
+// TrusteeBundle downloads what the trustee needs for their next step on
+// their own machine: the trustees' keys, to deal to; once everyone has
+// dealt, the shares dealt to this trustee; and once the election is
+// completed, the sealed ballots to decrypt.
+func (h *Handlers) TrusteeBundle(w http.ResponseWriter, r *http.Request) {
+	_, election, t, _ := h.trusteeStep(w, r)
+	if t == nil {
+		return
+	}
+
+	bundle, err := h.trusteeBundle(election, t.ShareIndex)
+	if err == errBundleNotReady {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error building trustee bundle: %v", err)
+		http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="election-%d-trustee-%d.json"`, election.ID, t.ShareIndex))
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		log.Printf("Error writing trustee bundle: %v", err)
+	}
+}
+
+func (h *Handlers) trusteeBundle(election *models.Election, index int) (*trustee.Bundle, error) {
+	bundle := &trustee.Bundle{ElectionID: election.ID, Index: index, Trustees: make(map[int]string)}
+
+	var opened bool
+	err := h.db.QueryRow(
+		`SELECT threshold, decrypted_at IS NOT NULL FROM election_keys WHERE election_id = ?`, election.ID,
+	).Scan(&bundle.Threshold, &opened)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.db.Query(`SELECT share_index, personal_key, commitments FROM trustees WHERE election_id = ?`, election.ID)
+	if err != nil {
+		return nil, err
+	}
+	commitments := make(map[int]string)
+	for rows.Next() {
+		var i int
+		var key, c sql.NullString
+		if err := rows.Scan(&i, &key, &c); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !key.Valid {
+			rows.Close()
+			return nil, errBundleNotReady
+		}
+		bundle.Trustees[i] = key.String
+		if c.Valid {
+			commitments[i] = c.String
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(commitments) < len(bundle.Trustees) {
+		return bundle, nil
+	}
+
+	rows, err = h.db.Query(`
+		SELECT dealer_index, ephemeral_key, ciphertext
+		FROM dealt_shares
+		WHERE election_id = ? AND recipient_index = ?
+		ORDER BY dealer_index
+	`, election.ID, index)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		d := trustee.Dealing{ElectionID: election.ID}
+		var share trustee.EncryptedShare
+		if err := rows.Scan(&d.Dealer, &share.EphemeralKey, &share.Ciphertext); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Commitments = strings.Split(commitments[d.Dealer], ",")
+		d.Shares = map[int]trustee.EncryptedShare{index: share}
+		bundle.Dealings = append(bundle.Dealings, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if election.Status != "completed" || opened {
+		return bundle, nil
+	}
+	rows, err = h.db.Query(`SELECT id, ephemeral_key FROM sealed_ballots WHERE election_id = ? ORDER BY id`, election.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b trustee.SealedBallot
+		if err := rows.Scan(&b.ID, &b.EphemeralKey); err != nil {
+			return nil, err
+		}
+		bundle.Ballots = append(bundle.Ballots, b)
+	}
+
+	return bundle, rows.Err()
+}
+
+// SubmitDealing takes the shares a trustee dealt on their own machine, each
+// sealed to the trustee it is for, and the commitments they can be checked
+// against. Once every trustee has dealt, the election's public key and the
+// trustees' verification keys are worked out from the commitments.
+func (h *Handlers) SubmitDealing(w http.ResponseWriter, r *http.Request) {
+	user, election, t, tally := h.trusteeStep(w, r)
+	if t == nil {
+		return
+	}
+	fail := func(message string) {
+		h.renderTrusteePage(w, user, map[string]interface{}{"Error": message})
+	}
+
+	switch {
+	case t.Dealt:
+		fail("You have already dealt your shares for " + election.Title)
+		return
+	case tally.Registered < tally.Trustees:
+		fail(errBundleNotReady.Error())
+		return
+	}
+
+	var dealing trustee.Dealing
+	if err := readTrusteeFile(r, "dealing", &dealing); err != nil {
+		fail(err.Error())
+		return
+	}
+	if dealing.ElectionID != election.ID || dealing.Dealer != t.ShareIndex {
+		fail("This dealing is not yours for " + election.Title)
+		return
+	}
+	indices := make([]int, tally.Trustees)
+	for i := range indices {
+		indices[i] = i + 1
+	}
+	commitments, err := dealing.Check(tally.Threshold, indices)
+	if err != nil {
+		fail("This dealing cannot be used: " + err.Error())
+		return
+	}
+
+	complete, err := h.storeDealing(election.ID, t.ShareIndex, commitments, dealing.Shares)
+	if err == errAlreadyDealt {
+		fail("You have already dealt your shares for " + election.Title)
+		return
+	}
+	if err != nil {
+		log.Printf("Error storing dealing: %v", err)
+		fail("Failed to store your dealing for " + election.Title)
+		return
+	}
+
+	if err := h.audit(election.ID, user.ID, "key_shares_dealt", fmt.Sprintf("Trustee %d dealt their shares", t.ShareIndex)); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+	message := "Your dealing for " + election.Title + " has been recorded."
+	if complete {
+		if err := h.audit(election.ID, user.ID, "election_key_created", "Every trustee has dealt; the election key is made"); err != nil {
+			log.Printf("Error recording audit entry: %v", err)
+		}
+		message += " Every trustee has now dealt: download your file again to confirm your share."
+	}
+	h.renderTrusteePage(w, user, map[string]interface{}{"Success": message})
+}
+
+// storeDealing records a trustee's dealing and, if it was the last one,
+// completes the election key. It reports whether it did.
+func (h *Handlers) storeDealing(electionID, dealer int, commitments []*big.Int, shares map[int]trustee.EncryptedShare) (bool, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	values := make([]string, len(commitments))
+	for i, c := range commitments {
+		values[i] = c.Text(16)
+	}
+	result, err := tx.Exec(
+		`UPDATE trustees SET commitments = ? WHERE election_id = ? AND share_index = ? AND commitments IS NULL`,
+		strings.Join(values, ","), electionID, dealer,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errAlreadyDealt
+		}
+		return false, err
+	}
+
+	for recipient, share := range shares {
+		_, err := tx.Exec(
+			`INSERT INTO dealt_shares (election_id, dealer_index, recipient_index, ephemeral_key, ciphertext) VALUES (?, ?, ?, ?, ?)`,
+			electionID, dealer, recipient, share.EphemeralKey, share.Ciphertext,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	complete, err := completeElectionKey(tx, electionID)
+	if err != nil {
+		return false, err
+	}
+	return complete, tx.Commit()
+}
+
+// completeElectionKey works out the election's public key, the product of
+// the dealers' first commitments, and each trustee's verification key, the
+// product of what the dealers committed to for them, once every trustee has
+// dealt. It reports whether they had.
+func completeElectionKey(tx *sql.Tx, electionID int) (bool, error) {
+	rows, err := tx.Query(`SELECT share_index, commitments FROM trustees WHERE election_id = ?`, electionID)
+	if err != nil {
+		return false, err
+	}
+	dealings := make(map[int][]*big.Int)
+	for rows.Next() {
+		var index int
+		var c sql.NullString
+		if err := rows.Scan(&index, &c); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if !c.Valid {
+			rows.Close()
+			return false, rows.Err()
+		}
+		for _, value := range strings.Split(c.String, ",") {
+			element, err := elgamal.ParseElement(value)
+			if err != nil {
+				rows.Close()
+				return false, err
+			}
+			dealings[index] = append(dealings[index], element)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	var parts []*big.Int
+	for _, commitments := range dealings {
+		parts = append(parts, commitments[0])
+	}
+	_, err = tx.Exec(
+		`UPDATE election_keys SET public_key = ? WHERE election_id = ?`, elgamal.Product(parts).Text(16), electionID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	for index := range dealings {
+		var parts []*big.Int
+		for _, commitments := range dealings {
+			parts = append(parts, elgamal.Committed(commitments, index))
+		}
+		_, err := tx.Exec(
+			`UPDATE trustees SET verification_key = ? WHERE election_id = ? AND share_index = ?`,
+			elgamal.Product(parts).Text(16), electionID, index,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ConfirmKeyShare takes a trustee's proof that they can work out their
+// share of the election key, which their trustee tool only makes once every
+// share dealt to them matches its dealer's commitments. Voting opens once
+// every trustee has confirmed.
+func (h *Handlers) ConfirmKeyShare(w http.ResponseWriter, r *http.Request) {
+	user, election, t, tally := h.trusteeStep(w, r)
+	if t == nil {
+		return
+	}
+	fail := func(message string) {
+		h.renderTrusteePage(w, user, map[string]interface{}{"Error": message})
+	}
+
+	switch {
+	case t.Confirmed:
+		fail("You have already confirmed your share for " + election.Title)
+		return
+	case tally.Dealt < tally.Trustees:
+		fail("Not every trustee has dealt their shares yet")
+		return
+	}
+
+	var confirmation trustee.Confirmation
+	if err := readTrusteeFile(r, "confirmation", &confirmation); err != nil {
+		fail(err.Error())
+		return
+	}
+	if confirmation.ElectionID != election.ID || confirmation.Index != t.ShareIndex {
+		fail("This confirmation is not yours for " + election.Title)
+		return
+	}
+
+	var verificationKey string
+	err := h.db.QueryRow(
+		`SELECT verification_key FROM trustees WHERE election_id = ? AND share_index = ?`, election.ID, t.ShareIndex,
+	).Scan(&verificationKey)
+	if err != nil {
+		http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+		return
+	}
+	vk, err := elgamal.ParseElement(verificationKey)
+	if err != nil {
+		http.Error(w, "Failed to load key shares", http.StatusInternalServerError)
+		return
+	}
+	proof, err := elgamal.ParseProof(confirmation.Proof)
+	if err != nil || !elgamal.CheckShareProof(vk, proof) {
+		fail("This confirmation does not prove you hold your share of " + election.Title)
+		return
+	}
+
+	_, err = h.db.Exec(
+		`UPDATE trustees SET confirmed_at = CURRENT_TIMESTAMP WHERE election_id = ? AND share_index = ?`,
+		election.ID, t.ShareIndex,
+	)
+	if err != nil {
+		http.Error(w, "Failed to confirm the key share", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.audit(election.ID, user.ID, "key_share_confirmed", fmt.Sprintf("Trustee %d confirmed their share", t.ShareIndex)); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	h.renderTrusteePage(w, user, map[string]interface{}{
+		"Success": "Your share of the key of " + election.Title + " is confirmed. Keep your key file until the ballots are decrypted.",
+	})
+}
+
+// SubmitDecryption takes a trustee's partial decryption of every sealed
+// ballot, made on their own machine once the election is completed. Each
+// comes with a proof that it was made with the trustee's share, checked
+// against their verification key. When enough trustees have done this, the
+// ballots are decrypted into the ballot box and the results become
+// available.
+func (h *Handlers) SubmitDecryption(w http.ResponseWriter, r *http.Request) {
+	user, election, t, tally := h.trusteeStep(w, r)
+	if t == nil {
+		return
+	}
+	fail := func(message string) {
+		h.renderTrusteePage(w, user, map[string]interface{}{"Error": message})
+	}
+
+	switch {
+	case election.Status != "completed":
+		fail("The ballots of " + election.Title + " can only be decrypted once the election is completed")
+		return
+	case tally.Opened:
+		fail("The ballots of " + election.Title + " have already been decrypted")
+		return
+	case t.Decrypted:
+		fail("You have already decrypted your part of " + election.Title)
+		return
+	}
+
+	var decryption trustee.Decryption
+	if err := readTrusteeFile(r, "decryption", &decryption); err != nil {
+		fail(err.Error())
+		return
+	}
+	if decryption.ElectionID != election.ID || decryption.Index != t.ShareIndex {
+		fail("This decryption is not yours for " + election.Title)
+		return
+	}
+
+	partials, err := h.checkPartials(election.ID, t.ShareIndex, decryption.Partials)
+	if err != nil {
+		if err := h.audit(election.ID, user.ID, "decryption_rejected", fmt.Sprintf("Trustee %d: %v", t.ShareIndex, err)); err != nil {
+			log.Printf("Error recording audit entry: %v", err)
+		}
+		fail("This decryption cannot be used: " + err.Error())
+		return
+	}
+
+	opened, unopened, err := h.decryptBallots(election.ID, t.ShareIndex, partials)
+	if err != nil {
+		log.Printf("Error decrypting ballots: %v", err)
+		fail("Failed to decrypt the ballots of " + election.Title)
+		return
+	}
+
+	detail := fmt.Sprintf("Trustee %d decrypted %d sealed ballots", t.ShareIndex, len(partials))
+	if err := h.audit(election.ID, user.ID, "key_share_submitted", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	message := "Your partial decryption of " + election.Title + " has been recorded."
+	if opened {
+		message += " Enough trustees have now taken part: the ballots are decrypted and the results are available."
+		if len(unopened) > 0 {
+			detail := fmt.Sprintf("%d sealed ballot(s) could not be decrypted: %s", len(unopened), strings.Join(unopened, ", "))
+			if err := h.audit(election.ID, user.ID, "sealed_ballot_unopened", detail); err != nil {
+				log.Printf("Error recording audit entry: %v", err)
+			}
+			message += fmt.Sprintf(" %d ballot(s) could not be decrypted and were left out; see the ballot ledger.", len(unopened))
+		}
+	}
+	h.renderTrusteePage(w, user, map[string]interface{}{"Success": message})
+}
+
+// checkPartials makes sure a trustee decrypted every sealed ballot of the
+// election and nothing else, each with their share, and returns the
+// partial decryptions by ballot ID.
+func (h *Handlers) checkPartials(electionID, index int, submitted []trustee.Partial) (map[string]trustee.Partial, error) {
+	var verificationKey string
+	err := h.db.QueryRow(
+		`SELECT verification_key FROM trustees WHERE election_id = ? AND share_index = ?`, electionID, index,
+	).Scan(&verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	vk, err := elgamal.ParseElement(verificationKey)
+	if err != nil {
+		return nil, err
+	}
+
+	partials := make(map[string]trustee.Partial, len(submitted))
+	for _, p := range submitted {
+		partials[p.BallotID] = p
+	}
+
+	rows, err := h.db.Query(`SELECT id, ephemeral_key FROM sealed_ballots WHERE election_id = ?`, electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ballots int
+	for rows.Next() {
+		var ballotID, ephemeralKey string
+		if err := rows.Scan(&ballotID, &ephemeralKey); err != nil {
+			return nil, err
+		}
+		ballots++
+		p, ok := partials[ballotID]
+		if !ok {
+			return nil, fmt.Errorf("ballot %s is missing", ballotID)
+		}
+		ephemeral, err := elgamal.ParseElement(ephemeralKey)
+		if err != nil {
+			return nil, err
+		}
+		partial, err := elgamal.ParseElement(p.Partial)
+		if err != nil {
+			return nil, fmt.Errorf("the partial decryption of ballot %s is not valid", ballotID)
+		}
+		proof, err := elgamal.ParseProof(p.Proof)
+		if err != nil || !elgamal.CheckPartial(ephemeral, vk, partial, proof) {
+			return nil, fmt.Errorf("the partial decryption of ballot %s was not made with your share", ballotID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(partials) != ballots {
+		return nil, errors.New("it holds ballots that are not this election's")
+	}
+
+	return partials, nil
+}
+
+// decryptBallots records the trustee's partial decryptions of the sealed
+// ballots of the election, and decrypts the ballots into the ballot box
+// once the threshold is reached. It reports whether they were, and the IDs
+// of any ballot that would not decrypt.
+func (h *Handlers) decryptBallots(electionID, index int, partials map[string]trustee.Partial) (bool, []string, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+
+	for ballotID, p := range partials {
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO decryption_shares (ballot_id, share_index, partial, proof) VALUES (?, ?, ?, ?)`,
+			ballotID, index, p.Partial, p.Proof,
+		)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE trustees SET decrypted_at = CURRENT_TIMESTAMP WHERE election_id = ? AND share_index = ?`,
+		electionID, index,
+	)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var threshold, decrypted int
+	err = tx.QueryRow(`
+		SELECT k.threshold, (SELECT COUNT(t.decrypted_at) FROM trustees t WHERE t.election_id = k.election_id)
+		FROM election_keys k
+		WHERE k.election_id = ? AND k.decrypted_at IS NULL
+	`, electionID).Scan(&threshold, &decrypted)
+	if err != nil {
+		return false, nil, err
+	}
+	if decrypted < threshold {
+		return false, nil, tx.Commit()
+	}
+
+	unopened, err := openSealedBallots(tx, electionID)
+	if err != nil {
+		return false, nil, err
+	}
+	_, err = tx.Exec(`UPDATE election_keys SET decrypted_at = CURRENT_TIMESTAMP WHERE election_id = ?`, electionID)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, unopened, tx.Commit()
+}
+
+// openSealedBallots decrypts every sealed ballot of the election into the
+// ballot box under its own ballot ID. A ballot that does not decrypt, such
+// as one whose ciphertext was changed, is left out and returned.
+func openSealedBallots(tx *sql.Tx, electionID int) ([]string, error) {
+	rows, err := tx.Query(`SELECT id FROM sealed_ballots WHERE election_id = ?`, electionID)
+	if err != nil {
+		return nil, err
+	}
+	var ballotIDs []string
+	for rows.Next() {
+		var ballotID string
+		if err := rows.Scan(&ballotID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ballotIDs = append(ballotIDs, ballotID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var unopened []string
+	for _, ballotID := range ballotIDs {
+		contents, err := ledger.OpenSealed(tx, ballotID)
+		if err == ledger.ErrUnopened {
+			unopened = append(unopened, ballotID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ballot := make([]contestBallot, len(contents))
+		for i, contest := range contents {
+			ballot[i] = contestBallot(contest)
+		}
+		if err := storeBallot(tx, electionID, ballotID, ballot); err != nil {
+			return nil, err
+		}
+	}
+
+	return unopened, nil
+}
@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"evoting-app/internal/middleware"
+	"evoting-app/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// maxVoterRollSize caps the size of an uploaded voter roll.
+const maxVoterRollSize = 10 << 20
+
+// voterColumns maps the headers a voter roll CSV may use to its fields.
+var voterColumns = map[string]string{
+	"name":      "name",
+	"member_id": "member_id",
+	"member id": "member_id",
+	"memberid":  "member_id",
+	"email":     "email",
+	"group":     "group",
+	"weight":    "weight",
+	"votes":     "weight",
+}
+
+// voterRoll is a voter roll read from a CSV, with the columns it had.
+type voterRoll struct {
+	Rows    []voterRow
+	Columns map[string]int
+}
+
+// voterRow is one voter read from a voter roll CSV.
+type voterRow struct {
+	MemberID string
+	Name     string
+	Email    string
+	Group    string
+	Weight   int
+}
+
+// ManageVoters lists an election's voter roll with where each voter's token
+// stands.
+func (h *Handlers) ManageVoters(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	h.renderVoters(w, user, election, nil)
+}
+
+// renderVoters shows the voter roll page, with data such as an "Error" or
+// "Success" message added to what the page always shows.
+func (h *Handlers) renderVoters(w http.ResponseWriter, user *models.User, election *models.Election, data map[string]interface{}) {
+	voters, err := h.getVoters(election.ID)
+	if err != nil {
+		log.Printf("Error loading voters: %v", err)
+		http.Error(w, "Failed to load voters", http.StatusInternalServerError)
+		return
+	}
+
+	var delivered, redeemed int
+	mail := map[string]int{}
+	for _, voter := range voters {
+		if voter.DeliveredAt != nil {
+			delivered++
+		}
+		if voter.Redeemed {
+			redeemed++
+		}
+		if voter.LastEmail != nil {
+			mail[voter.LastEmail.Status]++
+		}
+	}
+
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["User"] = user
+	data["Election"] = election
+	data["Voters"] = voters
+	data["Delivered"] = delivered
+	data["Redeemed"] = redeemed
+	data["MailEnabled"] = h.mail != nil
+	data["Mail"] = mail
+
+	if err := h.renderAdminTemplate(w, "manage_voters.html", data); err != nil {
+		log.Printf("Error executing manage voters template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// ImportVoters adds the voters in an uploaded CSV to the election's voter
+// roll and issues each new voter one token. Voters already on the roll, by
+// member ID, keep their token; their details are updated, and so is their
+// weight while the token is unused.
+func (h *Handlers) ImportVoters(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxVoterRollSize); err != nil {
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "The voter roll is too large or could not be read"})
+		return
+	}
+	file, _, err := r.FormFile("roll")
+	if err != nil {
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Choose a CSV file to import"})
+		return
+	}
+	defer file.Close()
+
+	roll, err := parseVoterRoll(file)
+	if err != nil {
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	added, updated, err := h.importVoters(election.ID, roll)
+	if err != nil {
+		log.Printf("Error importing voters: %v", err)
+		h.renderVoters(w, user, election, map[string]interface{}{"Error": "Failed to import the voter roll"})
+		return
+	}
+
+	detail := fmt.Sprintf("Voter roll imported: %d voter(s) added with a token each, %d updated", added, updated)
+	if err := h.audit(election.ID, user.ID, "voters_imported", detail); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/voters", http.StatusSeeOther)
+}
+
+// parseVoterRoll reads a voter roll CSV. The header row names the columns:
+// name and member ID are required, email, group and weight are optional.
+func parseVoterRoll(file io.Reader) (*voterRoll, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("The voter roll is empty")
+	}
+	if err != nil {
+		return nil, errors.New("The voter roll is not a valid CSV file")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if field, ok := voterColumns[name]; ok {
+			columns[field] = i
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("The voter roll needs a name column")
+	}
+	if _, ok := columns["member_id"]; !ok {
+		return nil, errors.New("The voter roll needs a member_id column")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []voterRow
+	seen := make(map[string]int)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the voter roll could not be read", line)
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		row := voterRow{
+			MemberID: field(record, "member_id"),
+			Name:     field(record, "name"),
+			Email:    field(record, "email"),
+			Group:    field(record, "group"),
+			Weight:   1,
+		}
+		switch {
+		case row.MemberID == "":
+			return nil, fmt.Errorf("Line %d has no member ID", line)
+		case row.Name == "":
+			return nil, fmt.Errorf("Line %d has no name", line)
+		}
+		if first, ok := seen[row.MemberID]; ok {
+			return nil, fmt.Errorf("Line %d repeats member ID %s from line %d", line, row.MemberID, first)
+		}
+		seen[row.MemberID] = line
+
+		// Only the bare address is kept, so that a display name or a second
+		// address cannot end up in the headers of the token email.
+		if row.Email != "" {
+			address, err := mail.ParseAddress(row.Email)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d has an email address that is not valid", line)
+			}
+			row.Email = address.Address
+		}
+
+		if weight := field(record, "weight"); weight != "" {
+			row.Weight, err = strconv.Atoi(weight)
+			if err != nil || row.Weight < 1 {
+				return nil, fmt.Errorf("Line %d has a weight that is not a whole number of at least 1", line)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("The voter roll has no voters")
+	}
+	return &voterRoll{Rows: rows, Columns: columns}, nil
+}
+
+// importVoters stores the voter roll in one transaction, issuing a token to
+// every voter not yet on it. Optional columns missing from the roll leave
+// what is stored for voters already on it alone.
+func (h *Handlers) importVoters(electionID int, roll *voterRoll) (added, updated int, err error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	_, hasEmail := roll.Columns["email"]
+	_, hasGroup := roll.Columns["group"]
+	_, hasWeight := roll.Columns["weight"]
+
+	for _, row := range roll.Rows {
+		var voterID int
+		var tokenID sql.NullInt64
+		var email, group string
+		err := tx.QueryRow(
+			`SELECT id, token_id, email, group_name FROM voters WHERE election_id = ? AND member_id = ?`,
+			electionID, row.MemberID,
+		).Scan(&voterID, &tokenID, &email, &group)
+
+		switch {
+		case err == sql.ErrNoRows:
+			result, err := tx.Exec(
+				`INSERT INTO voting_tokens (election_id, token, weight) VALUES (?, ?, ?)`,
+				electionID, h.newToken(), row.Weight,
+			)
+			if err != nil {
+				return 0, 0, err
+			}
+			newTokenID, err := result.LastInsertId()
+			if err != nil {
+				return 0, 0, err
+			}
+			_, err = tx.Exec(
+				`INSERT INTO voters (election_id, member_id, name, email, group_name, token_id) VALUES (?, ?, ?, ?, ?, ?)`,
+				electionID, row.MemberID, row.Name, row.Email, row.Group, newTokenID,
+			)
+			if err != nil {
+				return 0, 0, err
+			}
+			added++
+
+		case err != nil:
+			return 0, 0, err
+
+		default:
+			if hasEmail {
+				email = row.Email
+			}
+			if hasGroup {
+				group = row.Group
+			}
+			_, err = tx.Exec(
+				`UPDATE voters SET name = ?, email = ?, group_name = ? WHERE id = ?`,
+				row.Name, email, group, voterID,
+			)
+			if err != nil {
+				return 0, 0, err
+			}
+			if tokenID.Valid && hasWeight {
+				_, err = tx.Exec(
+					`UPDATE voting_tokens SET weight = ? WHERE id = ? AND is_used = FALSE`, row.Weight, tokenID.Int64,
+				)
+				if err != nil {
+					return 0, 0, err
+				}
+			}
+			updated++
+		}
+	}
+
+	return added, updated, tx.Commit()
+}
+
+// MarkVoterDelivered records that a voter has been given their token, or
+// with undo=1 takes that back.
+func (h *Handlers) MarkVoterDelivered(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := `UPDATE voters SET delivered_at = CURRENT_TIMESTAMP WHERE id = ? AND election_id = ? AND delivered_at IS NULL`
+	if r.FormValue("undo") == "1" {
+		query = `UPDATE voters SET delivered_at = NULL WHERE id = ? AND election_id = ?`
+	}
+	if _, err := h.db.Exec(query, vars["voter_id"], electionID); err != nil {
+		http.Error(w, "Failed to update voter", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/voters", http.StatusSeeOther)
+}
+
+// DeleteVoter takes a voter off the roll along with their token. A voter
+// whose token has been used stays on the roll, since the ballot cannot be
+// taken back.
+func (h *Handlers) DeleteVoter(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to remove voter", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var memberID string
+	var tokenID sql.NullInt64
+	var used bool
+	err = tx.QueryRow(`
+		SELECT v.member_id, v.token_id, COALESCE(t.is_used, FALSE)
+		FROM voters v LEFT JOIN voting_tokens t ON t.id = v.token_id
+		WHERE v.id = ? AND v.election_id = ?
+	`, vars["voter_id"], electionID).Scan(&memberID, &tokenID, &used)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Voter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove voter", http.StatusInternalServerError)
+		return
+	}
+	if used {
+		http.Error(w, "This voter has already voted and cannot be removed", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM voters WHERE id = ?`, vars["voter_id"]); err != nil {
+		http.Error(w, "Failed to remove voter", http.StatusInternalServerError)
+		return
+	}
+	if tokenID.Valid {
+		if _, err := tx.Exec(`DELETE FROM voting_tokens WHERE id = ? AND is_used = FALSE`, tokenID.Int64); err != nil {
+			http.Error(w, "Failed to remove voter", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to remove voter", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := strconv.Atoi(electionID)
+	if err := h.audit(id, user.ID, "voter_removed", "Voter "+memberID+" removed from the roll and their token withdrawn"); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	http.Redirect(w, r, "/admin/admin/elections/"+electionID+"/voters", http.StatusSeeOther)
+}
+
+// ExportVoters downloads the voter roll with each voter's token, for handing
+// the tokens out.
+func (h *Handlers) ExportVoters(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	vars := mux.Vars(r)
+	electionID := vars["id"]
+
+	if !h.hasElectionAccess(user.ID, electionID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	election, err := h.getElectionByID(electionID)
+	if err != nil {
+		http.Error(w, "Election not found", http.StatusNotFound)
+		return
+	}
+
+	voters, err := h.getVoters(election.ID)
+	if err != nil {
+		log.Printf("Error loading voters: %v", err)
+		http.Error(w, "Failed to load voters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"election-%d-voters.csv\"", election.ID))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"member_id", "name", "email", "group", "weight", "token", "status"})
+	for _, voter := range voters {
+		cw.Write([]string{
+			voter.MemberID, voter.Name, voter.Email, voter.Group,
+			strconv.Itoa(voter.Weight), voter.Token, voterStatus(voter),
+		})
+	}
+	cw.Flush()
+}
+
+// getVoters loads an election's voter roll, ordered by group and name.
+func (h *Handlers) getVoters(electionID int) ([]models.Voter, error) {
+	rows, err := h.db.Query(`
+		SELECT v.id, v.election_id, v.member_id, v.name, v.email, v.group_name,
+			COALESCE(t.token, ''), COALESCE(t.weight, 1), v.delivered_at,
+			COALESCE(t.is_used, FALSE), t.used_at,
+			COALESCE(t.revoked_at IS NOT NULL, FALSE), COALESCE(t.expires_at <= ?, FALSE), v.created_at,
+			o.kind, o.status, o.recipient, o.last_error, o.attempts, o.sent_at,
+			(SELECT COUNT(*) FROM email_outbox WHERE voter_id = v.id AND kind = 'reminder' AND status = 'sent')
+		FROM voters v
+		LEFT JOIN voting_tokens t ON t.id = v.token_id
+		LEFT JOIN email_outbox o ON o.id = (SELECT MAX(id) FROM email_outbox WHERE voter_id = v.id)
+		WHERE v.election_id = ?
+		ORDER BY v.group_name, v.name, v.member_id
+	`, time.Now().UTC().Truncate(time.Second), electionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var voters []models.Voter
+	for rows.Next() {
+		var voter models.Voter
+		var mail models.VoterMail
+		var kind, status, recipient, lastError sql.NullString
+		var attempts sql.NullInt64
+		err := rows.Scan(
+			&voter.ID, &voter.ElectionID, &voter.MemberID, &voter.Name, &voter.Email, &voter.Group,
+			&voter.Token, &voter.Weight, &voter.DeliveredAt,
+			&voter.Redeemed, &voter.RedeemedOn,
+			&voter.Revoked, &voter.Expired, &voter.CreatedAt,
+			&kind, &status, &recipient, &lastError, &attempts, &mail.SentAt,
+			&voter.Reminders,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if kind.Valid {
+			mail.Kind, mail.Status, mail.Recipient = kind.String, status.String, recipient.String
+			mail.Error, mail.Attempts = lastError.String, int(attempts.Int64)
+			voter.LastEmail = &mail
+		}
+		voters = append(voters, voter)
+	}
+	return voters, rows.Err()
+}
+
+// voterStatus is how far a voter has got: issued a token, given it, or
+// voted with it; or whether their token was revoked or expired unused.
+func voterStatus(voter models.Voter) string {
+	switch {
+	case voter.Redeemed:
+		return "redeemed"
+	case voter.Revoked:
+		return "revoked"
+	case voter.Expired:
+		return "expired"
+	case voter.DeliveredAt != nil:
+		return "delivered"
+	case voter.Token == "":
+		return "no token"
+	default:
+		return "issued"
+	}
+}
@@ -0,0 +1,266 @@
+// Package ledger keeps a hash chain over each election's ballots, so that
+// editing, removing or slipping in a ballot after the fact shows up when the
+// chain is recomputed.
+package ledger
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Contest is a ballot's choices in one contest, as candidate IDs in
+// preference order. A blank vote has no choices.
+type Contest struct {
+	ContestID int
+	Choices   []string
+}
+
+// Digest is the SHA-256 of a ballot's contents, in hex. The random ballot ID
+// is part of it, so the digest cannot be matched against every possible
+// ballot to learn how someone voted. A weight other than 1 is part of it
+// too; leaving out the default keeps the digests of earlier ballots valid.
+func Digest(electionID int, ballotID string, weight int, ballot []Contest) string {
+	contests := make([]Contest, len(ballot))
+	copy(contests, ballot)
+	sort.Slice(contests, func(i, j int) bool { return contests[i].ContestID < contests[j].ContestID })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "evoting-receipt-v1\nelection:%d\nballot:%s\n%s", electionID, ballotID, weightLine(weight))
+	for _, contest := range contests {
+		choices := "blank"
+		if len(contest.Choices) > 0 {
+			choices = strings.Join(contest.Choices, ",")
+		}
+		fmt.Fprintf(&b, "contest:%d:%s\n", contest.ContestID, choices)
+	}
+
+	return sha256Hex(b.String())
+}
+
+// weightLine is how a ballot's weight appears in its digest.
+func weightLine(weight int) string {
+	if weight == 1 {
+		return ""
+	}
+	return fmt.Sprintf("weight:%d\n", weight)
+}
+
+// Weight reads the weight a ballot was cast with.
+func Weight(db querier, ballotID string) (int, error) {
+	var weight int
+	err := db.QueryRow(`SELECT weight FROM ballots WHERE id = ?`, ballotID).Scan(&weight)
+	if err == sql.ErrNoRows {
+		return 1, nil
+	}
+	return weight, err
+}
+
+// genesis is the hash the first entry of an election's chain commits to.
+func genesis(electionID int) string {
+	return sha256Hex(fmt.Sprintf("evoting-ledger-v1\nelection:%d\n", electionID))
+}
+
+// link is the hash of an entry: it commits to the entry before it and to the
+// ballot it records.
+func link(prevHash, ballotID, ballotHash string) string {
+	return sha256Hex(prevHash + "\n" + ballotID + "\n" + ballotHash)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Head returns the number of ballots in the election's chain and the hash of
+// its last entry, or the genesis hash for an empty chain.
+func Head(db querier, electionID int) (int, string, error) {
+	var position int
+	var hash string
+	err := db.QueryRow(
+		`SELECT position, hash FROM ballot_ledger WHERE election_id = ? ORDER BY position DESC LIMIT 1`,
+		electionID,
+	).Scan(&position, &hash)
+	if err == sql.ErrNoRows {
+		return 0, genesis(electionID), nil
+	}
+	return position, hash, err
+}
+
+// Append adds a ballot to the end of the election's chain. It must run in
+// the transaction that stores the ballot, which holds the write lock, so
+// that no other ballot can take the same position.
+func Append(tx *sql.Tx, electionID int, ballotID, ballotHash string) error {
+	position, prevHash, err := Head(tx, electionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO ballot_ledger (election_id, position, ballot_id, ballot_hash, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?)`,
+		electionID, position+1, ballotID, ballotHash, prevHash, link(prevHash, ballotID, ballotHash),
+	)
+	return err
+}
+
+type rowsQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ErrInconsistent means a stored ballot's first preference in a contest is
+// not the first of its selections there, which submitted ballots never are.
+var ErrInconsistent = errors.New("ballot rows disagree with each other")
+
+// ReadBallot reads a ballot back from the ballot box in the form it was
+// submitted in.
+func ReadBallot(db rowsQuerier, ballotID string) ([]Contest, error) {
+	rows, err := db.Query(`
+		SELECT v.contest_id, v.candidate_id, vs.candidate_id
+		FROM votes v
+		LEFT JOIN vote_selections vs ON vs.vote_id = v.id
+		WHERE v.ballot_id = ?
+		ORDER BY v.contest_id, vs.preference
+	`, ballotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ballot []Contest
+	for rows.Next() {
+		var contestID int
+		var firstChoice, candidateID sql.NullInt64
+		if err := rows.Scan(&contestID, &firstChoice, &candidateID); err != nil {
+			return nil, err
+		}
+		if len(ballot) == 0 || ballot[len(ballot)-1].ContestID != contestID {
+			if firstChoice != candidateID {
+				return nil, ErrInconsistent
+			}
+			ballot = append(ballot, Contest{ContestID: contestID})
+		}
+		if candidateID.Valid {
+			last := &ballot[len(ballot)-1]
+			last.Choices = append(last.Choices, strconv.FormatInt(candidateID.Int64, 10))
+		}
+	}
+
+	return ballot, rows.Err()
+}
+
+// Result is the outcome of recomputing an election's chain.
+type Result struct {
+	Ballots  int    // entries in the chain
+	Head     string // hash of the last entry
+	BrokenAt int    // position of the first broken link, 0 if none
+	Problem  string // what is wrong at BrokenAt, or with the ballot box
+}
+
+func (r *Result) OK() bool {
+	return r.Problem == ""
+}
+
+type entry struct {
+	position   int
+	ballotID   string
+	ballotHash string
+	prevHash   string
+	hash       string
+}
+
+// Verify walks the election's chain from the start, recomputing every hash
+// and every ballot's digest from the ballot box or the sealed ballots, and
+// stops at the first entry that does not hold up. It then checks that
+// neither holds ballots the chain does not know about.
+func Verify(db *sql.DB, electionID int) (*Result, error) {
+	rows, err := db.Query(
+		`SELECT position, ballot_id, ballot_hash, prev_hash, hash FROM ballot_ledger WHERE election_id = ? ORDER BY position`,
+		electionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.position, &e.ballotID, &e.ballotHash, &e.prevHash, &e.hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Ballots: len(entries), Head: genesis(electionID)}
+	chained := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		broken := func(problem string) (*Result, error) {
+			result.BrokenAt = e.position
+			result.Problem = problem
+			return result, nil
+		}
+
+		switch {
+		case e.position != i+1:
+			return broken(fmt.Sprintf("expected entry %d, found entry %d", i+1, e.position))
+		case e.prevHash != result.Head:
+			return broken("does not follow on from the entry before it")
+		case e.hash != link(e.prevHash, e.ballotID, e.ballotHash):
+			return broken("its hash does not match its contents")
+		}
+
+		digest, err := StoredDigest(db, electionID, e.ballotID)
+		switch {
+		case err == ErrInconsistent:
+			return broken("its ballot has been changed")
+		case err == sql.ErrNoRows:
+			return broken("its ballot is missing from the ballot box")
+		case err != nil:
+			return nil, err
+		case digest != e.ballotHash:
+			return broken("its ballot has been changed")
+		}
+
+		chained[e.ballotID] = true
+		result.Head = e.hash
+	}
+
+	ballotRows, err := db.Query(
+		`SELECT ballot_id FROM votes WHERE election_id = ? UNION SELECT id FROM sealed_ballots WHERE election_id = ?`,
+		electionID, electionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer ballotRows.Close()
+	unchained := 0
+	for ballotRows.Next() {
+		var ballotID string
+		if err := ballotRows.Scan(&ballotID); err != nil {
+			return nil, err
+		}
+		if !chained[ballotID] {
+			unchained++
+		}
+	}
+	if err := ballotRows.Err(); err != nil {
+		return nil, err
+	}
+	if unchained > 0 {
+		result.Problem = fmt.Sprintf("%d ballot(s) in the ballot box are not in the ledger", unchained)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,186 @@
+package ledger
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"evoting-app/internal/elgamal"
+)
+
+// Ballots of an encrypted election are sealed to the election key when they
+// are cast and only reach the ballot box once enough trustees have
+// decrypted them. Their ledger entries and receipts commit to the
+// ciphertext, since the contents are not known until then.
+
+// SealedDigest is the SHA-256 of a sealed ballot, in hex. The weight is
+// left in the clear, next to the ciphertext, and included as in Digest.
+func SealedDigest(electionID int, ballotID string, weight int, ephemeralKey, ciphertext string) string {
+	return sha256Hex(fmt.Sprintf(
+		"evoting-sealed-v1\nelection:%d\nballot:%s\n%sephemeral:%s\nciphertext:%s\n",
+		electionID, ballotID, weightLine(weight), ephemeralKey, ciphertext,
+	))
+}
+
+// sealedData binds a ciphertext to its ballot, so it cannot be passed off
+// as another one.
+func sealedData(electionID int, ballotID string) []byte {
+	return []byte(fmt.Sprintf("evoting-sealed-v1\nelection:%d\nballot:%s\n", electionID, ballotID))
+}
+
+// sealedSize is the length every ballot is padded to before it is sealed,
+// so that the length of a ciphertext does not give away how many choices
+// the ballot holds.
+const sealedSize = 4096
+
+// ErrTooLarge means a ballot holds too many choices to be sealed.
+var ErrTooLarge = errors.New("ballot is too large to seal")
+
+// Seal encrypts the ballot to the election's public key, stores it with the
+// sealed ballots and returns the digest its ledger entry records.
+func Seal(tx *sql.Tx, electionID int, ballotID string, weight int, publicKey *big.Int, ballot []Contest) (string, error) {
+	plaintext, err := json.Marshal(ballot)
+	if err != nil {
+		return "", err
+	}
+	if len(plaintext) > sealedSize {
+		return "", ErrTooLarge
+	}
+	// JSON ignores the trailing spaces when the ballot is opened.
+	plaintext = append(plaintext, bytes.Repeat([]byte(" "), sealedSize-len(plaintext))...)
+
+	ephemeral, sealed, err := elgamal.Seal(publicKey, plaintext, sealedData(electionID, ballotID))
+	if err != nil {
+		return "", err
+	}
+	ephemeralKey := ephemeral.Text(16)
+	ciphertext := base64.StdEncoding.EncodeToString(sealed)
+
+	_, err = tx.Exec(
+		`INSERT INTO sealed_ballots (id, election_id, ephemeral_key, ciphertext) VALUES (?, ?, ?, ?)`,
+		ballotID, electionID, ephemeralKey, ciphertext,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return SealedDigest(electionID, ballotID, weight, ephemeralKey, ciphertext), nil
+}
+
+// ErrUnopened means a sealed ballot could not be decrypted: too few
+// trustees have submitted their partial decryptions, or the ciphertext or
+// one of them has been changed.
+var ErrUnopened = errors.New("sealed ballot cannot be decrypted")
+
+type store interface {
+	querier
+	rowsQuerier
+}
+
+// OpenSealed decrypts a sealed ballot with the partial decryptions the
+// trustees have submitted for it.
+func OpenSealed(db store, ballotID string) ([]Contest, error) {
+	var electionID int
+	var ephemeralKey, ciphertext string
+	err := db.QueryRow(
+		`SELECT election_id, ephemeral_key, ciphertext FROM sealed_ballots WHERE id = ?`, ballotID,
+	).Scan(&electionID, &ephemeralKey, &ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT share_index, partial FROM decryption_shares WHERE ballot_id = ?`, ballotID)
+	if err != nil {
+		return nil, err
+	}
+	partials := make(map[int]*big.Int)
+	for rows.Next() {
+		var index int
+		var partial string
+		if err := rows.Scan(&index, &partial); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		value, err := elgamal.ParseElement(partial)
+		if err != nil {
+			rows.Close()
+			return nil, ErrUnopened
+		}
+		partials[index] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(partials) == 0 {
+		return nil, ErrUnopened
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, ErrUnopened
+	}
+	shared, err := elgamal.Combine(partials)
+	if err != nil {
+		return nil, ErrUnopened
+	}
+	plaintext, err := elgamal.Open(shared, sealed, sealedData(electionID, ballotID))
+	if err != nil {
+		return nil, ErrUnopened
+	}
+
+	var ballot []Contest
+	if err := json.Unmarshal(plaintext, &ballot); err != nil {
+		return nil, ErrUnopened
+	}
+	return ballot, nil
+}
+
+// StoredDigest recomputes the digest of a ballot as it is stored now: from
+// its ciphertext if it was sealed, and from the ballot box otherwise. A
+// sealed ballot that has been decrypted into the ballot box must decrypt to
+// what the ballot box holds. It returns sql.ErrNoRows if the ballot is
+// nowhere to be found and ErrInconsistent if its rows disagree.
+func StoredDigest(db store, electionID int, ballotID string) (string, error) {
+	counted, err := ReadBallot(db, ballotID)
+	if err != nil {
+		return "", err
+	}
+	weight, err := Weight(db, ballotID)
+	if err != nil {
+		return "", err
+	}
+
+	var ephemeralKey, ciphertext string
+	err = db.QueryRow(
+		`SELECT ephemeral_key, ciphertext FROM sealed_ballots WHERE id = ?`, ballotID,
+	).Scan(&ephemeralKey, &ciphertext)
+	if err == sql.ErrNoRows {
+		if len(counted) == 0 {
+			return "", sql.ErrNoRows
+		}
+		return Digest(electionID, ballotID, weight, counted), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(counted) > 0 {
+		opened, err := OpenSealed(db, ballotID)
+		if err == ErrUnopened {
+			return "", ErrInconsistent
+		}
+		if err != nil {
+			return "", err
+		}
+		if Digest(electionID, ballotID, weight, opened) != Digest(electionID, ballotID, weight, counted) {
+			return "", ErrInconsistent
+		}
+	}
+
+	return SealedDigest(electionID, ballotID, weight, ephemeralKey, ciphertext), nil
+}
@@ -0,0 +1,111 @@
+package ledger_test
+
+import (
+	"encoding/base64"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"evoting-app/internal/database"
+	"evoting-app/internal/elgamal"
+	"evoting-app/internal/ledger"
+)
+
+func TestOpenSealed(t *testing.T) {
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "evoting.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	result, err := db.Exec(
+		`INSERT INTO elections (title, description, start_date, end_date, status, created_by) VALUES ('Sealed', '', ?, ?, 'active', 1)`,
+		now.Add(-time.Hour), now.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	electionID64, _ := result.LastInsertId()
+	electionID := int(electionID64)
+
+	commitments, shares, err := elgamal.Deal(2, []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ballot := []ledger.Contest{{ContestID: 1, Choices: []string{"4", "2"}}}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Seal(tx, electionID, "b1", 1, commitments[0], ballot); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ephemeralKey, ciphertext string
+	if err := db.QueryRow(`SELECT ephemeral_key, ciphertext FROM sealed_ballots WHERE id = 'b1'`).Scan(&ephemeralKey, &ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := elgamal.ParseElement(ephemeralKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit := func(share elgamal.Share) {
+		t.Helper()
+		partial, proof, err := elgamal.PartialDecrypt(ephemeral, share)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(
+			`INSERT INTO decryption_shares (ballot_id, share_index, partial, proof) VALUES ('b1', ?, ?, ?)`,
+			share.Index, partial.Text(16), proof.String(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	submit(shares[0])
+	if _, err := ledger.OpenSealed(db, "b1"); err != ledger.ErrUnopened {
+		t.Errorf("with one partial decryption of two: got %v, want ErrUnopened", err)
+	}
+
+	submit(shares[2])
+	opened, err := ledger.OpenSealed(db, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened, ballot) {
+		t.Errorf("opened %+v, want %+v", opened, ballot)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)/2] ^= 1
+	if _, err := db.Exec(`UPDATE sealed_ballots SET ciphertext = ? WHERE id = 'b1'`, base64.StdEncoding.EncodeToString(sealed)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.OpenSealed(db, "b1"); err != ledger.ErrUnopened {
+		t.Errorf("with a changed ciphertext: got %v, want ErrUnopened", err)
+	}
+
+	// A partial decryption changed to another group element spoils it too.
+	if _, err := db.Exec(`UPDATE sealed_ballots SET ciphertext = ? WHERE id = 'b1'`, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE decryption_shares SET partial = ? WHERE share_index = 3`, big.NewInt(4).Text(16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.OpenSealed(db, "b1"); err != ledger.ErrUnopened {
+		t.Errorf("with a changed partial decryption: got %v, want ErrUnopened", err)
+	}
+}
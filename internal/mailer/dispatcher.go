@@ -0,0 +1,281 @@
+package mailer
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// maxAttempts is how many times a message is tried before it is given
+	// up as failed.
+	maxAttempts = 5
+	// batchSize caps how many messages one pass sends.
+	batchSize = 50
+)
+
+// Dispatcher periodically sends the messages waiting in the outbox. Like
+// the scheduler it keeps all of its state in the database, so messages
+// queued while the server was down go out once it is back.
+type Dispatcher struct {
+	db        *sql.DB
+	transport Transport
+	from      string
+	baseURL   string
+	templates map[string]*template.Template
+	interval  time.Duration
+	wake      chan struct{}
+	stop      chan struct{}
+}
+
+// New loads the message templates from web/templates/email, one file per
+// kind of message. Each defines a "subject" and a "body" template. baseURL
+// is where voters reach the application, for the link in their message.
+func New(db *sql.DB, transport Transport, from, baseURL string, interval time.Duration) (*Dispatcher, error) {
+	templates := make(map[string]*template.Template)
+	for _, kind := range []string{Invitation, Reminder} {
+		tmpl, err := template.ParseFiles(filepath.Join("web", "templates", "email", kind+".txt"))
+		if err != nil {
+			return nil, err
+		}
+		templates[kind] = tmpl
+	}
+
+	return &Dispatcher{
+		db:        db,
+		transport: transport,
+		from:      from,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		templates: templates,
+		interval:  interval,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+// Start runs a pass straight away and then one every interval, or sooner
+// when woken, until Stop is called.
+func (d *Dispatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := d.Run(time.Now()); err != nil {
+				log.Printf("Mailer: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-d.wake:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) Stop() {
+	close(d.stop)
+}
+
+// Wake asks for a pass now, so newly queued messages need not wait for the
+// next tick.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// outgoing is a queued message with what it takes to render it.
+type outgoing struct {
+	id       int
+	kind     string
+	attempts int
+	voterID  int
+	email    string
+	token    string
+	used     bool
+	revoked  bool
+	expired  bool
+	status   string
+	data     messageData
+}
+
+// messageData is what the message templates can use.
+type messageData struct {
+	Name        string
+	MemberID    string
+	Election    string
+	Description string
+	Token       string
+	Weight      int
+	VoteURL     string
+	Closes      string
+}
+
+// Run sends the messages due at now. A message that fails for a reason worth
+// retrying is tried again later, up to maxAttempts times; one the mail server
+// refuses outright is marked bounced. Messages that no longer make sense,
+// because the voter has voted, their token was revoked or has expired, or the
+// election has closed, are cancelled. A voter whose token was reissued is
+// sent the new one.
+func (d *Dispatcher) Run(now time.Time) error {
+	now = now.UTC().Truncate(time.Second)
+
+	rows, err := d.db.Query(`
+		SELECT o.id, o.kind, o.attempts, v.id, v.name, v.member_id, v.email,
+			COALESCE(t.token, ''), COALESCE(t.weight, 1), COALESCE(t.is_used, FALSE),
+			COALESCE(t.revoked_at IS NOT NULL, FALSE), COALESCE(t.expires_at <= ?, FALSE),
+			e.title, e.description, e.end_date, e.timezone, e.status
+		FROM email_outbox o
+		JOIN voters v ON v.id = o.voter_id
+		JOIN elections e ON e.id = o.election_id
+		LEFT JOIN voting_tokens t ON t.id = v.token_id
+		WHERE o.status = 'queued' AND (o.next_attempt_at IS NULL OR o.next_attempt_at <= ?)
+		ORDER BY o.id
+		LIMIT ?
+	`, now, now, batchSize)
+	if err != nil {
+		return err
+	}
+
+	var messages []outgoing
+	for rows.Next() {
+		var m outgoing
+		var endDate time.Time
+		var timezone string
+		err := rows.Scan(
+			&m.id, &m.kind, &m.attempts, &m.voterID, &m.data.Name, &m.data.MemberID, &m.email,
+			&m.token, &m.data.Weight, &m.used, &m.revoked, &m.expired,
+			&m.data.Election, &m.data.Description, &endDate, &timezone, &m.status,
+		)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if loc, err := time.LoadLocation(timezone); err == nil {
+			endDate = endDate.In(loc)
+		}
+		m.data.Closes = endDate.Format("Monday 2 January 2006, 15:04 MST")
+		m.data.Token = m.token
+		m.data.VoteURL = d.baseURL + "/vote?token=" + url.QueryEscape(m.token)
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		if err := d.deliver(m, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends one message and records how it went. The error it returns is
+// about recording; a failure to send is recorded against the message.
+func (d *Dispatcher) deliver(m outgoing, now time.Time) error {
+	switch {
+	case m.used:
+		return d.finish(m, "cancelled", "The voter has already voted")
+	case m.token == "":
+		return d.finish(m, "cancelled", "The voter has no token")
+	case m.revoked:
+		return d.finish(m, "cancelled", "The voter's token was revoked")
+	case m.expired:
+		return d.finish(m, "cancelled", "The voter's token has expired")
+	case m.email == "":
+		return d.finish(m, "cancelled", "The voter has no email address")
+	case m.status == "completed":
+		return d.finish(m, "cancelled", "The election has closed")
+	}
+
+	msg, err := d.render(m)
+	if err != nil {
+		log.Printf("Mailer: rendering %s %d: %v", m.kind, m.id, err)
+		return d.finish(m, "failed", "The message could not be rendered")
+	}
+
+	m.attempts++
+	if err := d.transport.Send(msg); err != nil {
+		switch {
+		case permanent(err):
+			return d.finish(m, "bounced", err.Error())
+		case m.attempts >= maxAttempts:
+			return d.finish(m, "failed", err.Error())
+		}
+		// Back off 1, 2, 4, 8... minutes between attempts
+		retry := now.Add(time.Minute << (m.attempts - 1))
+		_, err = d.db.Exec(
+			`UPDATE email_outbox SET attempts = ?, next_attempt_at = ?, last_error = ?, recipient = ? WHERE id = ?`,
+			m.attempts, retry, err.Error(), m.email, m.id,
+		)
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE email_outbox
+		SET status = 'sent', attempts = ?, last_error = '', recipient = ?, message_id = ?, sent_at = ?
+		WHERE id = ?
+	`, m.attempts, m.email, msg.MessageID, now, m.id)
+	if err != nil {
+		return err
+	}
+	if m.kind == Invitation {
+		if _, err := tx.Exec(`UPDATE voters SET delivered_at = COALESCE(delivered_at, ?) WHERE id = ?`, now, m.voterID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// finish takes a message out of the queue with its final status.
+func (d *Dispatcher) finish(m outgoing, status, reason string) error {
+	_, err := d.db.Exec(
+		`UPDATE email_outbox SET status = ?, attempts = ?, last_error = ?, recipient = ? WHERE id = ?`,
+		status, m.attempts, reason, m.email, m.id,
+	)
+	if err == nil && status != "cancelled" {
+		log.Printf("Mailer: %s %d to %s %s: %s", m.kind, m.id, m.email, status, reason)
+	}
+	return err
+}
+
+func (d *Dispatcher) render(m outgoing) (Message, error) {
+	tmpl, ok := d.templates[m.kind]
+	if !ok {
+		return Message{}, fmt.Errorf("no template for %q", m.kind)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", m.data); err != nil {
+		return Message{}, err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", m.data); err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		From:      d.from,
+		To:        m.email,
+		Subject:   strings.Join(strings.Fields(subject.String()), " "),
+		Body:      strings.TrimSpace(body.String()) + "\n",
+		MessageID: newMessageID(d.from),
+	}, nil
+}
@@ -0,0 +1,171 @@
+// Package mailer emails voters their tokens. Messages wait in the
+// email_outbox table until a Dispatcher renders and sends them through a
+// Transport, retrying failures and recording each voter's delivery status.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is one rendered email.
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	Body      string
+	MessageID string
+}
+
+// Transport hands a message to a mail server. SMTP is the transport the
+// application uses; anything else that can deliver a Message, such as a
+// provider's HTTP API, can stand in for it.
+type Transport interface {
+	Send(msg Message) error
+}
+
+// SMTP sends messages through an SMTP server, using STARTTLS when the
+// server offers it and authenticating only when a username is set. A local
+// catch-all server such as MailHog needs just the address.
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	Timeout  time.Duration // for connecting and sending one message; defaultTimeout if zero
+}
+
+// defaultTimeout bounds how long a message may take to send, so that a mail
+// server that stops answering cannot hold up the dispatcher.
+const defaultTimeout = 30 * time.Second
+
+func (s *SMTP) Send(msg Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	data, err := msg.bytes()
+	if err != nil {
+		return err
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	// What follows is smtp.SendMail, which has no way to set a deadline.
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(envelopeAddress(msg.From)); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// bytes encodes the message as a plain-text MIME email.
+func (msg Message) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", msg.From},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", msg.MessageID},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newMessageID makes a Message-ID in the sender's domain. The outbox keeps
+// it, so a bounce can be matched to the message it is about.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(envelopeAddress(from), "@"); at >= 0 {
+		domain = envelopeAddress(from)[at+1:]
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+// envelopeAddress takes the bare address out of a From header such as
+// "Election Committee <vote@example.org>".
+func envelopeAddress(from string) string {
+	if start := strings.LastIndex(from, "<"); start >= 0 {
+		if end := strings.LastIndex(from, ">"); end > start {
+			return from[start+1 : end]
+		}
+	}
+	return strings.TrimSpace(from)
+}
+
+// permanent reports whether the mail server refused a message outright (a
+// 5xx reply), in which case sending it again will not help. Anything else,
+// such as a 4xx reply or a dropped connection, is worth retrying.
+func permanent(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
@@ -0,0 +1,132 @@
+package mailer
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// The kinds of message the outbox holds.
+const (
+	Invitation = "invitation" // a voter's token and a link to vote with it
+	Reminder   = "reminder"   // a nudge to a voter who has not voted yet
+)
+
+// Every voter the outbox writes to is on the roll with an address and a
+// token they have not used, which has not been revoked or expired, and has
+// nothing already waiting to be sent.
+// Nobody is written to again at an address that has bounced.
+const queueVoters = `
+	INSERT INTO email_outbox (election_id, voter_id, kind, recipient)
+	SELECT v.election_id, v.id, ?, v.email
+	FROM voters v
+	JOIN voting_tokens t ON t.id = v.token_id
+	WHERE v.election_id = ? AND v.email <> '' AND t.is_used = FALSE
+		AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR datetime(t.expires_at) > datetime('now'))
+		AND NOT EXISTS (
+			SELECT 1 FROM email_outbox o
+			WHERE o.voter_id = v.id
+				AND (o.status = 'queued' OR (o.status = 'bounced' AND o.recipient = v.email))
+		)`
+
+// QueueInvitations queues an invitation for every voter of the election who
+// has not been sent one at their current address.
+func QueueInvitations(db *sql.DB, electionID int) (int, error) {
+	return queue(db, queueVoters+`
+		AND NOT EXISTS (
+			SELECT 1 FROM email_outbox o
+			WHERE o.voter_id = v.id AND o.kind = 'invitation' AND o.status = 'sent' AND o.recipient = v.email
+		)`, Invitation, electionID)
+}
+
+// QueueInvitation queues an invitation for one voter, whether or not they
+// have been sent one before.
+func QueueInvitation(db *sql.DB, electionID, voterID int) (int, error) {
+	return queue(db, queueVoters+` AND v.id = ?`, Invitation, electionID, voterID)
+}
+
+// QueueReminders queues a reminder for every voter of the election who has
+// not voted yet.
+func QueueReminders(db *sql.DB, electionID int) (int, error) {
+	return queue(db, queueVoters, Reminder, electionID)
+}
+
+func queue(db *sql.DB, query, kind string, args ...interface{}) (int, error) {
+	result, err := db.Exec(query, append([]interface{}{kind}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Bounce is a sent message that came back undelivered.
+type Bounce struct {
+	ElectionID int
+	MemberID   string
+	Recipient  string
+	Kind       string
+}
+
+// RecordBounce marks a sent message as bounced, found by its Message-ID or
+// else as the latest message sent to the address. A bounced invitation
+// means the voter does not have their token after all, so they are no
+// longer counted as delivered.
+func RecordBounce(db *sql.DB, messageID, address, reason string) ([]Bounce, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT o.id, o.voter_id, o.election_id, v.member_id, o.recipient, o.kind
+		FROM email_outbox o JOIN voters v ON v.id = o.voter_id
+		WHERE o.status = 'sent' AND o.message_id = ?`
+	args := []interface{}{messageID}
+	if messageID == "" {
+		// Each voter's latest message to the address
+		query = `
+			SELECT o.id, o.voter_id, o.election_id, v.member_id, o.recipient, o.kind
+			FROM email_outbox o JOIN voters v ON v.id = o.voter_id
+			WHERE o.status = 'sent' AND o.recipient = ? COLLATE NOCASE
+				AND o.id = (SELECT MAX(id) FROM email_outbox WHERE voter_id = o.voter_id AND status = 'sent')`
+		args = []interface{}{strings.TrimSpace(address)}
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	type sent struct {
+		id, voterID int
+		bounce      Bounce
+	}
+	var messages []sent
+	for rows.Next() {
+		var m sent
+		if err := rows.Scan(&m.id, &m.voterID, &m.bounce.ElectionID, &m.bounce.MemberID, &m.bounce.Recipient, &m.bounce.Kind); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var bounces []Bounce
+	for _, m := range messages {
+		if _, err := tx.Exec(`UPDATE email_outbox SET status = 'bounced', last_error = ? WHERE id = ?`, reason, m.id); err != nil {
+			return nil, err
+		}
+		if m.bounce.Kind == Invitation {
+			if _, err := tx.Exec(`UPDATE voters SET delivered_at = NULL WHERE id = ?`, m.voterID); err != nil {
+				return nil, err
+			}
+		}
+		bounces = append(bounces, m.bounce)
+	}
+
+	return bounces, tx.Commit()
+}
@@ -14,43 +14,134 @@ type User struct {
 }
 
 type Election struct {
-	ID          int       `json:"id" db:"id"`
-	Title       string    `json:"title" db:"title"`
-	Description string    `json:"description" db:"description"`
-	StartDate   time.Time `json:"start_date" db:"start_date"`
-	EndDate     time.Time `json:"end_date" db:"end_date"`
-	Status      string    `json:"status" db:"status"` // "draft", "active", "completed"
-	CreatedBy   int       `json:"created_by" db:"created_by"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID             int        `json:"id" db:"id"`
+	Title          string     `json:"title" db:"title"`
+	Description    string     `json:"description" db:"description"`
+	StartDate      time.Time  `json:"start_date" db:"start_date"`
+	EndDate        time.Time  `json:"end_date" db:"end_date"`
+	Timezone       string     `json:"timezone" db:"timezone"`               // IANA zone StartDate and EndDate are shown in
+	Status         string     `json:"status" db:"status"`                   // "draft", "active", "completed"
+	AutoStatus     bool       `json:"auto_status" db:"auto_status"`         // status follows StartDate and EndDate
+	VotingMethod   string     `json:"voting_method" db:"voting_method"`     // "plurality", "ranked", "stv" or "approval"
+	Encrypted      bool       `json:"encrypted" db:"encrypted"`             // ballots are sealed until trustees decrypt them
+	ResultsEmbargo bool       `json:"results_embargo" db:"results_embargo"` // tallies are hidden until the election has ended
+	Published      bool       `json:"published" db:"published"`             // results are on the public results page
+	TieBreak       string     `json:"tie_break" db:"tie_break"`             // "unresolved", "runoff" or "lot"
+	ParentID       int        `json:"parent_id" db:"parent_election_id"`    // the election this is a runoff of, 0 if none
+	Quorum         QuorumRule `json:"quorum"`
+	CreatedBy      int        `json:"created_by" db:"created_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Contest is one position on an election's ballot, such as chair or
+// treasurer. Every token casts one vote in each contest of its election.
+// QuorumRule is what an election's result needs to be valid.
+type QuorumRule struct {
+	Percent          int    `json:"percent" db:"quorum_percent"`              // minimum turnout, 0 for none
+	Basis            string `json:"basis" db:"quorum_basis"`                  // "tokens" or "roll"
+	RegisteredVoters int    `json:"registered_voters" db:"registered_voters"` // size of the voter roll
+	MinWinningShare  int    `json:"min_winning_share" db:"min_winning_share"` // percent of counted ballots, 0 for none
+}
+
+type Contest struct {
+	ID            int         `json:"id" db:"id"`
+	ElectionID    int         `json:"election_id" db:"election_id"`
+	Title         string      `json:"title" db:"title"`
+	Description   string      `json:"description" db:"description"`
+	Kind          string      `json:"kind" db:"kind"`                     // "candidates" or "referendum"
+	PassThreshold string      `json:"pass_threshold" db:"pass_threshold"` // referendum threshold, e.g. "majority"
+	Seats         int         `json:"seats" db:"seats"`                   // number of candidates elected
+	MaxSelections int         `json:"max_selections" db:"max_selections"` // candidates a voter may choose
+	Order         int         `json:"order" db:"order"`
+	CreatedAt     time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at" db:"updated_at"`
+	Candidates    []Candidate `json:"candidates,omitempty" db:"-"`
 }
 
 type Candidate struct {
-	ID          int    `json:"id" db:"id"`
-	ElectionID  int    `json:"election_id" db:"election_id"`
-	Name        string `json:"name" db:"name"`
-	Description string `json:"description" db:"description"`
-	PhotoURL    string `json:"photo_url" db:"photo_url"`
-	Order       int    `json:"order" db:"order"`
+	ID          int       `json:"id" db:"id"`
+	ElectionID  int       `json:"election_id" db:"election_id"`
+	ContestID   int       `json:"contest_id" db:"contest_id"`
+	Name        string    `json:"name" db:"name"`
+	Stance      string    `json:"stance,omitempty" db:"stance"` // referendum option: "yes", "no" or "abstain"
+	Description string    `json:"description" db:"description"`
+	PhotoURL    string    `json:"photo_url" db:"photo_url"`
+	Order       int       `json:"order" db:"order"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 }
 
 type VotingToken struct {
-	ID         int       `json:"id" db:"id"`
-	ElectionID int       `json:"election_id" db:"election_id"`
-	Token      string    `json:"token" db:"token"`
-	IsUsed     bool      `json:"is_used" db:"is_used"`
-	UsedAt     *time.Time `json:"used_at" db:"used_at"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	ID           int        `json:"id" db:"id"`
+	ElectionID   int        `json:"election_id" db:"election_id"`
+	Token        string     `json:"token" db:"token"`
+	IsUsed       bool       `json:"is_used" db:"is_used"`
+	Weight       int        `json:"weight" db:"weight"` // votes the token casts
+	UsedAt       *time.Time `json:"used_at" db:"used_at"`
+	PrintBatch   int        `json:"print_batch" db:"print_batch"` // 0 if never printed
+	PrintSerial  int        `json:"print_serial" db:"print_serial"`
+	PrintedAt    *time.Time `json:"printed_at" db:"printed_at"`
+	ExpiresAt    *time.Time `json:"expires_at" db:"expires_at"` // nil if it never expires
+	Expired      bool       `json:"expired"`                    // past ExpiresAt when loaded
+	RevokedAt    *time.Time `json:"revoked_at" db:"revoked_at"`
+	RevokeReason string     `json:"revoked_reason" db:"revoked_reason"`
+	ReplacedBy   int        `json:"replaced_by" db:"replaced_by"` // the token reissued in its place, 0 if none
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Voter is a member on an election's voter roll and the token issued to
+// them.
+type Voter struct {
+	ID          int        `json:"id" db:"id"`
+	ElectionID  int        `json:"election_id" db:"election_id"`
+	MemberID    string     `json:"member_id" db:"member_id"`
+	Name        string     `json:"name" db:"name"`
+	Email       string     `json:"email" db:"email"`
+	Group       string     `json:"group" db:"group_name"`
+	Token       string     `json:"-"`      // empty if the token is gone
+	Weight      int        `json:"weight"` // votes the token casts
+	DeliveredAt *time.Time `json:"delivered_at" db:"delivered_at"`
+	Redeemed    bool       `json:"redeemed"`
+	RedeemedOn  *time.Time `json:"redeemed_on"` // the day, not the time
+	Revoked     bool       `json:"revoked"`     // the token was revoked and not reissued
+	Expired     bool       `json:"expired"`     // the token expired unused
+	LastEmail   *VoterMail `json:"last_email"`  // the latest message to the voter, if any
+	Reminders   int        `json:"reminders"`   // reminders sent
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// VoterMail is where a message to a voter stands in the email outbox.
+type VoterMail struct {
+	Kind      string     `json:"kind"`   // invitation or reminder
+	Status    string     `json:"status"` // queued, sent, failed, bounced or cancelled
+	Recipient string     `json:"recipient"`
+	Error     string     `json:"error"`
+	Attempts  int        `json:"attempts"`
+	SentAt    *time.Time `json:"sent_at"`
 }
 
 type Vote struct {
-	ID          int       `json:"id" db:"id"`
-	ElectionID  int       `json:"election_id" db:"election_id"`
-	CandidateID int       `json:"candidate_id" db:"candidate_id"`
-	TokenID     int       `json:"token_id" db:"token_id"`
-	VotedAt     time.Time `json:"voted_at" db:"voted_at"`
+	ID            int    `json:"id" db:"id"`
+	ElectionID    int    `json:"election_id" db:"election_id"`
+	ContestID     int    `json:"contest_id" db:"contest_id"`
+	ContestTitle  string `json:"contest_title" db:"contest_title"`
+	CandidateID   int    `json:"candidate_id" db:"candidate_id"`
+	CandidateName string `json:"candidate_name" db:"candidate_name"`
+	Blank         bool   `json:"blank" db:"-"` // deliberate abstention, no candidate
+	BallotID      string `json:"ballot_id" db:"ballot_id"`
+}
+
+// Trustee is a user holding one share of an encrypted election's key.
+type Trustee struct {
+	ElectionID int    `json:"election_id" db:"election_id"`
+	UserID     int    `json:"user_id" db:"user_id"`
+	Username   string `json:"username" db:"username"`
+	ShareIndex int    `json:"share_index" db:"share_index"`
+	Registered bool   `json:"registered" db:"-"` // the trustee has registered their own key
+	Dealt      bool   `json:"dealt" db:"-"`      // the trustee has dealt shares to the others
+	Confirmed  bool   `json:"confirmed" db:"-"`  // the trustee has proved they hold their share
+	Decrypted  bool   `json:"decrypted" db:"-"`  // the trustee has decrypted the ballots with it
 }
 
 type ElectionAdmin struct {
@@ -65,11 +156,203 @@ type VoteCount struct {
 	CandidateID   int    `json:"candidate_id" db:"candidate_id"`
 	CandidateName string `json:"candidate_name" db:"candidate_name"`
 	VoteCount     int    `json:"vote_count" db:"vote_count"`
+	Elected       bool   `json:"elected"`
 }
 
+// ElectionStats counts an election's tokens and ballots. The weighted
+// figures add up the tokens' and ballots' weights instead; they equal the
+// plain counts unless some token carries more than one vote.
 type ElectionStats struct {
-	TotalTokens     int `json:"total_tokens" db:"total_tokens"`
-	UsedTokens      int `json:"used_tokens" db:"used_tokens"`
-	TotalVotes      int `json:"total_votes" db:"total_votes"`
-	TotalCandidates int `json:"total_candidates" db:"total_candidates"`
+	TotalTokens      int  `json:"total_tokens" db:"total_tokens"`
+	UsedTokens       int  `json:"used_tokens" db:"used_tokens"`
+	TotalVotes       int  `json:"total_votes" db:"total_votes"`     // ballots cast, blank ones included
+	BlankBallots     int  `json:"blank_ballots" db:"blank_ballots"` // ballots left blank in every contest
+	TotalCandidates  int  `json:"total_candidates" db:"total_candidates"`
+	RegisteredVoters int  `json:"registered_voters"`                  // on the voter roll
+	TotalWeight      int  `json:"total_weight" db:"total_weight"`     // votes held by all tokens
+	UsedWeight       int  `json:"used_weight" db:"used_weight"`       // votes held by used tokens
+	WeightedVotes    int  `json:"weighted_votes" db:"weighted_votes"` // votes carried by the ballots cast
+	Weighted         bool `json:"weighted"`                           // some token carries more than one vote
+}
+
+// RunoffRow is one candidate's line in an instant-runoff round table.
+// Counts holds the candidate's votes in each round they took part in.
+type RunoffRow struct {
+	CandidateID   int    `json:"candidate_id"`
+	CandidateName string `json:"candidate_name"`
+	Counts        []int  `json:"counts"`
+	EliminatedIn  int    `json:"eliminated_in"` // round number, 0 if never eliminated
+}
+
+type RunoffReport struct {
+	Rounds    []int       `json:"rounds"` // round numbers, 1-based
+	Rows      []RunoffRow `json:"rows"`
+	Exhausted []int       `json:"exhausted"`
+	Winner    string      `json:"winner"`
+	WinnerID  int         `json:"winner_id"` // 0 if there is no outright winner
+	Tied      []string    `json:"tied"`
+	TiedIDs   []int       `json:"tied_ids"` // in the order of Tied
+}
+
+// STVRow is one candidate's line in an STV transfer table. Transfers and
+// Totals hold one formatted value per stage.
+type STVRow struct {
+	CandidateID   int      `json:"candidate_id"`
+	CandidateName string   `json:"candidate_name"`
+	Transfers     []string `json:"transfers"`
+	Totals        []string `json:"totals"`
+	ElectedIn     int      `json:"elected_in"`  // stage number, 0 if not elected
+	ExcludedIn    int      `json:"excluded_in"` // stage number, 0 if not excluded
+}
+
+type STVStage struct {
+	Number    int    `json:"number"`
+	Action    string `json:"action"`
+	Exhausted string `json:"exhausted"`
+}
+
+type STVReport struct {
+	Seats      int        `json:"seats"`
+	ValidVotes string     `json:"valid_votes"`
+	Quota      string     `json:"quota"`
+	Stages     []STVStage `json:"stages"`
+	Rows       []STVRow   `json:"rows"`
+	Elected    []string   `json:"elected"`
+}
+
+// ContestReport is the result of one contest, counted with the election's
+// voting method.
+type ContestReport struct {
+	Contest      Contest           `json:"contest"`
+	TotalBallots int               `json:"total_ballots"` // votes carried by the ballots, blank votes included
+	BlankVotes   int               `json:"blank_votes"`
+	VoteCounts   []VoteCount       `json:"vote_counts"`
+	Runoff       *RunoffReport     `json:"runoff,omitempty"`
+	STV          *STVReport        `json:"stv,omitempty"`
+	Referendum   *ReferendumReport `json:"referendum,omitempty"`
+	Tie          *TieReport        `json:"tie,omitempty"` // a tie for a winning place
+}
+
+// TieReport describes candidates tied for the last winning places of a
+// contest, and how the tie is settled under the election's tie-break rule.
+type TieReport struct {
+	CandidateIDs []int    `json:"candidate_ids"` // ascending
+	Candidates   []string `json:"candidates"`    // names, in the order of CandidateIDs
+	Seats        int      `json:"seats"`         // seats to fill from among them; in an STV count, places that go ahead
+	Rule         string   `json:"rule"`          // "unresolved", "runoff" or "lot"
+	Draw         *TieDraw `json:"draw,omitempty"`
+	Stage        int      `json:"stage,omitempty"`  // in an STV count, the stage the tie held up
+	Action       string   `json:"action,omitempty"` // in an STV count, "surplus" or "exclusion"
+}
+
+// TieDraw is a recorded lot drawing that settled a tie.
+type TieDraw struct {
+	Seed      string    `json:"seed"`
+	Order     []string  `json:"order"`   // tied candidates, first drawn first
+	Winners   []string  `json:"winners"` // the first Seats drawn
+	WinnerIDs []int     `json:"winner_ids"`
+	DrawnBy   string    `json:"-"` // username, kept off the public results feed
+	DrawnAt   time.Time `json:"drawn_at"`
+}
+
+// ReferendumReport is the outcome of a Yes/No question. Abstentions are
+// reported but do not count towards the threshold.
+type ReferendumReport struct {
+	YesLabel     string `json:"yes_label"`
+	NoLabel      string `json:"no_label"`
+	AbstainLabel string `json:"abstain_label,omitempty"`
+	Yes          int    `json:"yes"`
+	No           int    `json:"no"`
+	Abstain      int    `json:"abstain"`
+	Threshold    string `json:"threshold"` // e.g. "Two-thirds majority"
+	YesShare     string `json:"yes_share"` // Yes as a percentage of Yes and No
+	Carried      bool   `json:"carried"`
+}
+
+// ElectionReport gathers the results shown on the reports page and written
+// to report exports.
+type ElectionReport struct {
+	Stats         *ElectionStats  `json:"stats"`
+	Contests      []ContestReport `json:"contests"`
+	LedgerBallots int             `json:"ledger_ballots"`
+	LedgerHead    string          `json:"ledger_head"`      // hash of the ballot ledger's last entry
+	Sealed        *SealedTally    `json:"sealed,omitempty"` // encrypted elections only
+	Validity      *ResultValidity `json:"validity,omitempty"`
+}
+
+// ResultValidity is whether an election's result meets its quorum rule.
+type ResultValidity struct {
+	Status   string   `json:"status"` // "valid", "invalid" or "pending"
+	Reason   string   `json:"reason"`
+	Basis    string   `json:"basis"`           // "tokens" or "roll"
+	Eligible int      `json:"eligible"`        // votes held by the issued tokens, or registered voters
+	Turnout  float64  `json:"turnout"`         // percent of Eligible
+	Short    []string `json:"short,omitempty"` // contests whose winner fell short of the minimum share
+}
+
+// SealedTally is how far the trustees of an encrypted election have got
+// with making its key and decrypting its ballots.
+type SealedTally struct {
+	HasKey     bool `json:"has_key"` // the trustees have been chosen
+	Ballots    int  `json:"ballots"` // sealed ballots cast
+	Weight     int  `json:"weight"`  // votes they carry
+	Trustees   int  `json:"trustees"`
+	Threshold  int  `json:"threshold"`  // trustees needed to decrypt
+	Registered int  `json:"registered"` // trustees who have registered their own key
+	Dealt      int  `json:"dealt"`      // trustees who have dealt shares
+	Confirmed  int  `json:"confirmed"`  // trustees who have proved they hold their share
+	Decrypted  int  `json:"decrypted"`  // trustees who have decrypted
+	Opened     bool `json:"opened"`     // the ballots are in the ballot box and counted
+}
+
+// PublishedResults is what the public results page and its JSON feed show
+// of a completed election once an admin has published its results.
+type PublishedResults struct {
+	ElectionID    int                `json:"election_id"`
+	Title         string             `json:"title"`
+	Description   string             `json:"description"`
+	VotingMethod  string             `json:"voting_method"`
+	StartDate     time.Time          `json:"start_date"`
+	EndDate       time.Time          `json:"end_date"`
+	PublishedAt   time.Time          `json:"published_at"`
+	Turnout       Turnout            `json:"turnout"`
+	Contests      []PublishedContest `json:"contests"`
+	Validity      *ResultValidity    `json:"validity,omitempty"` // only if the election has a quorum rule
+	LedgerBallots int                `json:"ledger_ballots"`
+	LedgerHead    string             `json:"ledger_head"`
+}
+
+// Turnout is how many of the issued tokens were used to cast a ballot, and
+// for weighted elections how many of their votes.
+type Turnout struct {
+	Eligible           int     `json:"eligible"` // tokens issued
+	Ballots            int     `json:"ballots"`  // blank ballots included
+	BlankBallots       int     `json:"blank_ballots"`
+	Percentage         float64 `json:"percentage"`
+	Weighted           bool    `json:"weighted"`
+	EligibleVotes      int     `json:"eligible_votes"` // held by the issued tokens
+	Votes              int     `json:"votes"`          // carried by the ballots
+	WeightedPercentage float64 `json:"weighted_percentage"`
+}
+
+// PublishedContest is one contest's counts and outcome. Percentages are of
+// all the contest's ballots, blank ones included.
+type PublishedContest struct {
+	Title      string            `json:"title"`
+	Kind       string            `json:"kind"` // "candidates" or "referendum"
+	Seats      int               `json:"seats"`
+	Counted    string            `json:"counted"` // "votes", "approvals" or "first preferences"
+	Ballots    int               `json:"ballots"`
+	BlankVotes int               `json:"blank_votes"`
+	Candidates []PublishedCount  `json:"candidates"`
+	Winners    []string          `json:"winners"`
+	Tie        *TieReport        `json:"tie,omitempty"`
+	Referendum *ReferendumReport `json:"referendum,omitempty"`
+}
+
+type PublishedCount struct {
+	Name       string  `json:"name"`
+	Votes      int     `json:"votes"`
+	Percentage float64 `json:"percentage"`
+	Elected    bool    `json:"elected"`
 }
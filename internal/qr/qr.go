@@ -0,0 +1,489 @@
+// Package qr draws QR codes (ISO/IEC 18004) for the voting links printed on
+// token slips. It encodes text in byte mode at error correction level M,
+// which still scans with some 15% of the symbol smudged or torn, in the
+// smallest of versions 1 to 10 that fits: up to 213 bytes, plenty for a URL.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTooLong is returned for text that does not fit in a version 10 symbol.
+var ErrTooLong = errors.New("qr: text too long")
+
+// Code is an encoded QR symbol, without its quiet zone.
+type Code struct {
+	Size    int
+	modules [][]bool // [row][column], true for dark
+}
+
+// Dark reports whether the module at row y, column x is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// blockLayout is how a version's codewords split into error correction
+// blocks at level M: group 1 blocks have shortData data codewords and the
+// rest one more.
+type blockLayout struct {
+	eccPerBlock int
+	shortBlocks int
+	shortData   int
+	longBlocks  int
+}
+
+// levelM lists the block layout of versions 1 to 10 at level M, indexed by
+// version.
+var levelM = [...]blockLayout{
+	1:  {10, 1, 16, 0},
+	2:  {16, 1, 28, 0},
+	3:  {26, 1, 44, 0},
+	4:  {18, 2, 32, 0},
+	5:  {24, 2, 43, 0},
+	6:  {16, 4, 27, 0},
+	7:  {18, 4, 31, 0},
+	8:  {22, 2, 38, 2},
+	9:  {22, 3, 36, 2},
+	10: {26, 4, 43, 1},
+}
+
+// alignment lists the centre coordinates of each version's alignment
+// patterns, indexed by version.
+var alignment = [...][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+func (l blockLayout) dataCodewords() int {
+	return l.shortBlocks*l.shortData + l.longBlocks*(l.shortData+1)
+}
+
+// Encode encodes text as a QR code.
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+
+	version := 0
+	for v := 1; v < len(levelM); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*levelM[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	codewords := addErrorCorrection(encodeData(data, version), levelM[version])
+
+	c := newSymbol(version)
+	c.placeData(codewords)
+
+	// Use whichever mask leaves the symbol easiest to scan
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masking twice undoes it
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+
+	return &Code{Size: c.size, modules: c.modules}, nil
+}
+
+// encodeData lays text out as the data codewords of a version in byte
+// mode: the mode, the length, the bytes, a terminator and then padding.
+func encodeData(data []byte, version int) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	capacity := 8 * levelM[version].dataCodewords()
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return codewords
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 == 1)
+	}
+}
+
+// addErrorCorrection splits the data codewords into blocks, adds each
+// block's Reed-Solomon codewords and interleaves the lot.
+func addErrorCorrection(data []byte, layout blockLayout) []byte {
+	divisor := rsDivisor(layout.eccPerBlock)
+
+	var blocks, eccs [][]byte
+	for i := 0; i < layout.shortBlocks+layout.longBlocks; i++ {
+		n := layout.shortData
+		if i >= layout.shortBlocks {
+			n++
+		}
+		block := data[:n]
+		data = data[n:]
+		blocks = append(blocks, block)
+		eccs = append(eccs, rsRemainder(block, divisor))
+	}
+
+	var result []byte
+	for i := 0; i <= layout.shortData; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.eccPerBlock; i++ {
+		for _, ecc := range eccs {
+			result = append(result, ecc[i])
+		}
+	}
+	return result
+}
+
+// rsDivisor is the Reed-Solomon generator polynomial of the given degree,
+// the product of (x - 2^i) for i below it, leading coefficient dropped.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+	return result
+}
+
+// rsRemainder is data times x^degree modulo the divisor: its error
+// correction codewords.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// symbol is a QR code being drawn. Function modules, the patterns every
+// symbol carries, are never masked or overwritten with data.
+type symbol struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func newSymbol(version int) *symbol {
+	size := 17 + 4*version
+	s := &symbol{version: version, size: size}
+	s.modules = make([][]bool, size)
+	s.function = make([][]bool, size)
+	for y := range s.modules {
+		s.modules[y] = make([]bool, size)
+		s.function[y] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		s.set(6, i, i%2 == 0)
+		s.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with their separators
+	s.drawFinder(3, 3)
+	s.drawFinder(size-4, 3)
+	s.drawFinder(3, size-4)
+
+	// Alignment patterns, except where they would overlap a finder
+	centres := alignment[version]
+	for i, x := range centres {
+		for j, y := range centres {
+			last := len(centres) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					s.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn once the mask is chosen
+	s.drawFormat(0)
+
+	if version >= 7 {
+		s.drawVersion()
+	}
+	return s
+}
+
+func (s *symbol) set(x, y int, dark bool) {
+	s.modules[y][x] = dark
+	s.function[y][x] = true
+}
+
+func (s *symbol) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= s.size || y < 0 || y >= s.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			s.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawFormat draws the two copies of the format information: the error
+// correction level and mask, protected by a BCH code.
+func (s *symbol) drawFormat(mask int) {
+	const levelMBits = 0 // level M is 00
+	data := levelMBits<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		s.set(8, i, bit(i))
+	}
+	s.set(8, 7, bit(6))
+	s.set(8, 8, bit(7))
+	s.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		s.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		s.set(s.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		s.set(8, s.size-15+i, bit(i))
+	}
+	s.set(8, s.size-8, true) // the dark module
+}
+
+// drawVersion draws the two copies of the version information that
+// versions 7 and up carry.
+func (s *symbol) drawVersion() {
+	rem := s.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := s.version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a, b := s.size-11+i%3, i/3
+		s.set(a, b, dark)
+		s.set(b, a, dark)
+	}
+}
+
+// placeData fills the non-function modules with the codewords, most
+// significant bit first, in two-module-wide columns that zigzag up and down
+// from the bottom right corner, skipping the vertical timing pattern. Any
+// modules left over stay light.
+func (s *symbol) placeData(codewords []byte) {
+	i := 0
+	for right := s.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < s.size; vert++ {
+			y := vert
+			if upward {
+				y = s.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if s.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				s.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules the mask pattern selects.
+func (s *symbol) applyMask(mask int) {
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !s.function[y][x] {
+				s.modules[y][x] = !s.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard a masked symbol is to scan, by the four rules of
+// the standard: long runs of one colour, 2x2 blocks of one colour, patterns
+// that look like a finder, and an imbalance of dark and light.
+func (s *symbol) penalty() int {
+	total := 0
+	var rows, columns strings.Builder
+	dark := 0
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			if s.modules[y][x] {
+				rows.WriteByte('1')
+				dark++
+			} else {
+				rows.WriteByte('0')
+			}
+			if s.modules[x][y] {
+				columns.WriteByte('1')
+			} else {
+				columns.WriteByte('0')
+			}
+		}
+		rows.WriteByte('\n')
+		columns.WriteByte('\n')
+	}
+
+	for _, line := range strings.Split(rows.String()+columns.String(), "\n") {
+		run := 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				total += run - 2
+			}
+			run = 1
+		}
+		for _, pattern := range []string{"10111010000", "00001011101"} {
+			total += 40 * strings.Count(line, pattern)
+		}
+	}
+
+	for y := 0; y+1 < s.size; y++ {
+		for x := 0; x+1 < s.size; x++ {
+			c := s.modules[y][x]
+			if s.modules[y][x+1] == c && s.modules[y+1][x] == c && s.modules[y+1][x+1] == c {
+				total += 3
+			}
+		}
+	}
+
+	cells := s.size * s.size
+	deviation := abs(dark*20-cells*10) / cells // in steps of 5%
+	total += 10 * deviation
+
+	return total
+}
+
+// SVG draws the code as an SVG image with the standard four-module quiet
+// zone, scaled to fit whatever box it is placed in.
+func (c *Code) SVG() string {
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	size := c.Size + 8
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+			`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, size, size, path.String(),
+	)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
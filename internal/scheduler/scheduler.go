@@ -0,0 +1,123 @@
+// Package scheduler moves elections from draft to active to completed as
+// their voting windows open and close.
+package scheduler
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Scheduler periodically brings the status of every election with
+// auto_status set in line with its start and end dates. All of its state
+// lives in the database, so a restarted server picks up where it left off
+// and applies any transition it missed while it was down.
+type Scheduler struct {
+	db       *sql.DB
+	interval time.Duration
+	stop     chan struct{}
+}
+
+func New(db *sql.DB, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs a pass straight away and then one every interval until Stop is
+// called.
+func (s *Scheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.Run(time.Now()); err != nil {
+				log.Printf("Scheduler: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+type pendingElection struct {
+	id        int
+	title     string
+	status    string
+	startDate time.Time
+	endDate   time.Time
+}
+
+// Run applies the transitions due at now. Elections only move forward: a
+// draft whose window has opened becomes active, and a draft or active
+// election whose window has closed becomes completed.
+func (s *Scheduler) Run(now time.Time) error {
+	rows, err := s.db.Query(`
+		SELECT id, title, status, start_date, end_date
+		FROM elections
+		WHERE auto_status = TRUE AND status IN ('draft', 'active')
+	`)
+	if err != nil {
+		return err
+	}
+
+	var elections []pendingElection
+	for rows.Next() {
+		var e pendingElection
+		if err := rows.Scan(&e.id, &e.title, &e.status, &e.startDate, &e.endDate); err != nil {
+			rows.Close()
+			return err
+		}
+		elections = append(elections, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range elections {
+		next := nextStatus(e, now)
+		if next == e.status {
+			continue
+		}
+
+		// Only move the election if nobody changed it since it was read, so
+		// an admin's manual change made in the meantime wins.
+		result, err := s.db.Exec(
+			`UPDATE elections SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ? AND auto_status = TRUE`,
+			next, e.id, e.status,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		log.Printf("Scheduler: election %d (%s) moved from %s to %s", e.id, e.title, e.status, next)
+	}
+
+	return nil
+}
+
+func nextStatus(e pendingElection, now time.Time) string {
+	switch {
+	case !now.Before(e.endDate):
+		return "completed"
+	case !now.Before(e.startDate):
+		return "active"
+	default:
+		return e.status
+	}
+}
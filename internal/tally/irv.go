@@ -0,0 +1,140 @@
+package tally
+
+import "sort"
+
+// Ballot is one voter's ordered list of candidate IDs, most preferred first,
+// with the number of votes it carries, at least 1.
+type Ballot struct {
+	Choices []int
+	Weight  int
+}
+
+// Round is the state of an instant-runoff count after one round of counting.
+type Round struct {
+	Counts     map[int]int // votes held by each continuing candidate
+	Eliminated []int       // candidates excluded at the end of this round
+	Exhausted  int         // votes of ballots with no continuing preference left
+}
+
+// RunoffResult is the outcome of an instant-runoff count.
+type RunoffResult struct {
+	Rounds []Round
+	Winner int   // 0 when no single winner could be determined
+	Tied   []int // candidates still tied when the count could not continue
+}
+
+// InstantRunoff counts ranked ballots using instant-runoff voting.
+//
+// Each round, every ballot counts its weight for its highest-ranked continuing
+// candidate. A candidate holding a majority of the non-exhausted votes wins; otherwise
+// the candidate with the fewest votes is eliminated and their ballots transfer
+// to the next continuing preference. A tie for last place is broken by the
+// candidates' totals in earlier rounds, most recent first. If they are still
+// tied, all of them are eliminated together, unless that would leave nobody,
+// in which case the count stops and the remaining candidates are reported as
+// tied.
+func InstantRunoff(candidates []int, ballots []Ballot) RunoffResult {
+	continuing := make(map[int]bool, len(candidates))
+	for _, id := range candidates {
+		continuing[id] = true
+	}
+
+	var result RunoffResult
+	for len(continuing) > 0 {
+		round := Round{Counts: make(map[int]int, len(continuing))}
+		for id := range continuing {
+			round.Counts[id] = 0
+		}
+
+		active := 0
+		for _, ballot := range ballots {
+			if choice, ok := topChoice(ballot, continuing); ok {
+				round.Counts[choice] += ballot.Weight
+				active += ballot.Weight
+			} else {
+				round.Exhausted += ballot.Weight
+			}
+		}
+
+		for id, votes := range round.Counts {
+			if votes*2 > active {
+				result.Winner = id
+			}
+		}
+		if result.Winner != 0 || len(continuing) == 1 {
+			if result.Winner == 0 {
+				for id := range continuing {
+					result.Winner = id
+				}
+			}
+			result.Rounds = append(result.Rounds, round)
+			return result
+		}
+
+		lowest := lowestCandidates(round.Counts, result.Rounds)
+		if len(lowest) == len(continuing) {
+			result.Tied = sortedIDs(lowest)
+			result.Rounds = append(result.Rounds, round)
+			return result
+		}
+
+		round.Eliminated = sortedIDs(lowest)
+		for _, id := range lowest {
+			delete(continuing, id)
+		}
+		result.Rounds = append(result.Rounds, round)
+	}
+
+	return result
+}
+
+// topChoice returns the highest-ranked candidate on the ballot that is still
+// in the count.
+func topChoice(ballot Ballot, continuing map[int]bool) (int, bool) {
+	for _, id := range ballot.Choices {
+		if continuing[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// lowestCandidates returns the candidates with the fewest votes in counts,
+// narrowed by comparing their totals in previous rounds (latest first).
+func lowestCandidates(counts map[int]int, previous []Round) []int {
+	lowest := minimumOf(counts, nil)
+	for i := len(previous) - 1; i >= 0 && len(lowest) > 1; i-- {
+		lowest = minimumOf(previous[i].Counts, lowest)
+	}
+	return lowest
+}
+
+// minimumOf returns the IDs holding the smallest count, restricted to among
+// when it is non-nil.
+func minimumOf(counts map[int]int, among []int) []int {
+	if among == nil {
+		for id := range counts {
+			among = append(among, id)
+		}
+	}
+
+	var lowest []int
+	fewest := -1
+	for _, id := range among {
+		votes := counts[id]
+		switch {
+		case fewest == -1 || votes < fewest:
+			fewest = votes
+			lowest = []int{id}
+		case votes == fewest:
+			lowest = append(lowest, id)
+		}
+	}
+	return lowest
+}
+
+func sortedIDs(ids []int) []int {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	return sorted
+}
@@ -0,0 +1,93 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstantRunoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []int
+		ballots    []Ballot
+		rounds     int
+		eliminated [][]int // by round
+		exhausted  []int   // by round
+		winner     int
+		tied       []int
+	}{
+		{
+			name:       "majority in the first round",
+			candidates: []int{1, 2, 3},
+			ballots:    concat(ballots(4, 1), ballots(2, 2), ballots(1, 3)),
+			rounds:     1,
+			eliminated: [][]int{nil},
+			exhausted:  []int{0},
+			winner:     1,
+		},
+		{
+			name:       "transfers decide the winner",
+			candidates: []int{1, 2, 3},
+			ballots:    concat(ballots(4, 1), ballots(3, 2), ballots(2, 3, 2)),
+			rounds:     2,
+			eliminated: [][]int{{3}, nil},
+			exhausted:  []int{0, 0},
+			winner:     2,
+		},
+		{
+			name:       "everyone tied for last is eliminated at once",
+			candidates: []int{1, 2, 3, 4},
+			ballots:    concat(ballots(4, 1), ballots(3, 2), ballots(1, 3), ballots(1, 4)),
+			rounds:     2,
+			eliminated: [][]int{{3, 4}, nil},
+			exhausted:  []int{0, 2},
+			winner:     1,
+		},
+		{
+			// 2 and 3 tie on 3 votes in round 2; 3 had fewer in round 1.
+			name:       "tie for last broken by an earlier round",
+			candidates: []int{1, 2, 3, 4},
+			ballots: []Ballot{
+				{Choices: []int{1}, Weight: 5},
+				{Choices: []int{2}, Weight: 3},
+				{Choices: []int{3}, Weight: 2},
+				{Choices: []int{4, 3}, Weight: 1},
+			},
+			rounds:     3,
+			eliminated: [][]int{{4}, {3}, nil},
+			exhausted:  []int{0, 0, 3},
+			winner:     1,
+		},
+		{
+			name:       "a tie between everyone left stops the count",
+			candidates: []int{1, 2, 3},
+			ballots:    concat(ballots(2, 1), ballots(2, 2), ballots(1, 3)),
+			rounds:     2,
+			eliminated: [][]int{{3}, nil},
+			exhausted:  []int{0, 1},
+			tied:       []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := InstantRunoff(tt.candidates, tt.ballots)
+			if len(result.Rounds) != tt.rounds {
+				t.Fatalf("%d rounds, want %d", len(result.Rounds), tt.rounds)
+			}
+			for i, round := range result.Rounds {
+				if !reflect.DeepEqual(round.Eliminated, tt.eliminated[i]) {
+					t.Errorf("round %d eliminated %v, want %v", i+1, round.Eliminated, tt.eliminated[i])
+				}
+				if round.Exhausted != tt.exhausted[i] {
+					t.Errorf("round %d exhausted %d, want %d", i+1, round.Exhausted, tt.exhausted[i])
+				}
+			}
+			if result.Winner != tt.winner {
+				t.Errorf("winner %d, want %d", result.Winner, tt.winner)
+			}
+			if !reflect.DeepEqual(result.Tied, tt.tied) {
+				t.Errorf("tied %v, want %v", result.Tied, tt.tied)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package tally
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"strconv"
+)
+
+// DrawLots orders tied candidates by lot, first drawn first.
+//
+// The draw is determined entirely by the seed: each candidate's ticket is
+// the SHA-256 hash of the seed, a colon and the candidate's ID in decimal,
+// and tickets are drawn from the lowest hash up. Publishing the seed and the
+// tied candidates lets anyone repeat the draw and check its outcome.
+func DrawLots(seed string, candidates []int) []int {
+	tickets := make(map[int][]byte, len(candidates))
+	for _, id := range candidates {
+		sum := sha256.Sum256([]byte(seed + ":" + strconv.Itoa(id)))
+		tickets[id] = sum[:]
+	}
+
+	order := append([]int(nil), candidates...)
+	sort.Slice(order, func(i, j int) bool {
+		if c := bytes.Compare(tickets[order[i]], tickets[order[j]]); c != 0 {
+			return c < 0
+		}
+		return order[i] < order[j]
+	})
+	return order
+}
@@ -0,0 +1,30 @@
+package tally
+
+// Threshold is the share of Yes votes a motion needs to carry, as a fraction
+// of the Yes and No votes cast. Abstentions are not part of the base.
+type Threshold struct {
+	Num, Den int
+	Strict   bool // Yes must exceed the fraction rather than reach it
+}
+
+// Common thresholds.
+var (
+	SimpleMajority = Threshold{Num: 1, Den: 2, Strict: true}
+	ThreeFifths    = Threshold{Num: 3, Den: 5}
+	TwoThirds      = Threshold{Num: 2, Den: 3}
+	ThreeQuarters  = Threshold{Num: 3, Den: 4}
+	Unanimous      = Threshold{Num: 1, Den: 1}
+)
+
+// Carried reports whether yes out of yes+no votes meets the threshold. A
+// motion with no Yes or No votes does not carry.
+func (t Threshold) Carried(yes, no int) bool {
+	total := yes + no
+	if total == 0 {
+		return false
+	}
+	if t.Strict {
+		return yes*t.Den > total*t.Num
+	}
+	return yes*t.Den >= total*t.Num
+}
@@ -0,0 +1,280 @@
+package tally
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Scale is the number of fixed-point units in one vote. STV counts keep vote
+// values as integers of 1/Scale of a vote, i.e. five decimal places.
+const Scale = 100000
+
+// FormatValue renders a fixed-point vote value as a decimal number, dropping
+// trailing zeros.
+func FormatValue(value int64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	whole, frac := value/Scale, value%Scale
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	s := fmt.Sprintf("%s%d.%05d", sign, whole, frac)
+	for s[len(s)-1] == '0' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// STVStage is one stage of a Single Transferable Vote count: the first
+// count, a surplus transfer or an exclusion.
+type STVStage struct {
+	Action    string        // "first", "surplus", "exclusion" or "remaining"
+	Candidate int           // candidate whose votes were transferred, 0 if none
+	Totals    map[int]int64 // each candidate's votes after the stage
+	Transfers map[int]int64 // change in each candidate's votes during the stage
+	Exhausted int64         // value no longer held by any candidate, including rounding loss
+	Elected   []int         // candidates elected at this stage
+}
+
+// STVResult is the outcome of a Single Transferable Vote count.
+type STVResult struct {
+	Quota      int64 // Droop quota, in fixed-point units
+	ValidVotes int64 // total value of ballots with at least one preference
+	Stages     []STVStage
+	Elected    []int   // in order of election
+	Tie        *STVTie // the first tie only the order of the candidates could break
+}
+
+// STVTie is a tie an STV count could only break by the order the candidates
+// were given in, as they had the same votes at every stage so far.
+type STVTie struct {
+	Stage      int    // index into Stages of the stage the tie was broken for
+	Action     string // "surplus" or "exclusion"
+	Candidates []int  // the tied candidates, in the order they were given
+}
+
+type stvPaper struct {
+	ballot Ballot
+	value  int64
+}
+
+// STV counts ranked ballots for the given number of seats using the Single
+// Transferable Vote with the Droop quota, floor(valid / (seats + 1)) + 1.
+//
+// Every ballot starts out worth its weight in votes. Surpluses are
+// transferred with the weighted inclusive Gregory method: every ballot held
+// by an elected candidate moves on to its next continuing preference at
+// value × surplus / total, truncated to five decimal places.
+// The amount lost to truncation is counted as exhausted. One surplus is
+// transferred per stage, largest first. When no surplus remains, the
+// candidate with the fewest votes is excluded and all their ballots move on
+// at their current value. Ties, whether for the largest surplus or the fewest
+// votes, are broken by the candidates' totals at the most recent earlier
+// stage where they differed, and then by the order of candidates (the
+// candidate listed later loses); the first tie that needs the order is
+// recorded in the result. Once the number of continuing candidates equals
+// the number of seats left, they are all elected.
+func STV(candidates []int, ballots []Ballot, seats int) STVResult {
+	order := make(map[int]int, len(candidates))
+	for i, id := range candidates {
+		order[id] = i
+	}
+
+	continuing := make(map[int]bool, len(candidates))
+	piles := make(map[int][]stvPaper, len(candidates))
+	for _, id := range candidates {
+		continuing[id] = true
+	}
+
+	var result STVResult
+	totals := make(map[int]int64, len(candidates))
+	for _, ballot := range ballots {
+		if choice, ok := topChoice(ballot, continuing); ok {
+			value := int64(ballot.Weight) * Scale
+			piles[choice] = append(piles[choice], stvPaper{ballot: ballot, value: value})
+			totals[choice] += value
+			result.ValidVotes += value
+		}
+	}
+	if seats < 1 {
+		seats = 1
+	}
+	result.Quota = (result.ValidVotes/Scale/int64(seats+1) + 1) * Scale
+
+	first := STVStage{Action: "first", Transfers: copyTotals(totals, candidates)}
+	var pending []int // elected candidates whose surplus is still to transfer
+
+	// electReached moves every continuing candidate at or above the quota to
+	// the elected list, largest first.
+	electReached := func(stage *STVStage) {
+		var reached []int
+		for _, id := range candidates {
+			if continuing[id] && totals[id] >= result.Quota {
+				reached = append(reached, id)
+			}
+		}
+		sortByTotal(reached, totals, result.Stages, order)
+		for _, id := range reached {
+			delete(continuing, id)
+			result.Elected = append(result.Elected, id)
+			stage.Elected = append(stage.Elected, id)
+			if totals[id] > result.Quota {
+				pending = append(pending, id)
+			}
+		}
+	}
+
+	// transfer moves the papers in from's pile to their next continuing
+	// preference, each at value × num / den.
+	transfer := func(from int, num, den int64) {
+		for _, paper := range piles[from] {
+			value := mulDiv(paper.value, num, den)
+			if choice, ok := topChoice(paper.ballot, continuing); ok && value > 0 {
+				piles[choice] = append(piles[choice], stvPaper{ballot: paper.ballot, value: value})
+				totals[choice] += value
+			}
+		}
+		piles[from] = nil
+	}
+
+	finish := func(stage STVStage, before map[int]int64) {
+		stage.Totals = copyTotals(totals, candidates)
+		if stage.Transfers == nil {
+			stage.Transfers = make(map[int]int64, len(candidates))
+			for _, id := range candidates {
+				stage.Transfers[id] = totals[id] - before[id]
+			}
+		}
+		held := int64(0)
+		for _, id := range candidates {
+			held += totals[id]
+		}
+		stage.Exhausted = result.ValidVotes - held
+		result.Stages = append(result.Stages, stage)
+	}
+
+	electReached(&first)
+	finish(first, nil)
+
+	for len(result.Elected) < seats && len(continuing) > 0 {
+		before := copyTotals(totals, candidates)
+
+		if len(continuing) <= seats-len(result.Elected) {
+			stage := STVStage{Action: "remaining"}
+			var rest []int
+			for _, id := range candidates {
+				if continuing[id] {
+					rest = append(rest, id)
+				}
+			}
+			sortByTotal(rest, totals, result.Stages, order)
+			for _, id := range rest {
+				delete(continuing, id)
+				result.Elected = append(result.Elected, id)
+				stage.Elected = append(stage.Elected, id)
+			}
+			finish(stage, before)
+			break
+		}
+
+		var stage STVStage
+		if len(pending) > 0 {
+			sortByTotal(pending, totals, result.Stages, order)
+			from := pending[0]
+			result.noteTie("surplus", from, pending, totals, order)
+			pending = pending[1:]
+			surplus := totals[from] - result.Quota
+			stage = STVStage{Action: "surplus", Candidate: from}
+			transfer(from, surplus, totals[from])
+			totals[from] = result.Quota
+		} else {
+			var standing []int
+			for _, id := range candidates {
+				if continuing[id] {
+					standing = append(standing, id)
+				}
+			}
+			sortByTotal(standing, totals, result.Stages, order)
+			lowest := standing[len(standing)-1]
+			result.noteTie("exclusion", lowest, standing, totals, order)
+			delete(continuing, lowest)
+			stage = STVStage{Action: "exclusion", Candidate: lowest}
+			transfer(lowest, 1, 1)
+			totals[lowest] = 0
+		}
+
+		electReached(&stage)
+		finish(stage, before)
+	}
+
+	return result
+}
+
+// noteTie records a tie for the stage about to be counted if chosen, picked
+// from ids, could only be told apart from another of them by their order,
+// unless an earlier tie has been recorded already.
+func (r *STVResult) noteTie(action string, chosen int, ids []int, totals map[int]int64, order map[int]int) {
+	if r.Tie != nil {
+		return
+	}
+	var tied []int
+	for _, id := range ids {
+		if totals[id] == totals[chosen] && sameHistory(id, chosen, r.Stages) {
+			tied = append(tied, id)
+		}
+	}
+	if len(tied) < 2 {
+		return
+	}
+	sort.Slice(tied, func(i, j int) bool { return order[tied[i]] < order[tied[j]] })
+	r.Tie = &STVTie{Stage: len(r.Stages), Action: action, Candidates: tied}
+}
+
+// sameHistory reports whether a and b had the same total at every stage.
+func sameHistory(a, b int, stages []STVStage) bool {
+	for _, stage := range stages {
+		if stage.Totals[a] != stage.Totals[b] {
+			return false
+		}
+	}
+	return true
+}
+
+// mulDiv returns a × b / c, truncated, for 0 ≤ a, b ≤ c. The product is
+// taken in 128 bits, since weighted ballots can carry values large enough to
+// overflow it in 64.
+func mulDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	quo, _ := bits.Div64(hi, lo, uint64(c))
+	return int64(quo)
+}
+
+func copyTotals(totals map[int]int64, candidates []int) map[int]int64 {
+	copied := make(map[int]int64, len(candidates))
+	for _, id := range candidates {
+		copied[id] = totals[id]
+	}
+	return copied
+}
+
+// sortByTotal orders ids by current total, largest first, breaking ties by
+// the most recent earlier stage where the totals differed and then by
+// ballot order.
+func sortByTotal(ids []int, totals map[int]int64, stages []STVStage, order map[int]int) {
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if totals[a] != totals[b] {
+			return totals[a] > totals[b]
+		}
+		for k := len(stages) - 1; k >= 0; k-- {
+			if stages[k].Totals[a] != stages[k].Totals[b] {
+				return stages[k].Totals[a] > stages[k].Totals[b]
+			}
+		}
+		return order[a] < order[b]
+	})
+}
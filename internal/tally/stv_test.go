@@ -0,0 +1,162 @@
+package tally
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// ballots returns count unweighted ballots with the given preferences.
+func ballots(count int, choices ...int) []Ballot {
+	out := make([]Ballot, count)
+	for i := range out {
+		out[i] = Ballot{Choices: choices, Weight: 1}
+	}
+	return out
+}
+
+func concat(groups ...[]Ballot) []Ballot {
+	var out []Ballot
+	for _, group := range groups {
+		out = append(out, group...)
+	}
+	return out
+}
+
+func TestSTVQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		ballots []Ballot
+		seats   int
+		valid   int64
+		quota   int64
+	}{
+		{"single seat", ballots(10, 1), 1, 10, 6},
+		{"two seats", ballots(10, 1), 2, 10, 4},
+		{"three seats", ballots(10, 1), 3, 10, 3},
+		{"weights count", []Ballot{{Choices: []int{1}, Weight: 7}, {Choices: []int{2}, Weight: 4}}, 2, 11, 4},
+		{"blank ballots do not count", concat(ballots(9, 1), ballots(3)), 2, 9, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := STV([]int{1, 2}, tt.ballots, tt.seats)
+			if result.ValidVotes != tt.valid*Scale {
+				t.Errorf("valid votes %s, want %d", FormatValue(result.ValidVotes), tt.valid)
+			}
+			if result.Quota != tt.quota*Scale {
+				t.Errorf("quota %s, want %d", FormatValue(result.Quota), tt.quota)
+			}
+		})
+	}
+}
+
+func TestSTV(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []int
+		ballots    []Ballot
+		seats      int
+		stages     []string // action and candidate of each stage
+		exhausted  []int64  // after each stage
+		elected    []int
+		tie        *STVTie
+	}{
+		{
+			// 7 papers at 1 × 3/7 truncate to 0.42857 each, losing 0.00001.
+			name:       "surplus transfer with rounding loss",
+			candidates: []int{1, 2, 3, 4},
+			ballots:    concat(ballots(7, 1, 2), ballots(2, 3), ballots(2, 4)),
+			seats:      2,
+			stages:     []string{"first", "surplus 1", "exclusion 4", "exclusion 3", "remaining"},
+			exhausted:  []int64{0, 1, 200001, 400001, 400001},
+			elected:    []int{1, 2},
+			tie:        &STVTie{Stage: 2, Action: "exclusion", Candidates: []int{3, 4}},
+		},
+		{
+			// 2 and 3 tie on 3 votes at stage 3, but 3 had fewer at stage 1,
+			// so 3 is excluded even though it is listed first.
+			name:       "exclusion tie broken by an earlier stage",
+			candidates: []int{1, 3, 2, 4},
+			ballots: []Ballot{
+				{Choices: []int{1}, Weight: 5},
+				{Choices: []int{2}, Weight: 3},
+				{Choices: []int{3}, Weight: 2},
+				{Choices: []int{4, 3}, Weight: 1},
+			},
+			seats:     1,
+			stages:    []string{"first", "exclusion 4", "exclusion 3", "exclusion 2", "remaining"},
+			exhausted: []int64{0, 0, 300000, 600000, 600000},
+			elected:   []int{1},
+		},
+		{
+			name:       "tie for the first surplus",
+			candidates: []int{1, 2, 3, 4},
+			ballots:    concat(ballots(5, 1, 3), ballots(5, 2, 3), ballots(1, 3), ballots(1, 4)),
+			seats:      3,
+			stages:     []string{"first", "surplus 1", "surplus 2", "exclusion 4", "remaining"},
+			exhausted:  []int64{0, 0, 0, 100000, 100000},
+			elected:    []int{1, 2, 3},
+			tie:        &STVTie{Stage: 1, Action: "surplus", Candidates: []int{1, 2}},
+		},
+		{
+			name:       "remaining candidates fill the seats",
+			candidates: []int{1, 2, 3},
+			ballots:    []Ballot{{Choices: []int{1}, Weight: 2}, {Choices: []int{2}, Weight: 1}, {Choices: []int{3}, Weight: 1}},
+			seats:      3,
+			stages:     []string{"first", "remaining"},
+			exhausted:  []int64{0, 0},
+			elected:    []int{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := STV(tt.candidates, tt.ballots, tt.seats)
+
+			var stages []string
+			var exhausted []int64
+			for _, stage := range result.Stages {
+				action := stage.Action
+				if stage.Candidate != 0 {
+					action = fmt.Sprintf("%s %d", action, stage.Candidate)
+				}
+				stages = append(stages, action)
+				exhausted = append(exhausted, stage.Exhausted)
+			}
+			if !reflect.DeepEqual(stages, tt.stages) {
+				t.Errorf("stages %v, want %v", stages, tt.stages)
+			}
+			if !reflect.DeepEqual(exhausted, tt.exhausted) {
+				t.Errorf("exhausted %v, want %v", exhausted, tt.exhausted)
+			}
+			if !reflect.DeepEqual(result.Elected, tt.elected) {
+				t.Errorf("elected %v, want %v", result.Elected, tt.elected)
+			}
+			if !reflect.DeepEqual(result.Tie, tt.tie) {
+				t.Errorf("tie %+v, want %+v", result.Tie, tt.tie)
+			}
+		})
+	}
+}
+
+func TestSTVSurplusValues(t *testing.T) {
+	result := STV([]int{1, 2, 3, 4}, concat(ballots(7, 1, 2), ballots(2, 3), ballots(2, 4)), 2)
+	surplus := result.Stages[1]
+	if got := surplus.Transfers[2]; got != 299999 {
+		t.Errorf("transferred %s to candidate 2, want 2.99999", FormatValue(got))
+	}
+	if got := surplus.Totals[1]; got != result.Quota {
+		t.Errorf("candidate 1 kept %s, want the quota %s", FormatValue(got), FormatValue(result.Quota))
+	}
+}
+
+func TestSTVTieOrder(t *testing.T) {
+	// Listed the other way round, the other tied candidate is excluded, and
+	// the tie records the candidates in the order given.
+	result := STV([]int{1, 2, 4, 3}, concat(ballots(7, 1, 2), ballots(2, 3), ballots(2, 4)), 2)
+	if got := result.Stages[2].Candidate; got != 3 {
+		t.Errorf("excluded %d, want 3", got)
+	}
+	if want := []int{4, 3}; result.Tie == nil || !reflect.DeepEqual(result.Tie.Candidates, want) {
+		t.Errorf("tie %+v, want candidates %v", result.Tie, want)
+	}
+}
@@ -0,0 +1,211 @@
+// Package tokens makes voting tokens that people can type. Each format ends
+// in a check character, so a mistyped token is caught, and the voter told
+// to check it, before it is ever looked up.
+//
+// A token is stored in its canonical form. Normalize turns whatever a voter
+// typed into that form: case, spacing and dashes do not matter, and in
+// base32 tokens the letters O, I and L are read as the digits they look
+// like. Tokens issued before these formats, 32 hex digits without a check,
+// are still accepted as they are.
+package tokens
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The token formats.
+const (
+	// Base32 is 20 characters in groups of four, such as
+	// 7KQM-3XRT-9WHP-D2NF-6VAC, drawn from digits and letters except I, L,
+	// O and U. The last character is a check: 95 random bits in all.
+	Base32 = "base32"
+	// Words is eight words from a list of 256 and a ninth that checks them,
+	// the list's counterpart of a check digit, such as
+	// maple-river-stone-otter-plum-toast-wheat-koala-robin: 64 random bits.
+	Words = "words"
+)
+
+// Formats describes each format, for configuration and help text.
+var Formats = map[string]string{
+	Base32: "XXXX-XXXX-XXXX-XXXX-XXXX",
+	Words:  "nine words, such as maple-river-stone-otter-plum-toast-wheat-koala-robin",
+}
+
+// Reasons a typed token is turned away, worded for the voter.
+var (
+	ErrMalformed = errors.New("Check your token: it is not the right length or has characters a voting token never has")
+	ErrMistyped  = errors.New("Check your token: a character looks mistyped, as its check character does not match")
+	ErrWord      = errors.New("Check your token: one of its words is misspelt")
+	ErrWordOrder = errors.New("Check your token: its words look mistyped or out of order")
+)
+
+const (
+	base32Alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	base32Length   = 20
+	wordCount      = 8
+)
+
+// Generate makes a new token in the format.
+func Generate(format string) (string, error) {
+	switch format {
+	case Base32:
+		return generateBase32(), nil
+	case Words:
+		return generateWords(), nil
+	}
+	return "", fmt.Errorf("unknown token format %q", format)
+}
+
+func generateBase32() string {
+	random := make([]byte, base32Length-1)
+	rand.Read(random)
+
+	code := make([]byte, base32Length-1, base32Length)
+	for i, b := range random {
+		code[i] = base32Alphabet[b%32]
+	}
+	code = append(code, base32Alphabet[checkCharacter(code)])
+	return groupBase32(string(code))
+}
+
+func generateWords() string {
+	random := make([]byte, wordCount)
+	for {
+		rand.Read(random)
+		if check := wordCheck(random); check < len(wordList) {
+			words := make([]string, 0, wordCount+1)
+			for _, b := range random {
+				words = append(words, wordList[b])
+			}
+			return strings.Join(append(words, wordList[check]), "-")
+		}
+	}
+}
+
+// Normalize checks a typed token and returns it in the form it is stored
+// in. The error says what is wrong with it, for the voter.
+func Normalize(input string) (string, error) {
+	input = strings.TrimSpace(input)
+
+	if isLegacy(input) {
+		return strings.ToLower(input), nil
+	}
+
+	fields := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	})
+	// Even the shortest words token is longer than a base32 one, which can
+	// start with something that looks like a word, such as BARN. Past its
+	// five groups, it is words with the first misspelt.
+	code := strings.Join(fields, "")
+	if len(code) > base32Length && (len(fields) > 5 || wordIndex(fields[0]) >= 0) {
+		return normalizeWords(fields)
+	}
+	return normalizeBase32(code)
+}
+
+// isLegacy reports whether input is a token from before the formats: 32 hex
+// digits, with no check.
+func isLegacy(input string) bool {
+	if len(input) != 32 {
+		return false
+	}
+	for _, r := range input {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeBase32(code string) (string, error) {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(code)
+	if len(code) != base32Length {
+		return "", ErrMalformed
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(base32Alphabet, code[i]) < 0 {
+			return "", ErrMalformed
+		}
+	}
+	if base32Alphabet[checkCharacter([]byte(code[:base32Length-1]))] != code[base32Length-1] {
+		return "", ErrMistyped
+	}
+	return groupBase32(code), nil
+}
+
+func groupBase32(code string) string {
+	var groups []string
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+func normalizeWords(fields []string) (string, error) {
+	if len(fields) != wordCount+1 {
+		return "", ErrMalformed
+	}
+
+	indexes := make([]byte, len(fields))
+	for i, word := range fields {
+		index := wordIndex(word)
+		if index < 0 {
+			return "", ErrWord
+		}
+		indexes[i] = byte(index)
+	}
+	if wordCheck(indexes[:wordCount]) != int(indexes[wordCount]) {
+		return "", ErrWordOrder
+	}
+	return strings.Join(fields, "-"), nil
+}
+
+func wordIndex(word string) int {
+	for i, w := range wordList {
+		if w == word {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkCharacter is the check character's position in the alphabet. Each
+// character's position is read as an element of GF(32), and the check is
+// their sum weighted by successive powers of a generator, the check itself
+// having weight 1. Since the weights are all different and nonzero, it
+// catches any one character mistyped and any two characters swapped,
+// which the Luhn mod 32 algorithm does not for 0 and Z.
+func checkCharacter(code []byte) int {
+	check := 0
+	for _, c := range code {
+		check = gfTimesX(check) ^ strings.IndexByte(base32Alphabet, c)
+	}
+	return gfTimesX(check)
+}
+
+// gfTimesX multiplies an element of GF(32) by x, the generator, modulo the
+// primitive polynomial x^5 + x^2 + 1.
+func gfTimesX(a int) int {
+	a <<= 1
+	if a&32 != 0 {
+		a ^= 0x25
+	}
+	return a
+}
+
+// wordCheck is the place on the list of the check word: the sum of each
+// word's place weighted by its position, modulo the prime 257. Since every
+// weight is below 257, it catches any one word changed and any two words
+// swapped. A sum of 256 has no word; generateWords draws again.
+func wordCheck(indexes []byte) int {
+	sum := 0
+	for i, index := range indexes {
+		sum += (i + 1) * int(index)
+	}
+	return sum % 257
+}
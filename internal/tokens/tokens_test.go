@@ -0,0 +1,162 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeGenerated(t *testing.T) {
+	for _, format := range []string{Base32, Words} {
+		for i := 0; i < 100; i++ {
+			token, err := Generate(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Normalize(token)
+			if err != nil || got != token {
+				t.Fatalf("Normalize(%q) = %q, %v; want it unchanged", token, got, err)
+			}
+		}
+	}
+}
+
+func TestNormalizeBase32Typing(t *testing.T) {
+	token, err := Generate(Base32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lower case, no dashes, spaces and letters that look like digits.
+	typed := " " + strings.ToLower(strings.ReplaceAll(token, "-", " ")) + " "
+	typed = strings.NewReplacer("0", "o", "1", "l").Replace(typed)
+	if got, err := Normalize(typed); err != nil || got != token {
+		t.Errorf("Normalize(%q) = %q, %v; want %q", typed, got, err, token)
+	}
+}
+
+func TestBase32CatchesTypos(t *testing.T) {
+	for n := 0; n < 20; n++ {
+		token, err := Generate(Base32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := []byte(strings.ReplaceAll(token, "-", ""))
+
+		for i := range code {
+			for j := 0; j < len(base32Alphabet); j++ {
+				if base32Alphabet[j] == code[i] {
+					continue
+				}
+				typo := append([]byte(nil), code...)
+				typo[i] = base32Alphabet[j]
+				if _, err := Normalize(string(typo)); err != ErrMistyped {
+					t.Fatalf("%s with character %d typed as %c: got %v, want ErrMistyped", token, i+1, base32Alphabet[j], err)
+				}
+			}
+		}
+
+		for i := 0; i+1 < len(code); i++ {
+			if code[i] == code[i+1] {
+				continue
+			}
+			swapped := append([]byte(nil), code...)
+			swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+			if _, err := Normalize(string(swapped)); err != ErrMistyped {
+				t.Fatalf("%s with characters %d and %d swapped: got %v, want ErrMistyped", token, i+1, i+2, err)
+			}
+		}
+	}
+}
+
+// TestBase32CatchesEverySwap checks every pair of characters in every pair
+// of neighbouring places, including the pairs the Luhn mod 32 algorithm
+// misses, such as 0 and Z.
+func TestBase32CatchesEverySwap(t *testing.T) {
+	code := []byte(strings.Repeat("7", base32Length-1))
+	for i := 0; i+1 < len(code); i++ {
+		for a := 0; a < len(base32Alphabet); a++ {
+			for b := a + 1; b < len(base32Alphabet); b++ {
+				code[i], code[i+1] = base32Alphabet[a], base32Alphabet[b]
+				check := checkCharacter(code)
+				code[i], code[i+1] = base32Alphabet[b], base32Alphabet[a]
+				if checkCharacter(code) == check {
+					t.Fatalf("swapping %c and %c at %d is not caught", base32Alphabet[a], base32Alphabet[b], i+1)
+				}
+			}
+		}
+		code[i], code[i+1] = '7', '7'
+	}
+	// The last character swapped with the check character itself.
+	for a := 0; a < len(base32Alphabet); a++ {
+		code[len(code)-1] = base32Alphabet[a]
+		check := checkCharacter(code)
+		if check == a {
+			continue
+		}
+		swapped := append(append([]byte(nil), code[:len(code)-1]...), base32Alphabet[check], base32Alphabet[a])
+		if _, err := Normalize(string(swapped)); err != ErrMistyped {
+			t.Fatalf("swapping the check character with %c: got %v, want ErrMistyped", base32Alphabet[a], err)
+		}
+	}
+}
+
+func TestWordsCatchTypos(t *testing.T) {
+	for n := 0; n < 20; n++ {
+		token, err := Generate(Words)
+		if err != nil {
+			t.Fatal(err)
+		}
+		words := strings.Split(token, "-")
+
+		for i, word := range words {
+			for k := range word {
+				for c := byte('a'); c <= 'z'; c++ {
+					if c == word[k] {
+						continue
+					}
+					typo := append([]string(nil), words...)
+					typo[i] = word[:k] + string(c) + word[k+1:]
+					if _, err := Normalize(strings.Join(typo, "-")); err != ErrWord && err != ErrWordOrder {
+						t.Fatalf("%s with %q typed as %q: got %v, want a misspelt or mistyped word", token, word, typo[i], err)
+					}
+				}
+			}
+			for _, other := range wordList {
+				if other == word {
+					continue
+				}
+				typo := append([]string(nil), words...)
+				typo[i] = other
+				if _, err := Normalize(strings.Join(typo, "-")); err != ErrWordOrder {
+					t.Fatalf("%s with %q typed as %q: got %v, want ErrWordOrder", token, word, other, err)
+				}
+			}
+		}
+
+		for i := 0; i+1 < len(words); i++ {
+			if words[i] == words[i+1] {
+				continue
+			}
+			swapped := append([]string(nil), words...)
+			swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+			if _, err := Normalize(strings.Join(swapped, "-")); err != ErrWordOrder {
+				t.Fatalf("%s with words %d and %d swapped: got %v, want ErrWordOrder", token, i+1, i+2, err)
+			}
+		}
+	}
+}
+
+func TestNormalizeLegacy(t *testing.T) {
+	for _, token := range []string{"14744a6480cc8fd3b28d029c1905e12f", "14744A6480CC8FD3B28D029C1905E12F", " 14744a6480cc8fd3b28d029c1905e12f\n"} {
+		if got, err := Normalize(token); err != nil || got != "14744a6480cc8fd3b28d029c1905e12f" {
+			t.Errorf("Normalize(%q) = %q, %v; want the legacy token in lower case", token, got, err)
+		}
+	}
+}
+
+func TestNormalizeMalformed(t *testing.T) {
+	for _, input := range []string{"", " ", "\t\n", "----", "- - -", strings.Repeat("-", 40), "7KQM", "not a token at all", "7KQM-3XRT-9WHP-D2NF-6VA!"} {
+		if _, err := Normalize(input); err != ErrMalformed && err != ErrWord {
+			t.Errorf("Normalize(%q): got %v, want it turned away as malformed", input, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package tokens
+
+// wordList holds the words of word tokens, one per byte value. They are
+// short, everyday and distinct, so that a misspelt word is unlikely to be
+// another word on the list.
+var wordList = [256]string{
+	"acorn", "actor", "adobe", "agent", "alarm", "album", "alley", "amber", "angle", "ankle",
+	"apple", "apron", "arena", "armor", "arrow", "aspen", "atlas", "attic", "audio", "award",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil", "basin", "beach",
+	"beard", "bench", "berry", "bison", "blade", "blaze", "bloom", "board", "boat", "booth",
+	"brave", "bread", "brick", "brook", "brush", "bugle", "cabin", "cable", "camel", "candy",
+	"canoe", "cargo", "cedar", "chair", "chalk", "charm", "chess", "chief", "chime", "cider",
+	"cliff", "clock", "cloud", "clover", "coast", "cobra", "cocoa", "comet", "coral", "couch",
+	"crane", "creek", "crown", "curve", "daisy", "dance", "delta", "denim", "desk", "diary",
+	"dock", "donut", "dove", "dragon", "dream", "drum", "eagle", "easel", "echo", "elbow",
+	"elder", "ember", "fable", "falcon", "feast", "fence", "ferry", "fiber", "field", "fig",
+	"flame", "flute", "forest", "fossil", "fox", "frost", "fruit", "gala", "garden", "gecko",
+	"giant", "ginger", "glade", "globe", "glove", "goose", "grape", "gravel", "guava", "guide",
+	"harbor", "harp", "hazel", "heron", "hiker", "hippo", "honey", "hotel", "igloo", "iris",
+	"island", "ivory", "jacket", "jazz", "jelly", "jewel", "judge", "juice", "kayak", "kettle",
+	"kiosk", "kitten", "koala", "label", "ladder", "lemon", "lilac", "lime", "linen", "lizard",
+	"llama", "lobby", "lotus", "lunar", "mango", "maple", "marble", "meadow", "melon", "mint",
+	"mocha", "moose", "motor", "mural", "nectar", "novel", "oasis", "ocean", "olive", "onion",
+	"opera", "orbit", "otter", "owl", "paddle", "panda", "paper", "parrot", "pastel", "peach",
+	"pearl", "pebble", "pepper", "piano", "pilot", "pixel", "planet", "plaza", "plum", "polar",
+	"poppy", "prism", "pulse", "puppy", "quartz", "quest", "radar", "raft", "rain", "raven",
+	"ribbon", "river", "robin", "rocket", "rose", "ruby", "saddle", "salad", "salmon", "sandal",
+	"satin", "scarf", "shell", "silver", "sketch", "slope", "smile", "snow", "sofa", "solar",
+	"spark", "spice", "spoon", "spruce", "squid", "stone", "storm", "sugar", "summit", "swan",
+	"syrup", "table", "tango", "teapot", "tiger", "timber", "toast", "topaz", "torch", "tulip",
+	"tunnel", "turtle", "valley", "velvet", "violet", "voyage", "wafer", "walnut", "water",
+	"whale", "wheat", "willow", "window", "wizard", "yacht", "zebra",
+}
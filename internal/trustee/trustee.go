@@ -0,0 +1,299 @@
+// Package trustee is what the trustees of an encrypted election run on
+// their own machines, and the files they exchange with the server for it.
+// A trustee downloads a Bundle from their Key Shares page, works on it with
+// their own secret key, and uploads the result; their secret key and their
+// share of the election key never leave the machine.
+//
+// The election key is made in two rounds. Every trustee first registers a
+// key of their own, then deals shares of a secret of their own to all the
+// trustees, each share sealed to its recipient's key. The election's
+// secret is the sum of the dealt secrets and a trustee's share of it the
+// sum of the shares dealt to them, so nobody, the server included, ever
+// holds it. Each trustee then proves they can work out their share, and
+// once the election is completed uses it to partially decrypt every ballot.
+package trustee
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"evoting-app/internal/elgamal"
+)
+
+// Bundle is what a trustee is given to work on: the election's trustees
+// and, as the key ceremony goes on, the dealings and the sealed ballots.
+type Bundle struct {
+	ElectionID int            `json:"election_id"`
+	Index      int            `json:"index"` // the share index of the trustee the bundle is for
+	Threshold  int            `json:"threshold"`
+	Trustees   map[int]string `json:"trustees"`           // every trustee's own public key, by share index
+	Dealings   []Dealing      `json:"dealings,omitempty"` // once every trustee has dealt, with only the shares dealt to Index
+	Ballots    []SealedBallot `json:"ballots,omitempty"`  // once the election is completed
+}
+
+// Dealing is one trustee's part of the election key: commitments to their
+// sharing polynomial, whose first one is their part of the public key, and
+// a share for every trustee, sealed to that trustee's own key.
+type Dealing struct {
+	ElectionID  int                    `json:"election_id"`
+	Dealer      int                    `json:"dealer"`
+	Commitments []string               `json:"commitments"`
+	Shares      map[int]EncryptedShare `json:"shares"`
+}
+
+// EncryptedShare is a share sealed to the key of the trustee it is dealt
+// to.
+type EncryptedShare struct {
+	EphemeralKey string `json:"ephemeral_key"`
+	Ciphertext   string `json:"ciphertext"` // base64
+}
+
+// SealedBallot is what a trustee needs of a sealed ballot to decrypt their
+// part of it.
+type SealedBallot struct {
+	ID           string `json:"id"`
+	EphemeralKey string `json:"ephemeral_key"`
+}
+
+// Confirmation proves that a trustee can work out their share of the
+// election key, and so that every share dealt to them was good.
+type Confirmation struct {
+	ElectionID int    `json:"election_id"`
+	Index      int    `json:"index"`
+	Proof      string `json:"proof"`
+}
+
+// Decryption is a trustee's partial decryption of every sealed ballot of an
+// election.
+type Decryption struct {
+	ElectionID int       `json:"election_id"`
+	Index      int       `json:"index"`
+	Partials   []Partial `json:"partials"`
+}
+
+// Partial is a trustee's partial decryption of one ballot, with the proof
+// that it was made with their share.
+type Partial struct {
+	BallotID string `json:"ballot_id"`
+	Partial  string `json:"partial"`
+	Proof    string `json:"proof"`
+}
+
+// GenerateKey creates a trustee's own key pair, returning the secret to keep
+// and the public key to register, both in hex.
+func GenerateKey() (string, string, error) {
+	secret, public, err := elgamal.GenerateKey()
+	if err != nil {
+		return "", "", err
+	}
+	return secret.Text(16), public.Text(16), nil
+}
+
+// ParseSecretKey reads a secret key written by GenerateKey.
+func ParseSecretKey(s string) (*big.Int, error) {
+	secret, err := elgamal.ParseExponent(s)
+	if err != nil {
+		return nil, errors.New("this is not a trustee secret key")
+	}
+	return secret, nil
+}
+
+// Fingerprint is a short digest of a trustee's public key, for the
+// trustees to compare with each other over another channel before they
+// deal: a server handing out a key of its own in place of a trustee's
+// could read the shares dealt to that trustee.
+func Fingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(publicKey))))
+	digits := hex.EncodeToString(sum[:8])
+	return digits[0:4] + "-" + digits[4:8] + "-" + digits[8:12] + "-" + digits[12:16]
+}
+
+// Indices returns the share indices of the bundle's trustees in order.
+func (b *Bundle) Indices() []int {
+	indices := make([]int, 0, len(b.Trustees))
+	for index := range b.Trustees {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Deal makes the trustee's dealing: a random secret, shared so that any
+// threshold of the trustees can use it, with every share sealed to the key
+// its trustee registered.
+func Deal(b *Bundle) (*Dealing, error) {
+	indices := b.Indices()
+	keys := make(map[int]*big.Int, len(indices))
+	for _, index := range indices {
+		key, err := elgamal.ParseElement(b.Trustees[index])
+		if err != nil {
+			return nil, fmt.Errorf("the public key of trustee #%d is not valid", index)
+		}
+		keys[index] = key
+	}
+
+	commitments, shares, err := elgamal.Deal(b.Threshold, indices)
+	if err != nil {
+		return nil, err
+	}
+
+	dealing := &Dealing{ElectionID: b.ElectionID, Dealer: b.Index, Shares: make(map[int]EncryptedShare)}
+	for _, c := range commitments {
+		dealing.Commitments = append(dealing.Commitments, c.Text(16))
+	}
+	for _, share := range shares {
+		ephemeral, sealed, err := elgamal.Seal(keys[share.Index], []byte(share.Value.Text(16)), shareData(b.ElectionID, b.Index, share.Index))
+		if err != nil {
+			return nil, err
+		}
+		dealing.Shares[share.Index] = EncryptedShare{
+			EphemeralKey: ephemeral.Text(16),
+			Ciphertext:   base64.StdEncoding.EncodeToString(sealed),
+		}
+	}
+
+	return dealing, nil
+}
+
+// Check makes sure a dealing has the shape the election needs: one
+// commitment per trustee needed to decrypt, each a group element, and a
+// well-formed share for every trustee. Whether the shares match the
+// commitments only their recipients can tell. It returns the commitments.
+func (d *Dealing) Check(threshold int, indices []int) ([]*big.Int, error) {
+	if len(d.Commitments) != threshold {
+		return nil, fmt.Errorf("the dealing should have %d commitments, not %d", threshold, len(d.Commitments))
+	}
+	commitments := make([]*big.Int, len(d.Commitments))
+	for i, c := range d.Commitments {
+		element, err := elgamal.ParseElement(c)
+		if err != nil {
+			return nil, fmt.Errorf("commitment %d of the dealing is not valid", i+1)
+		}
+		commitments[i] = element
+	}
+
+	if len(d.Shares) != len(indices) {
+		return nil, fmt.Errorf("the dealing should have a share for each of the %d trustees", len(indices))
+	}
+	for _, index := range indices {
+		share, ok := d.Shares[index]
+		if !ok {
+			return nil, fmt.Errorf("the dealing has no share for trustee #%d", index)
+		}
+		if _, err := elgamal.ParseElement(share.EphemeralKey); err != nil {
+			return nil, fmt.Errorf("the share for trustee #%d is not valid", index)
+		}
+		if _, err := base64.StdEncoding.DecodeString(share.Ciphertext); err != nil {
+			return nil, fmt.Errorf("the share for trustee #%d is not valid", index)
+		}
+	}
+
+	return commitments, nil
+}
+
+// Share opens the shares dealt to the trustee, checks each against its
+// dealer's commitments and adds them up into the trustee's share of the
+// election key. An error names a dealer whose share is not good.
+func Share(b *Bundle, secret *big.Int) (elgamal.Share, error) {
+	if len(b.Dealings) == 0 || len(b.Dealings) != len(b.Trustees) {
+		return elgamal.Share{}, errors.New("not every trustee has dealt yet")
+	}
+
+	values := make([]*big.Int, 0, len(b.Dealings))
+	for _, dealing := range b.Dealings {
+		bad := fmt.Errorf("the share dealt to you by trustee #%d is not good; tell the superadmin, who has to start the key over", dealing.Dealer)
+
+		commitments := make([]*big.Int, len(dealing.Commitments))
+		for i, c := range dealing.Commitments {
+			element, err := elgamal.ParseElement(c)
+			if err != nil {
+				return elgamal.Share{}, bad
+			}
+			commitments[i] = element
+		}
+		if len(commitments) != b.Threshold {
+			return elgamal.Share{}, bad
+		}
+
+		encrypted, ok := dealing.Shares[b.Index]
+		if !ok {
+			return elgamal.Share{}, bad
+		}
+		ephemeral, err := elgamal.ParseElement(encrypted.EphemeralKey)
+		if err != nil {
+			return elgamal.Share{}, bad
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encrypted.Ciphertext)
+		if err != nil {
+			return elgamal.Share{}, bad
+		}
+		plaintext, err := elgamal.OpenWith(secret, ephemeral, sealed, shareData(b.ElectionID, dealing.Dealer, b.Index))
+		if err != nil {
+			return elgamal.Share{}, fmt.Errorf("the share dealt to you by trustee #%d cannot be opened with this key; check that it is the key you registered for this election", dealing.Dealer)
+		}
+		value, err := elgamal.ParseExponent(string(plaintext))
+		if err != nil || !elgamal.CheckShare(commitments, elgamal.Share{Index: b.Index, Value: value}) {
+			return elgamal.Share{}, bad
+		}
+		values = append(values, value)
+	}
+
+	return elgamal.AddShares(b.Index, values), nil
+}
+
+// Confirm works out the trustee's share and proves they hold it.
+func Confirm(b *Bundle, secret *big.Int) (*Confirmation, error) {
+	share, err := Share(b, secret)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := elgamal.ProveShare(share)
+	if err != nil {
+		return nil, err
+	}
+	return &Confirmation{ElectionID: b.ElectionID, Index: b.Index, Proof: proof.String()}, nil
+}
+
+// Decrypt works out the trustee's share and partially decrypts every
+// sealed ballot of the bundle with it.
+func Decrypt(b *Bundle, secret *big.Int) (*Decryption, error) {
+	if len(b.Ballots) == 0 {
+		return nil, errors.New("there are no sealed ballots to decrypt yet")
+	}
+	share, err := Share(b, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	decryption := &Decryption{ElectionID: b.ElectionID, Index: b.Index}
+	for _, ballot := range b.Ballots {
+		ephemeral, err := elgamal.ParseElement(ballot.EphemeralKey)
+		if err != nil {
+			// Left without a partial decryption, so it will not decrypt.
+			continue
+		}
+		partial, proof, err := elgamal.PartialDecrypt(ephemeral, share)
+		if err != nil {
+			return nil, err
+		}
+		decryption.Partials = append(decryption.Partials, Partial{
+			BallotID: ballot.ID,
+			Partial:  partial.Text(16),
+			Proof:    proof.String(),
+		})
+	}
+
+	return decryption, nil
+}
+
+// shareData binds a dealt share to its election, dealer and recipient, so
+// it cannot be passed off as another one.
+func shareData(electionID, dealer, recipient int) []byte {
+	return []byte(fmt.Sprintf("evoting-share-v1\nelection:%d\ndealer:%d\nrecipient:%d\n", electionID, dealer, recipient))
+}
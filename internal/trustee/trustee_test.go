@@ -0,0 +1,164 @@
+package trustee
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"evoting-app/internal/elgamal"
+)
+
+// keyCeremony has three trustees, any two of whom can decrypt, register
+// their keys and deal. It returns their secret keys and a bundle for each
+// with every dealing in it.
+func keyCeremony(t *testing.T) (map[int]*big.Int, map[int]*Bundle) {
+	t.Helper()
+	secrets := make(map[int]*big.Int)
+	publics := make(map[int]string)
+	for index := 1; index <= 3; index++ {
+		secret, public, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secrets[index], err = ParseSecretKey(secret); err != nil {
+			t.Fatal(err)
+		}
+		publics[index] = public
+	}
+
+	bundles := make(map[int]*Bundle)
+	var dealings []Dealing
+	for index := range secrets {
+		bundles[index] = &Bundle{ElectionID: 7, Index: index, Threshold: 2, Trustees: publics}
+		dealing, err := Deal(bundles[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dealing.Check(2, bundles[index].Indices()); err != nil {
+			t.Fatal(err)
+		}
+		dealings = append(dealings, *dealing)
+	}
+	for _, bundle := range bundles {
+		bundle.Dealings = dealings
+	}
+	return secrets, bundles
+}
+
+// electionKey works out the public key and each trustee's verification key
+// from the dealers' commitments, as the server does.
+func electionKey(t *testing.T, dealings []Dealing, indices []int) (*big.Int, map[int]*big.Int) {
+	t.Helper()
+	var parts []*big.Int
+	keys := make(map[int][]*big.Int)
+	for _, dealing := range dealings {
+		commitments, err := dealing.Check(2, indices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, commitments[0])
+		for _, index := range indices {
+			keys[index] = append(keys[index], elgamal.Committed(commitments, index))
+		}
+	}
+	verification := make(map[int]*big.Int)
+	for index, k := range keys {
+		verification[index] = elgamal.Product(k)
+	}
+	return elgamal.Product(parts), verification
+}
+
+func TestRoundTrip(t *testing.T) {
+	secrets, bundles := keyCeremony(t)
+	indices := bundles[1].Indices()
+	publicKey, verification := electionKey(t, bundles[1].Dealings, indices)
+
+	for index, bundle := range bundles {
+		confirmation, err := Confirm(bundle, secrets[index])
+		if err != nil {
+			t.Fatalf("trustee #%d: %v", index, err)
+		}
+		proof, err := elgamal.ParseProof(confirmation.Proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !elgamal.CheckShareProof(verification[index], proof) {
+			t.Errorf("the confirmation of trustee #%d does not check", index)
+		}
+	}
+
+	plaintext := []byte("ballot")
+	ephemeral, sealed, err := elgamal.Seal(publicKey, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ballot := SealedBallot{ID: "b1", EphemeralKey: ephemeral.Text(16)}
+
+	partials := make(map[int]*big.Int)
+	for index, bundle := range bundles {
+		bundle.Ballots = []SealedBallot{ballot}
+		decryption, err := Decrypt(bundle, secrets[index])
+		if err != nil {
+			t.Fatalf("trustee #%d: %v", index, err)
+		}
+		if len(decryption.Partials) != 1 {
+			t.Fatalf("trustee #%d made %d partial decryptions, want 1", index, len(decryption.Partials))
+		}
+		partial, err := elgamal.ParseElement(decryption.Partials[0].Partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := elgamal.ParseProof(decryption.Partials[0].Proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !elgamal.CheckPartial(ephemeral, verification[index], partial, proof) {
+			t.Errorf("the partial decryption of trustee #%d does not check", index)
+		}
+		partials[index] = partial
+	}
+
+	for _, pair := range [][2]int{{1, 2}, {1, 3}, {2, 3}} {
+		shared, err := elgamal.Combine(map[int]*big.Int{pair[0]: partials[pair[0]], pair[1]: partials[pair[1]]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := elgamal.Open(shared, sealed, nil)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("trustees %v opened %q, %v; want %q", pair, opened, err, plaintext)
+		}
+	}
+	shared, err := elgamal.Combine(map[int]*big.Int{1: partials[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := elgamal.Open(shared, sealed, nil); err == nil {
+		t.Error("one trustee opened the ballot alone")
+	}
+}
+
+func TestShareNamesBadDealer(t *testing.T) {
+	secrets, bundles := keyCeremony(t)
+
+	// Trustee 2 deals trustee 1 a share sealed for another election.
+	bundle := bundles[1]
+	for i, dealing := range bundle.Dealings {
+		if dealing.Dealer == 2 {
+			wrong, err := Deal(&Bundle{ElectionID: 8, Index: 2, Threshold: 2, Trustees: bundle.Trustees})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dealing.Shares = map[int]EncryptedShare{1: wrong.Shares[1], 2: dealing.Shares[2], 3: dealing.Shares[3]}
+			bundle.Dealings[i] = dealing
+		}
+	}
+	if _, err := Share(bundle, secrets[1]); err == nil || !strings.Contains(err.Error(), "trustee #2") {
+		t.Errorf("got %v, want an error naming trustee #2", err)
+	}
+
+	// Another trustee's key opens nothing dealt to trustee 3.
+	if _, err := Share(bundles[3], secrets[2]); err == nil {
+		t.Error("trustee 3's shares opened with trustee 2's key")
+	}
+}
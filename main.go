@@ -1,19 +1,36 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	_ "time/tzdata" // election time zones must resolve without system zoneinfo
 
 	"evoting-app/internal/config"
 	"evoting-app/internal/database"
 	"evoting-app/internal/handlers"
+	"evoting-app/internal/ledger"
+	"evoting-app/internal/mailer"
 	"evoting-app/internal/middleware"
+	"evoting-app/internal/scheduler"
+	"evoting-app/internal/trustee"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
 func main() {
+	// "trustee <command>" is what the trustees of an encrypted election run
+	// on their own machines; it does not touch the database
+	if len(os.Args) > 1 && os.Args[1] == "trustee" {
+		os.Exit(runTrustee(os.Args[2:]))
+	}
+
 	// Load configuration
 	cfg := config.Load()
 
@@ -29,14 +46,40 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	// "verify-ledger [election-id...]" checks the ballot ledgers and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify-ledger" {
+		os.Exit(verifyLedgers(db, os.Args[2:]))
+	}
+
+	// Move elections between statuses as their voting windows open and close
+	sched := scheduler.New(db, cfg.SchedulerInterval)
+	sched.Start()
+	defer sched.Stop()
+
 	// Initialize session store
 	store := sessions.NewCookieStore([]byte(cfg.SessionSecret))
 
 	// Set session store for middleware
 	middleware.SetSessionStore(store)
 
+	// Send voters their tokens by email, if an SMTP server is configured
+	var mail *mailer.Dispatcher
+	if cfg.SMTPHost != "" {
+		transport := &mailer.SMTP{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		}
+		mail, err = mailer.New(db, transport, cfg.MailFrom, cfg.BaseURL, cfg.MailInterval)
+		if err != nil {
+			log.Fatal("Failed to load email templates:", err)
+		}
+		mail.Start()
+		defer mail.Stop()
+	}
+
 	// Initialize handlers
-	h := handlers.New(db, store)
+	h := handlers.New(db, store, mail, cfg.BaseURL, cfg.TokenFormat)
 
 	// Setup routes
 	r := mux.NewRouter()
@@ -49,12 +92,24 @@ func main() {
 	r.HandleFunc("/login", h.Login).Methods("GET", "POST")
 	r.HandleFunc("/vote", h.VoteForm).Methods("GET")
 	r.HandleFunc("/vote", h.SubmitVote).Methods("POST")
+	r.HandleFunc("/verify", h.VerifyReceipt).Methods("GET")
+	r.HandleFunc("/elections/{id}/results", h.PublicResults).Methods("GET")
+	r.HandleFunc("/elections/{id}/results.json", h.PublicResultsJSON).Methods("GET")
 	r.HandleFunc("/logout", h.Logout).Methods("POST")
+	r.HandleFunc("/mail/bounces", h.MailBounce(cfg.MailBounceSecret)).Methods("POST")
 
 	// Protected routes
 	protected := r.PathPrefix("/admin").Subrouter()
 	protected.Use(middleware.RequireAuth)
 
+	// Trustee routes, for any user holding a share of an election key
+	protected.HandleFunc("/trustee", h.TrusteeDashboard).Methods("GET")
+	protected.HandleFunc("/trustee/elections/{id}/bundle", h.TrusteeBundle).Methods("GET")
+	protected.HandleFunc("/trustee/elections/{id}/key", h.RegisterTrusteeKey).Methods("POST")
+	protected.HandleFunc("/trustee/elections/{id}/dealing", h.SubmitDealing).Methods("POST")
+	protected.HandleFunc("/trustee/elections/{id}/confirm", h.ConfirmKeyShare).Methods("POST")
+	protected.HandleFunc("/trustee/elections/{id}/decrypt", h.SubmitDecryption).Methods("POST")
+
 	// Superadmin routes
 	superadmin := protected.PathPrefix("/superadmin").Subrouter()
 	superadmin.Use(middleware.RequireSuperAdmin)
@@ -64,6 +119,9 @@ func main() {
 	superadmin.HandleFunc("/elections/{id}/edit", h.EditElection).Methods("GET", "POST")
 	superadmin.HandleFunc("/elections/{id}/delete", h.DeleteElection).Methods("POST")
 	superadmin.HandleFunc("/elections/{id}/assign-admin", h.AssignAdmin).Methods("GET", "POST")
+	superadmin.HandleFunc("/elections/{id}/trustees", h.ElectionTrustees).Methods("GET", "POST")
+	superadmin.HandleFunc("/elections/{id}/results-override", h.OverrideResultsEmbargo).Methods("POST")
+	superadmin.HandleFunc("/elections/{id}/runoff", h.CreateRunoff).Methods("GET", "POST")
 	superadmin.HandleFunc("/users", h.ManageUsers).Methods("GET")
 	superadmin.HandleFunc("/users/create", h.CreateUser).Methods("GET", "POST")
 
@@ -72,15 +130,210 @@ func main() {
 	admin.Use(middleware.RequireAdmin)
 	admin.HandleFunc("/dashboard", h.AdminDashboard).Methods("GET")
 	admin.HandleFunc("/elections", h.AdminElections).Methods("GET")
+	admin.HandleFunc("/elections/{id}/contests", h.ManageContests).Methods("GET")
+	admin.HandleFunc("/elections/{id}/contests/create", h.CreateContest).Methods("GET", "POST")
+	admin.HandleFunc("/elections/{id}/contests/{contest_id}/edit", h.EditContest).Methods("GET", "POST")
+	admin.HandleFunc("/elections/{id}/contests/{contest_id}/delete", h.DeleteContest).Methods("POST")
+	admin.HandleFunc("/elections/{id}/contests/{contest_id}/draw-lots", h.DrawTieLots).Methods("POST")
 	admin.HandleFunc("/elections/{id}/candidates", h.ManageCandidates).Methods("GET")
 	admin.HandleFunc("/elections/{id}/candidates/create", h.CreateCandidate).Methods("GET", "POST")
 	admin.HandleFunc("/elections/{id}/candidates/{candidate_id}/edit", h.EditCandidate).Methods("GET", "POST")
 	admin.HandleFunc("/elections/{id}/candidates/{candidate_id}/delete", h.DeleteCandidate).Methods("POST")
 	admin.HandleFunc("/elections/{id}/tokens", h.ManageTokens).Methods("GET")
 	admin.HandleFunc("/elections/{id}/tokens/generate", h.GenerateTokens).Methods("POST")
+	admin.HandleFunc("/elections/{id}/tokens/print", h.PrintTokens).Methods("POST")
+	admin.HandleFunc("/elections/{id}/tokens/batches/{batch}", h.TokenSlips).Methods("GET")
+	admin.HandleFunc("/elections/{id}/tokens/expiry", h.SetTokenExpiry).Methods("POST")
+	admin.HandleFunc("/elections/{id}/tokens/{token_id}/revoke", h.RevokeToken).Methods("POST")
+	admin.HandleFunc("/elections/{id}/tokens/{token_id}/reissue", h.ReissueToken).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters", h.ManageVoters).Methods("GET")
+	admin.HandleFunc("/elections/{id}/voters/import", h.ImportVoters).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/export", h.ExportVoters).Methods("GET")
+	admin.HandleFunc("/elections/{id}/voters/invite", h.SendInvitations).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/remind", h.SendReminders).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/{voter_id}/invite", h.SendInvitations).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/{voter_id}/delivered", h.MarkVoterDelivered).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/{voter_id}/reissue", h.ReissueToken).Methods("POST")
+	admin.HandleFunc("/elections/{id}/voters/{voter_id}/delete", h.DeleteVoter).Methods("POST")
 	admin.HandleFunc("/elections/{id}/votes", h.ManageVotes).Methods("GET")
 	admin.HandleFunc("/elections/{id}/reports", h.ElectionReports).Methods("GET")
+	admin.HandleFunc("/elections/{id}/reports/export", h.ExportElectionReport).Methods("GET")
+	admin.HandleFunc("/elections/{id}/results/publish", h.PublishResults).Methods("POST")
+	admin.HandleFunc("/elections/{id}/results/unpublish", h.UnpublishResults).Methods("POST")
+	admin.HandleFunc("/elections/{id}/ledger", h.VerifyElectionLedger).Methods("GET")
 
 	log.Printf("Server starting on port %s", cfg.Port)
 	log.Fatal(http.ListenAndServe(":"+cfg.Port, r))
 }
+
+// verifyLedgers recomputes the ballot ledger of each listed election, or of
+// every election, and prints the outcome. The exit code is 1 if any ledger
+// is broken and 2 if one could not be checked.
+func verifyLedgers(db *sql.DB, args []string) int {
+	var electionIDs []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid election ID %q\n", arg)
+			return 2
+		}
+		electionIDs = append(electionIDs, id)
+	}
+
+	if len(electionIDs) == 0 {
+		rows, err := db.Query(`SELECT id FROM elections ORDER BY id`)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list elections: %v\n", err)
+			return 2
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				fmt.Fprintf(os.Stderr, "Failed to list elections: %v\n", err)
+				return 2
+			}
+			electionIDs = append(electionIDs, id)
+		}
+		rows.Close()
+	}
+
+	status := 0
+	for _, id := range electionIDs {
+		result, err := ledger.Verify(db, id)
+		switch {
+		case err != nil:
+			fmt.Printf("Election %d: could not verify: %v\n", id, err)
+			status = 2
+		case result.OK():
+			fmt.Printf("Election %d: OK, %d ballots, head %s\n", id, result.Ballots, result.Head)
+		case result.BrokenAt > 0:
+			fmt.Printf("Election %d: BROKEN at entry %d of %d: %s\n", id, result.BrokenAt, result.Ballots, result.Problem)
+			if status == 0 {
+				status = 1
+			}
+		default:
+			fmt.Printf("Election %d: BROKEN: %s\n", id, result.Problem)
+			if status == 0 {
+				status = 1
+			}
+		}
+	}
+
+	return status
+}
+
+const trusteeUsage = `Usage:
+  trustee keygen <key-file>             make your own key and register the public key it prints
+  trustee deal <bundle>                 deal your shares; upload what it prints
+  trustee confirm <key-file> <bundle>   check the shares dealt to you; upload what it prints
+  trustee decrypt <key-file> <bundle>   decrypt your part of the ballots; upload what it prints
+`
+
+// runTrustee carries out a trustee's step of making an election key or
+// decrypting its ballots, on a bundle downloaded from their Key Shares
+// page. What it prints on standard output is the file to upload. The exit
+// code is 1 if the step failed and 2 on a usage error.
+func runTrustee(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, trusteeUsage)
+		return 2
+	}
+
+	switch command := args[0]; {
+	case command == "keygen" && len(args) == 2:
+		secret, public, err := trustee.GenerateKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to make a key: %v\n", err)
+			return 1
+		}
+		// Never overwrite a key, which may be the only copy of one in use
+		file, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the key: %v\n", err)
+			return 1
+		}
+		if _, err := fmt.Fprintln(file, secret); err != nil {
+			file.Close()
+			fmt.Fprintf(os.Stderr, "Failed to write the key: %v\n", err)
+			return 1
+		}
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the key: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Your secret key is in %s: keep it safe until the ballots are decrypted.\n", args[1])
+		fmt.Fprintf(os.Stderr, "Register this public key, fingerprint %s:\n", trustee.Fingerprint(public))
+		fmt.Println(public)
+		return 0
+
+	case command == "deal" && len(args) == 2:
+		bundle, err := readTrusteeBundle(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "Check these fingerprints with each trustee before you upload the dealing:")
+		for _, index := range bundle.Indices() {
+			fmt.Fprintf(os.Stderr, "  Trustee #%d: %s\n", index, trustee.Fingerprint(bundle.Trustees[index]))
+		}
+		dealing, err := trustee.Deal(bundle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to deal: %v\n", err)
+			return 1
+		}
+		return printTrusteeFile(dealing)
+
+	case (command == "confirm" || command == "decrypt") && len(args) == 3:
+		key, err := os.ReadFile(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the key: %v\n", err)
+			return 1
+		}
+		secret, err := trustee.ParseSecretKey(string(key))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[1], err)
+			return 1
+		}
+		bundle, err := readTrusteeBundle(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var result interface{}
+		if command == "confirm" {
+			result, err = trustee.Confirm(bundle, secret)
+		} else {
+			result, err = trustee.Decrypt(bundle, secret)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to %s: %v\n", command, err)
+			return 1
+		}
+		return printTrusteeFile(result)
+
+	default:
+		fmt.Fprint(os.Stderr, trusteeUsage)
+		return 2
+	}
+}
+
+func readTrusteeBundle(path string) (*trustee.Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the bundle: %v", err)
+	}
+	var bundle trustee.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("%s is not a bundle from the Key Shares page: %v", path, err)
+	}
+	return &bundle, nil
+}
+
+func printTrusteeFile(v interface{}) int {
+	if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the result: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -91,12 +91,19 @@ function initializeFormEnhancements() {
 // Vote form functionality
 function initializeVoteForm() {
     const candidateOptions = document.querySelectorAll('.candidate-option');
-    const radioInputs = document.querySelectorAll('input[name="candidate_id"]');
+    const radioInputs = document.querySelectorAll('input[type="radio"].candidate-radio');
+    
+    // A ballot can hold several contests, so selection is scoped to the
+    // candidate list the option belongs to.
+    function siblingOptions(element) {
+        const list = element.closest('.candidates-list');
+        return list ? list.querySelectorAll('.candidate-option') : candidateOptions;
+    }
     
     candidateOptions.forEach(option => {
         option.addEventListener('click', function() {
-            // Remove selected class from all options
-            candidateOptions.forEach(opt => opt.classList.remove('selected'));
+            // Remove selected class from the other options in this contest
+            siblingOptions(this).forEach(opt => opt.classList.remove('selected'));
             
             // Add selected class to clicked option
             this.classList.add('selected');
@@ -118,33 +125,13 @@ function initializeVoteForm() {
     // Handle radio button changes
     radioInputs.forEach(radio => {
         radio.addEventListener('change', function() {
-            candidateOptions.forEach(opt => opt.classList.remove('selected'));
             const parentOption = this.closest('.candidate-option');
             if (parentOption) {
+                siblingOptions(parentOption).forEach(opt => opt.classList.remove('selected'));
                 parentOption.classList.add('selected');
             }
         });
     });
-    
-    // Vote form validation
-    const voteForm = document.getElementById('voteForm');
-    if (voteForm) {
-        voteForm.addEventListener('submit', function(e) {
-            const selectedCandidate = document.querySelector('input[name="candidate_id"]:checked');
-            if (!selectedCandidate) {
-                e.preventDefault();
-                showNotification('Please select a candidate before submitting your vote.', 'warning');
-                return false;
-            }
-            
-            // Confirm vote submission
-            const candidateName = selectedCandidate.closest('.candidate-option').querySelector('h5').textContent;
-            if (!confirm(`Are you sure you want to vote for ${candidateName}? This action cannot be undone.`)) {
-                e.preventDefault();
-                return false;
-            }
-        });
-    }
 }
 
 // Smooth scrolling for anchor links